@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/StCredZero/ROTCS/protocol"
+	"github.com/satori/go.uuid"
+)
+
+/*
+The admin API lets an operator look at the live world and change it. It
+is served as JSON on its own listener, and every request must carry the
+admin token as "Authorization: Bearer <token>".
+
+	GET  /subgrids                      subgrids, with players, entities and life
+	POST /subgrids/<x>,<y>/life         {"allowed": bool, "active": bool}, either may be left out
+	POST /subgrids/<x>,<y>/release      let a quarantined subgrid step again, as it is
+	POST /subgrids/<x>,<y>/rebuild      replace a subgrid with a fresh one, keeping its players
+	GET  /players                       connected players
+	GET  /entities/<id>                 one entity
+	POST /players/<id>/teleport         {"x": n, "y": n}
+	POST /players/<id>/kick
+	POST /players/<id>/heal             {"health": n}, or full health without a body
+	POST /players/<id>/kill
+	POST /spawn                         {"archetype": "monster", "x": n, "y": n}
+	POST /broadcast                     {"message": "..."}
+	GET  /slow-ticks                    the tick profiler's last reports
+
+The world belongs to the tick goroutine, so handlers don't touch it. They
+queue a command, which Step runs between ticks the way it takes in
+register and unregister, and wait for its reply.
+*/
+
+// How long a handler waits for the tick loop to run its command
+const adminTimeout = 5 * time.Second
+
+type adminReply struct {
+	value interface{}
+	err   error
+}
+
+type adminCommand struct {
+	run   func(srv *CstServer) (interface{}, error)
+	reply chan adminReply
+	// Whether it changes the world, which no one may do to a replay
+	mutates bool
+}
+
+// adminError carries the HTTP status an admin command failed with
+type adminError struct {
+	status  int
+	message string
+}
+
+func (self *adminError) Error() string {
+	return self.message
+}
+
+func adminErrorf(status int, format string, args ...interface{}) error {
+	return &adminError{status, fmt.Sprintf(format, args...)}
+}
+
+/*
+Admin changes to the world. They go into the replay log, so a playback
+makes them at the same point. Kicks and broadcasts aren't among them: a
+kick is recorded as the player leaving, and messages don't change the
+world.
+*/
+const adminTeleport = 't'
+const adminHealth = 'h'
+const adminSpawn = 's'
+const adminLife = 'l'
+const adminGod = 'g'
+const adminGameplay = 'c'
+const adminRelease = 'u'
+const adminRebuild = 'r'
+
+type adminChange struct {
+	op        byte
+	id        EntityID
+	loc       Coord
+	gcoord    GridCoord
+	health    int
+	archetype string
+	allowed   bool
+	active    bool
+	detection int
+	tries     int
+}
+
+// applyChange makes a change to the world, or says why it can't
+func applyChange(world *WorldGrid, change adminChange) error {
+	switch change.op {
+	case adminTeleport:
+		ntt := world.EntityByID(change.id)
+		if ntt == nil {
+			return adminErrorf(http.StatusNotFound, "no entity %v", change.id)
+		}
+		if !world.PassableAt(change.loc) {
+			return adminErrorf(http.StatusConflict, "%v is not open floor", change.loc)
+		}
+		world.MoveEntity(ntt, change.loc)
+		// The client gets a whole map, not a line, after the jump
+		ntt.SetInitialized(false)
+	case adminHealth:
+		ntt := world.EntityByID(change.id)
+		if ntt == nil {
+			return adminErrorf(http.StatusNotFound, "no entity %v", change.id)
+		}
+		ntt.SetHealth(change.health)
+	case adminSpawn:
+		archetype, present := SpawnArchetypes[change.archetype]
+		if !present {
+			return adminErrorf(http.StatusBadRequest, "unknown archetype %q", change.archetype)
+		}
+		if !world.PassableAt(change.loc) {
+			return adminErrorf(http.StatusConflict, "%v is not open floor", change.loc)
+		}
+		ntt := archetype(world)
+		ntt.SetEntityID(world.NewEntityID())
+		world.PutEntityAt(ntt, change.loc)
+	case adminLife:
+		if change.active && !change.allowed {
+			return adminErrorf(http.StatusConflict, "life isn't allowed in %v", change.gcoord)
+		}
+		subgrid := world.subgridAtGrid(change.gcoord)
+		subgrid.lifeAllowed = change.allowed
+		subgrid.lifeActive = change.active
+	case adminGod:
+		player, ok := world.EntityByID(change.id).(*Player)
+		if !ok {
+			return adminErrorf(http.StatusNotFound, "no player %v", change.id)
+		}
+		player.god = change.active
+	case adminGameplay:
+		detectionRadius = change.detection
+		placementTries = change.tries
+	case adminRelease, adminRebuild:
+		return applyRepair(world, change)
+	default:
+		return adminErrorf(http.StatusBadRequest, "unknown change %q", change.op)
+	}
+	return nil
+}
+
+// change makes an admin change to the live world and records it
+func (srv *CstServer) change(change adminChange) error {
+	if srv.playback != nil {
+		return adminErrorf(http.StatusConflict, "the world is a replay")
+	}
+	if err := applyChange(srv.world, change); err != nil {
+		return err
+	}
+	srv.recorder.Admin(change)
+	return nil
+}
+
+// runAdminCommands runs the queued admin commands. Called once per tick.
+// A replay would no longer match its digests after a change, so commands
+// that make one are refused.
+func (srv *CstServer) runAdminCommands() {
+	for {
+		select {
+		case cmd := <-srv.adminQueue:
+			var value interface{}
+			var err error
+			if cmd.mutates && srv.playback != nil {
+				err = adminErrorf(http.StatusConflict, "the world is a replay")
+			} else {
+				value, err = cmd.run(srv)
+			}
+			if cmd.reply != nil {
+				cmd.reply <- adminReply{value, err}
+			}
+		default:
+			return
+		}
+	}
+}
+
+type subgridInfo struct {
+	X           int64 `json:"x"`
+	Y           int64 `json:"y"`
+	Players     int   `json:"players"`
+	Entities    int   `json:"entities"`
+	LifeAllowed bool  `json:"life_allowed"`
+	LifeActive  bool  `json:"life_active"`
+	// Why the subgrid stopped stepping, and the entities that broke its
+	// invariants
+	Quarantined string   `json:"quarantined,omitempty"`
+	Suspects    []string `json:"suspects,omitempty"`
+}
+
+func (srv *CstServer) subgridInfos() []subgridInfo {
+	infos := make([]subgridInfo, 0, len(srv.world.grid))
+	for _, gcoord := range srv.world.gridCoords() {
+		subgrid := srv.world.grid[gcoord]
+		info := subgridInfo{
+			X:           gcoord.x,
+			Y:           gcoord.y,
+			Players:     subgrid.PlayerCount,
+			Entities:    len(subgrid.Entities),
+			LifeAllowed: subgrid.lifeAllowed,
+			LifeActive:  subgrid.lifeActive,
+			Quarantined: subgrid.quarantined,
+		}
+		for _, id := range subgrid.suspects {
+			info.Suspects = append(info.Suspects, id.String())
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+type entityInfo struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Symbol    string `json:"symbol"`
+	X         int64  `json:"x"`
+	Y         int64  `json:"y"`
+	GridX     int64  `json:"grid_x"`
+	GridY     int64  `json:"grid_y"`
+	Health    int    `json:"health"`
+	Direction string `json:"direction,omitempty"`
+	// For players
+	Name       string          `json:"name,omitempty"`
+	State      string          `json:"state,omitempty"`
+	Connection *connectionInfo `json:"connection,omitempty"`
+}
+
+// connectionInfo is how a player's client keeps up
+type connectionInfo struct {
+	Remote      string  `json:"remote,omitempty"`
+	SentBytes   uint64  `json:"sent_bytes"`
+	BytesPerSec uint64  `json:"bytes_per_sec"`
+	LagMS       float64 `json:"lag_ms"`
+	Coalesced   uint64  `json:"coalesced"`
+	Dropped     uint64  `json:"dropped"`
+	Limited     uint64  `json:"limited"`
+}
+
+func newConnectionInfo(c *connection) *connectionInfo {
+	return &connectionInfo{
+		Remote:      c.remote,
+		SentBytes:   atomic.LoadUint64(&c.sent),
+		BytesPerSec: c.bandwidth,
+		LagMS:       float64(c.Lag()) / float64(time.Millisecond),
+		Coalesced:   atomic.LoadUint64(&c.coalesced),
+		Dropped:     atomic.LoadUint64(&c.dropped),
+		Limited:     atomic.LoadUint64(&c.limitedCount),
+	}
+}
+
+func (srv *CstServer) entityInfo(ntt Entity) entityInfo {
+	loc := ntt.Coord()
+	gcoord := loc.Grid(srv.world)
+	info := entityInfo{
+		ID:     ntt.EntityID().String(),
+		Type:   entityKind(ntt),
+		Symbol: string(ntt.DisplaySymbol()),
+		X:      loc.x,
+		Y:      loc.y,
+		GridX:  gcoord.x,
+		GridY:  gcoord.y,
+		Health: ntt.Health(),
+	}
+	if dir := ntt.Direction(); dir != 0 {
+		info.Direction = string(dir)
+	}
+	if player, ok := ntt.(*Player); ok {
+		info.Name = player.DisplayString()
+		info.State = playerState(player)
+		info.Connection = newConnectionInfo(player.Connection)
+	}
+	return info
+}
+
+func playerState(player *Player) string {
+	switch {
+	case player.IsDead():
+		return "dead"
+	case player.dropped:
+		return "dropped"
+	case player.Connection.Blurred():
+		return "blurred"
+	}
+	return "playing"
+}
+
+func (srv *CstServer) playerInfos() []entityInfo {
+	infos := make([]entityInfo, 0, len(srv.connections))
+	for c, _ := range srv.connections {
+		infos = append(infos, srv.entityInfo(c.player))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// playerConnection finds the connection of a connected player
+func (srv *CstServer) playerConnection(id EntityID) (*connection, error) {
+	if c, present := srv.liveConnection(id, nil); present {
+		return c, nil
+	}
+	return nil, adminErrorf(http.StatusNotFound, "no player %v", id)
+}
+
+// kick removes a player from the world at once, without the grace a
+// dropped player gets, and hangs up on its client once it has been told
+func (srv *CstServer) kick(c *connection) {
+	var buffer bytes.Buffer
+	frame := protocol.Message{Data: "You were removed from the server"}
+	protocol.Encode(c.codec, &frame, &buffer)
+	c.queue(buffer.Bytes())
+	c.hangUpFor(closeKicked, "kicked")
+	delete(srv.dropped, c.id)
+	srv.unregisterConnection(c)
+}
+
+func (srv *CstServer) broadcast(message string) {
+	for c, _ := range srv.connections {
+		c.player.AddMessage(message)
+	}
+	for _, spectator := range srv.spectators {
+		spectator.AddMessage(message)
+	}
+}
+
+// loadAdminToken reads the admin token, making one the first time, as
+// loadHostKey does the SSH host key
+func loadAdminToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		var secret [24]byte
+		if _, err := rand.Read(secret[:]); err != nil {
+			return "", err
+		}
+		token := hex.EncodeToString(secret[:])
+		if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			return "", err
+		}
+		serverLog.Info("generated admin token", "path", path)
+		return token, nil
+	} else if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// AdminAPI serves the admin endpoints of srv to holders of token
+type AdminAPI struct {
+	srv   *CstServer
+	token string
+	mux   *http.ServeMux
+}
+
+func NewAdminAPI(srv *CstServer, token string) *AdminAPI {
+	api := &AdminAPI{srv: srv, token: token, mux: http.NewServeMux()}
+	api.mux.HandleFunc("/subgrids", api.handleSubgrids)
+	api.mux.HandleFunc("/subgrids/", api.handleSubgrid)
+	api.mux.HandleFunc("/players", api.handlePlayers)
+	api.mux.HandleFunc("/players/", api.handlePlayer)
+	api.mux.HandleFunc("/entities/", api.handleEntity)
+	api.mux.HandleFunc("/spawn", api.handleSpawn)
+	api.mux.HandleFunc("/broadcast", api.handleBroadcast)
+	api.mux.Handle("/slow-ticks", srv.profiler)
+	return api
+}
+
+func (self *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(self.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAdminError(w, adminErrorf(http.StatusUnauthorized, "bad admin token"))
+		return
+	}
+	self.mux.ServeHTTP(w, r)
+}
+
+// run has the tick loop run a command and writes its reply
+func (self *AdminAPI) run(w http.ResponseWriter, run func(srv *CstServer) (interface{}, error)) {
+	self.send(w, adminCommand{run: run, reply: make(chan adminReply, 1)})
+}
+
+// mutate is run for commands that change the world
+func (self *AdminAPI) mutate(w http.ResponseWriter, run func(srv *CstServer) (interface{}, error)) {
+	self.send(w, adminCommand{run: run, reply: make(chan adminReply, 1), mutates: true})
+}
+
+// send queues cmd for the tick loop and writes its reply
+func (self *AdminAPI) send(w http.ResponseWriter, cmd adminCommand) {
+	timeout := time.After(adminTimeout)
+	select {
+	case self.srv.adminQueue <- cmd:
+	case <-timeout:
+		writeAdminError(w, adminErrorf(http.StatusServiceUnavailable, "the server is busy"))
+		return
+	}
+	select {
+	case reply := <-cmd.reply:
+		if reply.err != nil {
+			writeAdminError(w, reply.err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, reply.value)
+	case <-timeout:
+		writeAdminError(w, adminErrorf(http.StatusServiceUnavailable, "the tick loop didn't answer"))
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		status, data = http.StatusInternalServerError, []byte(`{"error": "encoding the reply"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if aerr, ok := err.(*adminError); ok {
+		status = aerr.status
+	}
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAdminError(w, adminErrorf(http.StatusMethodNotAllowed, "use %s", method))
+		return false
+	}
+	return true
+}
+
+// readBody decodes a JSON body into v. An empty body leaves v as it was.
+func readBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err == nil && len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		writeAdminError(w, adminErrorf(http.StatusBadRequest, "bad body: %v", err))
+		return false
+	}
+	return true
+}
+
+func parseEntityID(s string) (EntityID, error) {
+	id, err := uuid.FromString(s)
+	if err != nil {
+		return EntityID{}, adminErrorf(http.StatusBadRequest, "bad entity id %q", s)
+	}
+	return EntityID(id), nil
+}
+
+var adminOK = map[string]bool{"ok": true}
+
+func (self *AdminAPI) handleSubgrids(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	self.run(w, func(srv *CstServer) (interface{}, error) {
+		return srv.subgridInfos(), nil
+	})
+}
+
+// handleSubgrid serves /subgrids/<x>,<y>/life, release and rebuild
+func (self *AdminAPI) handleSubgrid(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/subgrids/"), "/")
+	if len(parts) != 2 || (parts[1] != "life" && parts[1] != "release" && parts[1] != "rebuild") {
+		http.NotFound(w, r)
+		return
+	}
+	xy := strings.Split(parts[0], ",")
+	var gcoord GridCoord
+	var errX, errY error
+	if len(xy) == 2 {
+		gcoord.x, errX = strconv.ParseInt(xy[0], 10, 64)
+		gcoord.y, errY = strconv.ParseInt(xy[1], 10, 64)
+	}
+	if len(xy) != 2 || errX != nil || errY != nil {
+		writeAdminError(w, adminErrorf(http.StatusBadRequest, "bad subgrid %q", parts[0]))
+		return
+	}
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	if parts[1] != "life" {
+		op := byte(adminRelease)
+		if parts[1] == "rebuild" {
+			op = adminRebuild
+		}
+		self.mutate(w, func(srv *CstServer) (interface{}, error) {
+			if err := srv.change(adminChange{op: op, gcoord: gcoord}); err != nil {
+				return nil, err
+			}
+			adminLog.Info("subgrid "+parts[1]+"d", "subgrid", gcoord, tickAttr(srv.tickNumber))
+			return srv.subgridInfo(gcoord), nil
+		})
+		return
+	}
+	var body struct {
+		Allowed *bool `json:"allowed"`
+		Active  *bool `json:"active"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	self.mutate(w, func(srv *CstServer) (interface{}, error) {
+		change := adminChange{op: adminLife, gcoord: gcoord}
+		if subgrid := srv.world.safeSubgridAtGrid(gcoord); subgrid != nil {
+			change.allowed, change.active = subgrid.lifeAllowed, subgrid.lifeActive
+		} else {
+			change.allowed = true
+		}
+		if body.Allowed != nil {
+			change.allowed = *body.Allowed
+		}
+		if body.Active != nil {
+			change.active = *body.Active
+		}
+		if err := srv.change(change); err != nil {
+			return nil, err
+		}
+		return srv.subgridInfo(gcoord), nil
+	})
+}
+
+// subgridInfo describes one subgrid, or says all is well if it was
+// discarded
+func (srv *CstServer) subgridInfo(gcoord GridCoord) interface{} {
+	for _, info := range srv.subgridInfos() {
+		if info.X == gcoord.x && info.Y == gcoord.y {
+			return info
+		}
+	}
+	return adminOK
+}
+
+func (self *AdminAPI) handlePlayers(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	self.run(w, func(srv *CstServer) (interface{}, error) {
+		return srv.playerInfos(), nil
+	})
+}
+
+func (self *AdminAPI) handleEntity(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	id, err := parseEntityID(strings.TrimPrefix(r.URL.Path, "/entities/"))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	self.run(w, func(srv *CstServer) (interface{}, error) {
+		ntt := srv.world.EntityByID(id)
+		if ntt == nil {
+			return nil, adminErrorf(http.StatusNotFound, "no entity %v", id)
+		}
+		return srv.entityInfo(ntt), nil
+	})
+}
+
+// handlePlayer serves /players/<id>/<action>
+func (self *AdminAPI) handlePlayer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/players/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := parseEntityID(parts[0])
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	var change adminChange
+	switch parts[1] {
+	case "teleport":
+		var body struct {
+			X *int64 `json:"x"`
+			Y *int64 `json:"y"`
+		}
+		if !readBody(w, r, &body) {
+			return
+		}
+		if body.X == nil || body.Y == nil {
+			writeAdminError(w, adminErrorf(http.StatusBadRequest, "teleport needs x and y"))
+			return
+		}
+		change = adminChange{op: adminTeleport, id: id, loc: Coord{*body.X, *body.Y}}
+	case "heal":
+		body := struct {
+			Health int `json:"health"`
+		}{playerHealth}
+		if !readBody(w, r, &body) {
+			return
+		}
+		change = adminChange{op: adminHealth, id: id, health: body.Health}
+	case "kill":
+		change = adminChange{op: adminHealth, id: id, health: playerDeadHealth}
+	case "kick":
+		self.mutate(w, func(srv *CstServer) (interface{}, error) {
+			c, err := srv.playerConnection(id)
+			if err != nil {
+				return nil, err
+			}
+			srv.kick(c)
+			return adminOK, nil
+		})
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	self.mutate(w, func(srv *CstServer) (interface{}, error) {
+		c, err := srv.playerConnection(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := srv.change(change); err != nil {
+			return nil, err
+		}
+		return srv.entityInfo(c.player), nil
+	})
+}
+
+func (self *AdminAPI) handleSpawn(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	var body struct {
+		Archetype string `json:"archetype"`
+		X         *int64 `json:"x"`
+		Y         *int64 `json:"y"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	if body.X == nil || body.Y == nil {
+		writeAdminError(w, adminErrorf(http.StatusBadRequest, "spawn needs x and y"))
+		return
+	}
+	loc := Coord{*body.X, *body.Y}
+	self.mutate(w, func(srv *CstServer) (interface{}, error) {
+		change := adminChange{op: adminSpawn, archetype: body.Archetype, loc: loc}
+		if err := srv.change(change); err != nil {
+			return nil, err
+		}
+		ntt, _ := srv.world.EntityAt(loc)
+		return srv.entityInfo(ntt), nil
+	})
+}
+
+func (self *AdminAPI) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	if body.Message == "" {
+		writeAdminError(w, adminErrorf(http.StatusBadRequest, "broadcast needs a message"))
+		return
+	}
+	self.run(w, func(srv *CstServer) (interface{}, error) {
+		srv.broadcast(body.Message)
+		return adminOK, nil
+	})
+}
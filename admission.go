@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// Admission lanes, served in order. Clients that come back with a valid
+// resume token after their player expired go ahead of new arrivals.
+const laneResume = 0
+const laneNew = 1
+const laneCount = 2
+
+// Waiting clients get their queue frame again this often even if their
+// position didn't change, so the wait estimate stays fresh
+var queueRefreshTicks = ticksPerSec * 5
+
+/*
+AdmissionQueue holds connections waiting for a player slot, first come
+first served within each lane. It also keeps a running estimate of how
+often slots free up so it can tell clients how long they'll wait.
+
+Only runLoop touches it.
+*/
+type AdmissionQueue struct {
+	lanes [laneCount][]*connection
+
+	lastDeparture     time.Time
+	departureInterval time.Duration
+}
+
+func NewAdmissionQueue() *AdmissionQueue {
+	return &AdmissionQueue{}
+}
+
+func (self *AdmissionQueue) Len() int {
+	n := 0
+	for _, lane := range self.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+func (self *AdmissionQueue) Push(c *connection, lane int) {
+	self.lanes[lane] = append(self.lanes[lane], c)
+}
+
+func (self *AdmissionQueue) Pop() (*connection, bool) {
+	for i, lane := range self.lanes {
+		if len(lane) > 0 {
+			c := lane[0]
+			lane[0] = nil
+			self.lanes[i] = lane[1:]
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func (self *AdmissionQueue) Remove(c *connection) bool {
+	for i, lane := range self.lanes {
+		for j, queued := range lane {
+			if queued == c {
+				self.lanes[i] = append(lane[:j], lane[j+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Each visits the waiting connections in admission order. Positions
+// start at 1.
+func (self *AdmissionQueue) Each(visit func(*connection, int)) {
+	position := 1
+	for _, lane := range self.lanes {
+		for _, c := range lane {
+			visit(c, position)
+			position++
+		}
+	}
+}
+
+// NoteDeparture records a freed slot. The interval between departures
+// is smoothed so one burst doesn't swing every estimate.
+func (self *AdmissionQueue) NoteDeparture(now time.Time) {
+	if !self.lastDeparture.IsZero() {
+		interval := now.Sub(self.lastDeparture)
+		if self.departureInterval == 0 {
+			self.departureInterval = interval
+		} else {
+			self.departureInterval = (self.departureInterval*4 + interval) / 5
+		}
+	}
+	self.lastDeparture = now
+}
+
+// EstimatedWait is zero when there's no estimate yet
+func (self *AdmissionQueue) EstimatedWait(position int) time.Duration {
+	return self.departureInterval * time.Duration(position)
+}
+
+func (srv *CstServer) hasCapacity() bool {
+	return len(srv.connections) < srv.config.MaxPopulation &&
+		srv.load < srv.config.MaxLoad
+}
+
+// admit creates the connection's player and tells the client
+func (srv *CstServer) admit(c *connection) {
+	var buffer bytes.Buffer
+	player := NewPlayer(c, srv.world, srv.world.offsets)
+	entity, _ := srv.world.NewEntity(player)
+	c.setPlayer(entity.EntityID(), player)
+	srv.connections[c] = c.id
+	srv.recorder.Join(c.id, entity.Coord())
+	frame := protocol.Init{
+		Approved: true,
+		ID:       c.id,
+		Token:    srv.issueToken(player),
+		Pop:      srv.population,
+		Load:     srv.load,
+	}
+	protocol.Encode(c.codec, &frame, &buffer)
+	c.queue(buffer.Bytes())
+	logTrace(netLog, "admitted", "conn", c, "at", entity.Coord())
+}
+
+// turnAway tells a client there's no room, even to wait, and hangs up
+func (srv *CstServer) turnAway(c *connection) {
+	var buffer bytes.Buffer
+	frame := protocol.Init{Pop: srv.population, Load: srv.load}
+	protocol.Encode(c.codec, &frame, &buffer)
+	c.queue(buffer.Bytes())
+	c.hangUpFor(closeServerFull, "server full")
+	logTrace(netLog, "turned away", "conn", c)
+}
+
+// admitWaiting lets in as many waiting connections as there is room for
+// and tells the rest where they stand. Called once per tick.
+func (srv *CstServer) admitWaiting() {
+	for srv.hasCapacity() {
+		c, ok := srv.admission.Pop()
+		if !ok {
+			break
+		}
+		srv.admit(c)
+	}
+	srv.notifyQueue(srv.tickNumber%queueRefreshTicks == 0)
+}
+
+// notifyQueue sends queue frames to waiting connections whose position
+// changed, or to all of them when refresh is set
+func (srv *CstServer) notifyQueue(refresh bool) {
+	length := srv.admission.Len()
+	srv.admission.Each(func(c *connection, position int) {
+		if position == c.queuePosition && !refresh {
+			return
+		}
+		c.queuePosition = position
+		var buffer bytes.Buffer
+		frame := protocol.Queue{
+			Position: position,
+			Length:   length,
+			Wait:     int((srv.admission.EstimatedWait(position) + time.Second - 1) / time.Second),
+		}
+		protocol.Encode(c.codec, &frame, &buffer)
+		c.queue(buffer.Bytes())
+	})
+}
@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/StCredZero/ROTCS/client"
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+/*
+Behavior decides what a bot does next. Act is called with the bot's view
+each time the bot is due to act, and returns the command to send, if any.
+The bot's connection stamps it.
+*/
+type Behavior interface {
+	Act(view *client.View, rng *rand.Rand) (protocol.Command, bool)
+}
+
+func move(moves string) (protocol.Command, bool) {
+	if len(moves) > protocol.MaxMoves {
+		moves = moves[:protocol.MaxMoves]
+	}
+	return protocol.Command{Type: protocol.CmdMove, Data: moves}, moves != ""
+}
+
+// RandomWalk takes a few steps at a time in a random open direction
+type RandomWalk struct{}
+
+func (self RandomWalk) Act(view *client.View, rng *rand.Rand) (protocol.Command, bool) {
+	open := make([]rune, 0, 4)
+	for _, dir := range client.Directions {
+		if view.Walkable(view.At.Moved(dir)) {
+			open = append(open, dir)
+		}
+	}
+	if len(open) == 0 {
+		return move(string(client.Directions[rng.Intn(len(client.Directions))]))
+	}
+	dir := open[rng.Intn(len(open))]
+	moves := make([]rune, 0, 4)
+	at := view.At
+	for n := 1 + rng.Intn(4); n > 0 && view.Walkable(at.Moved(dir)); n-- {
+		moves = append(moves, dir)
+		at = at.Moved(dir)
+	}
+	return move(string(moves))
+}
+
+// Explore walks to the nearest floor it hasn't seen past, so it keeps
+// pulling new map in. It walks randomly when there is nowhere new.
+type Explore struct{}
+
+func (self Explore) Act(view *client.View, rng *rand.Rand) (protocol.Command, bool) {
+	path, found := view.PathTo(func(at client.Point) bool {
+		for _, dir := range client.Directions {
+			if _, known := view.Tiles[at.Moved(dir)]; !known {
+				return true
+			}
+		}
+		return false
+	})
+	if found {
+		return move(path)
+	}
+	return RandomWalk{}.Act(view, rng)
+}
+
+// Fight goes after the nearest monster in view, and explores when there
+// isn't one
+type Fight struct{}
+
+const monsterSymbol = '%'
+
+func (self Fight) Act(view *client.View, rng *rand.Rand) (protocol.Command, bool) {
+	monsters := make(map[client.Point]bool)
+	for _, mark := range view.Marks {
+		if mark.Symbol == monsterSymbol {
+			monsters[mark.At] = true
+		}
+	}
+	if len(monsters) > 0 {
+		path, found := view.PathTo(func(at client.Point) bool {
+			return monsters[at]
+		})
+		if found {
+			return move(path)
+		}
+	}
+	return Explore{}.Act(view, rng)
+}
+
+// Chat says something one time in Every, and otherwise does what Then
+// does
+type Chat struct {
+	Every int
+	Lines []string
+	Then  Behavior
+}
+
+var chatLines = []string{
+	"hello",
+	"anyone here?",
+	"watch out for the %",
+	"this way",
+	"brb",
+}
+
+func (self Chat) Act(view *client.View, rng *rand.Rand) (protocol.Command, bool) {
+	every, lines, then := self.Every, self.Lines, self.Then
+	if every <= 0 {
+		every = 10
+	}
+	if len(lines) == 0 {
+		lines = chatLines
+	}
+	if then == nil {
+		then = RandomWalk{}
+	}
+	if rng.Intn(every) == 0 {
+		line := lines[rng.Intn(len(lines))]
+		return protocol.Command{Type: protocol.CmdChat, Data: line}, true
+	}
+	return then.Act(view, rng)
+}
+
+var behaviors = map[string]Behavior{
+	"random":  RandomWalk{},
+	"explore": Explore{},
+	"fight":   Fight{},
+	"chat":    Chat{},
+}
+
+// BehaviorNames lists the names ByName knows
+func BehaviorNames() []string {
+	names := make([]string, 0, len(behaviors))
+	for name, _ := range behaviors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func ByName(name string) (Behavior, error) {
+	behavior, present := behaviors[name]
+	if !present {
+		return nil, fmt.Errorf("bot: unknown behavior %q", name)
+	}
+	return behavior, nil
+}
@@ -0,0 +1,213 @@
+/*
+Package bot is a headless ROTCS client for load testing. A Bot connects
+with a client.Conn, keeps a client.View of the updates it is sent and
+lets a Behavior choose its commands. It counts what a load test
+wants to know: bytes each way, how long moves take to come back, and how
+the connection ended.
+*/
+package bot
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/StCredZero/ROTCS/client"
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// Stats is what a bot has counted so far. Latencies only holds the
+// samples since the last call to Sample.
+type Stats struct {
+	Admitted bool
+	// Turned away at the door, with no room even to wait
+	Refused bool
+	// Lost the connection after being admitted, without Close
+	Dropped bool
+	// Position in the admission queue; 0 when not waiting
+	Queued   int
+	Frames   int64
+	BytesIn  int64
+	BytesOut int64
+	// The server's tick load and population from the last update
+	Load      float64
+	Pop       int
+	Latencies []time.Duration
+}
+
+// DefaultInterval is how often a bot acts, close to a player's pace
+const DefaultInterval = 250 * time.Millisecond
+
+// maxPending bounds the moves a bot remembers waiting for their echo
+const maxPending = 256
+
+type Bot struct {
+	URL      string
+	Codec    int
+	Interval time.Duration
+
+	behavior Behavior
+	closed   bool
+	conn     *client.Conn
+	echoed   uint64
+	lastAct  time.Time
+	mutex    sync.Mutex
+	// Send times of moves, by timestamp, until the server echoes them
+	pending map[uint64]time.Time
+	rng     *rand.Rand
+	stats   Stats
+	view    *client.View
+}
+
+func New(wsURL string, behavior Behavior, seed int64) *Bot {
+	return &Bot{
+		URL:      wsURL,
+		Codec:    protocol.CodecJSON,
+		Interval: DefaultInterval,
+		behavior: behavior,
+		pending:  make(map[uint64]time.Time),
+		rng:      rand.New(rand.NewSource(seed)),
+		view:     client.NewView(),
+	}
+}
+
+/*
+Run connects and plays until the connection ends or Close is called. It
+returns nil when the bot was closed or turned away, and the error that
+ended the connection otherwise.
+*/
+func (self *Bot) Run() error {
+	conn, err := client.Dial(self.URL, self.Codec, protocol.MapBitmask)
+	if err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.conn = conn
+	closed := self.closed
+	self.mutex.Unlock()
+	if closed {
+		return conn.Close()
+	}
+	defer conn.Close()
+	for {
+		frame, size, err := conn.Read()
+		if size == 0 {
+			return self.ended(err)
+		}
+		self.mutex.Lock()
+		self.stats.Frames++
+		self.stats.BytesIn += int64(size)
+		self.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := self.handle(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *Bot) ended(err error) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed || self.stats.Refused {
+		return nil
+	}
+	if self.stats.Admitted {
+		self.stats.Dropped = true
+	}
+	return err
+}
+
+// Close hangs up. Run returns once it sees the connection close.
+func (self *Bot) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.closed = true
+	if self.conn != nil {
+		self.conn.Close()
+	}
+}
+
+// Admitted is true once the server has given the bot a player
+func (self *Bot) Admitted() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.stats.Admitted
+}
+
+// Sample returns the stats and starts a new set of latency samples
+func (self *Bot) Sample() Stats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	stats := self.stats
+	self.stats.Latencies = nil
+	return stats
+}
+
+func (self *Bot) handle(frame protocol.Frame) error {
+	switch frame := frame.(type) {
+	case *protocol.Init:
+		self.mutex.Lock()
+		self.stats.Admitted = frame.Approved
+		self.stats.Refused = !frame.Approved
+		self.stats.Queued = 0
+		self.stats.Load, self.stats.Pop = frame.Load, frame.Pop
+		self.mutex.Unlock()
+		self.view.ID = frame.ID
+	case *protocol.Queue:
+		self.mutex.Lock()
+		self.stats.Queued = frame.Position
+		self.mutex.Unlock()
+	case *protocol.Update:
+		self.view.Apply(frame)
+		self.echo(frame)
+		return self.act()
+	}
+	return nil
+}
+
+// echo times the move whose timestamp an update carries back
+func (self *Bot) echo(update *protocol.Update) {
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.stats.Load, self.stats.Pop = update.Load, update.Pop
+	if update.Timestamp == self.echoed {
+		return
+	}
+	self.echoed = update.Timestamp
+	if sentAt, present := self.pending[update.Timestamp]; present {
+		self.stats.Latencies = append(self.stats.Latencies, now.Sub(sentAt))
+	}
+	// Moves older than the echo were replaced before they were made
+	for stamp, _ := range self.pending {
+		if stamp <= update.Timestamp {
+			delete(self.pending, stamp)
+		}
+	}
+}
+
+// act sends the behavior's next command if the bot is due to act
+func (self *Bot) act() error {
+	now := time.Now()
+	if now.Sub(self.lastAct) < self.Interval {
+		return nil
+	}
+	self.lastAct = now
+	cmd, ok := self.behavior.Act(self.view, self.rng)
+	if !ok {
+		return nil
+	}
+	stamp, size, err := self.conn.Send(cmd)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if cmd.Type == protocol.CmdMove {
+		if len(self.pending) >= maxPending {
+			self.pending = make(map[uint64]time.Time)
+		}
+		self.pending[stamp] = now
+	}
+	self.stats.BytesOut += int64(size)
+	return err
+}
@@ -0,0 +1,120 @@
+/*
+Package client is the player's end of the ROTCS protocol, for programs
+that play without a browser. A Conn talks to /ws the way static/game.js
+does. A View keeps what the updates have shown of the world, and a Screen
+draws it in an ANSI terminal. The bots, the load tester, rotcs-client and
+the server's own telnet and SSH sessions all share it.
+*/
+package client
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/StCredZero/ROTCS/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Conn is a websocket connection to a ROTCS server
+type Conn struct {
+	Codec int
+	// Map encoding asked for, protocol.MapBitmask or protocol.MapTiles
+	MapVersion int
+
+	lastSent uint64
+	// Writes are serialized, as the websocket allows only one writer
+	mutex sync.Mutex
+	ws    *websocket.Conn
+}
+
+/*
+Dial connects to the server's websocket at wsURL, asking for frames in
+codec and maps in mapVersion. It doesn't wait to be admitted; the first
+frame read says whether the server took the connection.
+*/
+func Dial(wsURL string, codec int, mapVersion int) (*Conn, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	if codec == protocol.CodecBinary {
+		query.Set("codec", "bin")
+	}
+	if mapVersion != protocol.MapBitmask {
+		query.Set("v", strconv.Itoa(mapVersion))
+	}
+	u.RawQuery = query.Encode()
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Codec: codec, MapVersion: mapVersion, ws: ws}, nil
+}
+
+// Read waits for the next frame. It returns the frame's size on the wire
+// along with it, even when the frame can't be decoded; the size is 0 when
+// nothing could be read.
+func (self *Conn) Read() (protocol.Frame, int, error) {
+	_, data, err := self.ws.ReadMessage()
+	if err != nil {
+		return nil, 0, err
+	}
+	frame, err := protocol.Decode(self.Codec, data)
+	return frame, len(data), err
+}
+
+/*
+Send stamps cmd and sends it, returning the timestamp and the bytes
+written. Timestamps are the client's clock in milliseconds, as game.js
+sends, but never repeat, so each move can be told apart when an update
+echoes it.
+*/
+func (self *Conn) Send(cmd protocol.Command) (uint64, int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	stamp := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if stamp <= self.lastSent {
+		stamp = self.lastSent + 1
+	}
+	self.lastSent = stamp
+	cmd.Timestamp = stamp
+	message := cmd.AppendTo(make([]byte, 0, 32+len(cmd.Data)))
+	return stamp, len(message), self.ws.WriteMessage(websocket.TextMessage, message)
+}
+
+// Move asks to walk moves, at most protocol.MaxMoves of them
+func (self *Conn) Move(moves string) error {
+	_, _, err := self.Send(protocol.Command{Type: protocol.CmdMove, Data: moves})
+	return err
+}
+
+// LifeCell flips the life cell where the player stands
+func (self *Conn) LifeCell() error {
+	_, _, err := self.Send(protocol.Command{Type: protocol.CmdLifeCell})
+	return err
+}
+
+// LifeActivate switches the life system in the player's subgrid on or off
+func (self *Conn) LifeActivate() error {
+	_, _, err := self.Send(protocol.Command{Type: protocol.CmdLifeActivate})
+	return err
+}
+
+// Blur tells the server whether anyone is watching. While blurred the
+// server sends no updates.
+func (self *Conn) Blur(blurred bool) error {
+	data := "0"
+	if blurred {
+		data = "1"
+	}
+	_, _, err := self.Send(protocol.Command{Type: protocol.CmdBlur, Data: data})
+	return err
+}
+
+// Close hangs up. A Read in progress returns with an error.
+func (self *Conn) Close() error {
+	return self.ws.Close()
+}
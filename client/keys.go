@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// Keys, like the browser's, except hjkl also move and p is the life pen
+var keyCommands = map[byte]protocol.Command{
+	'k': {Type: protocol.CmdMove, Data: "n"},
+	'j': {Type: protocol.CmdMove, Data: "s"},
+	'l': {Type: protocol.CmdMove, Data: "e"},
+	'h': {Type: protocol.CmdMove, Data: "w"},
+	'o': {Type: protocol.CmdInteract},
+	'a': {Type: protocol.CmdLifeActivate},
+	'p': {Type: protocol.CmdLifeCell},
+}
+
+// Arrow keys end ESC [ A through ESC [ D, or ESC O A in application mode.
+// Focus reports, once Screen.Start asks for them, are ESC [ I and ESC [ O.
+var keyArrows = map[byte]string{'A': "n", 'B': "s", 'C': "e", 'D': "w"}
+var keyFocus = map[byte]string{'I': "0", 'O': "1"}
+
+// KeyReader turns the keys read from a terminal into commands
+type KeyReader struct {
+	in *bufio.Reader
+}
+
+func NewKeyReader(r io.Reader) *KeyReader {
+	return &KeyReader{in: bufio.NewReader(r)}
+}
+
+/*
+ReadCommand reads keys until one that means something and returns its
+command, without a timestamp. quit is true for q, ^C and ^D. The terminal
+losing focus blurs the view, as the browser window does.
+*/
+func (self *KeyReader) ReadCommand() (cmd protocol.Command, quit bool, err error) {
+	for {
+		b, err := self.in.ReadByte()
+		if err != nil {
+			return cmd, false, err
+		}
+		switch b {
+		case 'q', 3, 4:
+			return cmd, true, nil
+		case 0x1b:
+			b1, err := self.in.ReadByte()
+			if err != nil {
+				return cmd, false, err
+			}
+			b2, err := self.in.ReadByte()
+			if err != nil {
+				return cmd, false, err
+			}
+			if move, present := keyArrows[b2]; present && (b1 == '[' || b1 == 'O') {
+				return protocol.Command{Type: protocol.CmdMove, Data: move}, false, nil
+			}
+			if blurred, present := keyFocus[b2]; present && b1 == '[' {
+				return protocol.Command{Type: protocol.CmdBlur, Data: blurred}, false, nil
+			}
+		default:
+			if cmd, present := keyCommands[b]; present {
+				return cmd, false, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// Below the map are a status line and the last few messages
+const statusRow = protocol.ViewHeight + 1
+const messageRows = 3
+
+// ScreenHeight is the rows a Screen uses
+const ScreenHeight = statusRow + messageRows
+
+// KeyHelp is shown when the player is admitted
+const KeyHelp = "Arrows or hjkl move. o opens doors, a and p work the life system, q quits."
+
+// Cell styles, as SGR sequences. They follow display.js: walls are grey
+// blocks, floor is blank and life cells are white.
+const (
+	styleFloor = iota
+	styleWall
+	styleDoor
+	styleDoorClosed
+	styleDoorLocked
+	styleLife
+	styleSelf
+	stylePlayer
+	styleMonster
+	styleLoot
+	styleGuard
+	styleOther
+)
+
+var styleSGR = []string{
+	styleFloor:      "\x1b[0m",
+	styleWall:       "\x1b[0;47m",
+	styleDoor:       "\x1b[0;33m",
+	styleDoorClosed: "\x1b[0;30;43m",
+	styleDoorLocked: "\x1b[0;37;41m",
+	styleLife:       "\x1b[0;107m",
+	styleSelf:       "\x1b[0;1;94m",
+	stylePlayer:     "\x1b[0;34m",
+	styleMonster:    "\x1b[0;1;37m",
+	styleLoot:       "\x1b[0;32m",
+	styleGuard:      "\x1b[0;1;34m",
+	styleOther:      "\x1b[0m",
+}
+
+type cell struct {
+	ch    rune
+	style uint8
+}
+
+func tileCell(tile int8) cell {
+	switch tile {
+	case protocol.TileFloor, protocol.TileCorridor:
+		return cell{' ', styleFloor}
+	case protocol.TileDoor:
+		return cell{'\'', styleDoor}
+	case protocol.TileDoorClosed:
+		return cell{'+', styleDoorClosed}
+	case protocol.TileDoorLocked:
+		return cell{'+', styleDoorLocked}
+	}
+	return cell{' ', styleWall}
+}
+
+func markCell(symbol rune) cell {
+	switch symbol {
+	case '@':
+		return cell{symbol, stylePlayer}
+	case '%':
+		return cell{symbol, styleMonster}
+	case '+':
+		return cell{symbol, styleLoot}
+	case 'G':
+		return cell{symbol, styleGuard}
+	}
+	return cell{symbol, styleOther}
+}
+
+// The player is drawn facing its direction, since that is where its
+// shield is
+func selfCell(direction rune) cell {
+	switch direction {
+	case 'n':
+		return cell{'^', styleSelf}
+	case 's':
+		return cell{'v', styleSelf}
+	case 'e':
+		return cell{'>', styleSelf}
+	case 'w':
+		return cell{'<', styleSelf}
+	}
+	return cell{'@', styleSelf}
+}
+
+/*
+Screen draws the game in an ANSI terminal: the view's map, a status line
+and the last few messages. It remembers what is on the terminal and
+redraws only the cells that changed. Nothing is written until Flush.
+*/
+type Screen struct {
+	// On the terminal, or nothing before the first draw
+	drawn    []cell
+	messages []string
+	out      *bufio.Writer
+	next     []cell
+	status   string
+}
+
+func NewScreen(w io.Writer) *Screen {
+	return &Screen{
+		out:  bufio.NewWriterSize(w, 8192),
+		next: make([]cell, protocol.ViewWidth*protocol.ViewHeight),
+	}
+}
+
+// Start clears the terminal, hides the cursor and asks the terminal to
+// report focus, which KeyReader turns into blur commands
+func (self *Screen) Start() {
+	self.out.WriteString("\x1b[0m\x1b[2J\x1b[?25l\x1b[?1004h")
+}
+
+// Stop puts the terminal back the way Start found it, below the screen
+func (self *Screen) Stop() {
+	fmt.Fprintf(self.out, "\x1b[?1004l\x1b[0m\x1b[?25h\x1b[%d;1H\r\n", ScreenHeight)
+}
+
+func (self *Screen) Flush() error {
+	return self.out.Flush()
+}
+
+// Show applies frame to view and draws what changed
+func (self *Screen) Show(view *View, frame protocol.Frame) {
+	switch frame := frame.(type) {
+	case *protocol.Init:
+		view.ID = frame.ID
+		if frame.Approved {
+			self.AddMessage(KeyHelp)
+		} else {
+			self.SetStatus("The server is full. Try again later.")
+		}
+	case *protocol.Queue:
+		self.SetStatus(fmt.Sprintf("Waiting in line: %d of %d", frame.Position, frame.Length))
+	case *protocol.Message:
+		self.AddMessage(frame.Data)
+	case *protocol.Shutdown:
+		what := "shutting down"
+		if frame.Restart {
+			what = "restarting"
+		}
+		if frame.Seconds > 0 {
+			self.AddMessage(fmt.Sprintf("Server %s in %ds.", what, frame.Seconds))
+		} else {
+			self.AddMessage(fmt.Sprintf("Server %s now.", what))
+		}
+	case *protocol.Update:
+		view.Apply(frame)
+		self.Draw(view)
+		for _, msg := range frame.Messages {
+			self.AddMessage(msg)
+		}
+		status := fmt.Sprintf("HP %d  Pop %d  Load %.2f  (%d, %d)",
+			frame.Health, frame.Pop, frame.Load, frame.X, frame.Y)
+		if frame.Collided {
+			status += "  *bump*"
+		}
+		self.SetStatus(status)
+	}
+}
+
+// Draw writes the map cells of view that differ from what is on the
+// terminal
+func (self *Screen) Draw(view *View) {
+	width, height := protocol.ViewWidth, protocol.ViewHeight
+	corner := view.Corner()
+	for i, _ := range self.next {
+		self.next[i] = tileCell(view.Tile(Point{corner.X + int64(i%width), corner.Y + int64(i/width)}))
+		if i < len(view.Life) && view.Life[i] {
+			self.next[i] = cell{' ', styleLife}
+		}
+	}
+	for _, mark := range view.Marks {
+		x, y := mark.At.X-corner.X, mark.At.Y-corner.Y
+		if 0 <= x && x < int64(width) && 0 <= y && y < int64(height) {
+			self.next[int(y)*width+int(x)] = markCell(mark.Symbol)
+		}
+	}
+	self.next[(height/2)*width+width/2] = selfCell(view.Direction)
+
+	first := self.drawn == nil
+	if first {
+		self.drawn = make([]cell, len(self.next))
+	}
+	style := -1
+	nextAt := -1
+	for i, c := range self.next {
+		if !first && c == self.drawn[i] {
+			continue
+		}
+		if i != nextAt {
+			fmt.Fprintf(self.out, "\x1b[%d;%dH", i/width+1, i%width+1)
+		}
+		if int(c.style) != style {
+			self.out.WriteString(styleSGR[c.style])
+			style = int(c.style)
+		}
+		self.out.WriteRune(c.ch)
+		self.drawn[i] = c
+		nextAt = i + 1
+		if nextAt%width == 0 {
+			nextAt = -1
+		}
+	}
+}
+
+func (self *Screen) SetStatus(status string) {
+	if status == self.status {
+		return
+	}
+	self.status = status
+	self.writeLine(statusRow, status)
+}
+
+func (self *Screen) AddMessage(msg string) {
+	self.messages = append(self.messages, msg)
+	if len(self.messages) > messageRows {
+		self.messages = self.messages[len(self.messages)-messageRows:]
+	}
+	for i, msg := range self.messages {
+		self.writeLine(statusRow+1+i, msg)
+	}
+}
+
+// writeLine replaces a text row below the map. Control characters are
+// dropped so that messages from other players can't drive the terminal.
+func (self *Screen) writeLine(row int, text string) {
+	fmt.Fprintf(self.out, "\x1b[%d;1H\x1b[0m\x1b[2K", row)
+	n := 0
+	for _, r := range text {
+		if r < ' ' || r == 0x7f || (0x80 <= r && r < 0xa0) {
+			continue
+		}
+		if n == protocol.ViewWidth {
+			break
+		}
+		self.out.WriteRune(r)
+		n++
+	}
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// Point is a world coordinate
+type Point struct {
+	X int64
+	Y int64
+}
+
+// Moved is the point one step away in direction dir
+func (self Point) Moved(dir rune) Point {
+	switch dir {
+	case 'n':
+		return Point{self.X, self.Y - 1}
+	case 's':
+		return Point{self.X, self.Y + 1}
+	case 'w':
+		return Point{self.X - 1, self.Y}
+	case 'e':
+		return Point{self.X + 1, self.Y}
+	}
+	return self
+}
+
+// Something drawn in the view, at world coordinates
+type Mark struct {
+	At     Point
+	Symbol rune
+}
+
+// maxKnown bounds the tiles a View remembers. Past it the tiles more
+// than keepViews views away are forgotten.
+const maxKnown = 1 << 16
+const keepViews = 2
+
+/*
+View is what a client knows of the world, built from the updates it has
+been sent. Tiles keeps the tiles seen so far, in world coordinates; Marks
+and Life only what is in view now. Life is by view cell, like the
+update's.
+*/
+type View struct {
+	ID          [16]byte
+	At          Point
+	Direction   rune
+	Health      int
+	Collided    bool
+	Pop         int
+	Load        float64
+	Marks       []Mark
+	Messages    []string
+	Tiles       map[Point]int8
+	Life        []bool
+	LifeAllowed bool
+}
+
+func NewView() *View {
+	return &View{
+		Marks: make([]Mark, 0, 32),
+		Tiles: make(map[Point]int8),
+	}
+}
+
+// Corner is the world coordinate of the view's top left cell
+func (self *View) Corner() Point {
+	return Point{self.At.X - protocol.ViewWidth/2, self.At.Y - protocol.ViewHeight/2}
+}
+
+// Apply brings the view up to date with an update from the server
+func (self *View) Apply(update *protocol.Update) {
+	self.At = Point{update.X, update.Y}
+	self.Direction = update.Direction
+	self.Health = update.Health
+	self.Collided = update.Collided
+	self.Pop = update.Pop
+	self.Load = update.Load
+	self.Messages = append(self.Messages[:0], update.Messages...)
+	self.Life = append(self.Life[:0], update.Life...)
+	self.LifeAllowed = update.LifeAllowed
+
+	if len(self.Tiles) > maxKnown {
+		self.forget()
+	}
+	corner := self.Corner()
+	m := &update.Map
+	start := corner
+	if m.Type == protocol.MapLine {
+		start = Point{m.StartX, m.StartY}
+	}
+	width := m.Width()
+	for i, tile := range m.Tiles {
+		self.Tiles[Point{start.X + int64(i%width), start.Y + int64(i/width)}] = tile
+	}
+	for _, patch := range update.Patch {
+		self.Tiles[Point{corner.X + int64(patch.X), corner.Y + int64(patch.Y)}] = patch.Tile
+	}
+
+	self.Marks = self.Marks[:0]
+	for _, mark := range update.Entities {
+		at := Point{corner.X + int64(mark.X), corner.Y + int64(mark.Y)}
+		self.Marks = append(self.Marks, Mark{at, mark.Symbol})
+	}
+}
+
+// forget drops the tiles far from where the view is now
+func (self *View) forget() {
+	rangeX, rangeY := int64(keepViews*protocol.ViewWidth), int64(keepViews*protocol.ViewHeight)
+	for at, _ := range self.Tiles {
+		dx, dy := at.X-self.At.X, at.Y-self.At.Y
+		if dx < -rangeX || rangeX < dx || dy < -rangeY || rangeY < dy {
+			delete(self.Tiles, at)
+		}
+	}
+}
+
+// Tile is the tile at a world coordinate, TileUnused if it hasn't been
+// seen
+func (self *View) Tile(at Point) int8 {
+	tile, known := self.Tiles[at]
+	if !known {
+		return protocol.TileUnused
+	}
+	return tile
+}
+
+func (self *View) Walkable(at Point) bool {
+	tile, known := self.Tiles[at]
+	return known && protocol.Walkable(tile)
+}
+
+// occupied is true where something that isn't walked through stands
+func (self *View) occupied(at Point) bool {
+	for _, mark := range self.Marks {
+		if mark.At == at && mark.Symbol != '+' {
+			return true
+		}
+	}
+	return false
+}
+
+// Directions are the runes of the four moves
+var Directions = []rune{'n', 's', 'e', 'w'}
+
+// maxSearch bounds how many tiles one path search visits
+const maxSearch = 4000
+
+/*
+PathTo finds the shortest walk over known floor to the nearest point that
+satisfies goal, and returns it as move runes. The search stays in what
+the view has seen, so it finds nothing if the goal is out of sight.
+*/
+func (self *View) PathTo(goal func(Point) bool) (string, bool) {
+	from := map[Point]rune{self.At: '0'}
+	frontier := []Point{self.At}
+	for len(frontier) > 0 && len(from) < maxSearch {
+		at := frontier[0]
+		frontier = frontier[1:]
+		if at != self.At && goal(at) {
+			return self.walkBack(from, at), true
+		}
+		for _, dir := range Directions {
+			next := at.Moved(dir)
+			if _, seen := from[next]; seen {
+				continue
+			}
+			if !self.Walkable(next) {
+				continue
+			}
+			from[next] = dir
+			frontier = append(frontier, next)
+		}
+	}
+	return "", false
+}
+
+func (self *View) walkBack(from map[Point]rune, at Point) string {
+	moves := make([]rune, 0, 16)
+	for at != self.At {
+		dir := from[at]
+		moves = append(moves, dir)
+		at = at.Moved(opposite(dir))
+	}
+	for i, j := 0, len(moves)-1; i < j; i, j = i+1, j-1 {
+		moves[i], moves[j] = moves[j], moves[i]
+	}
+	return string(moves)
+}
+
+func opposite(dir rune) rune {
+	switch dir {
+	case 'n':
+		return 's'
+	case 's':
+		return 'n'
+	case 'e':
+		return 'w'
+	case 'w':
+		return 'e'
+	}
+	return dir
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+)
+
+// Clock is where the server reads the time. Nothing in a tick calls
+// time.Now() directly, so a harness can run ticks on a ManualClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type SystemClock struct{}
+
+func (self SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock only moves when it is told to
+type ManualClock struct {
+	now time.Time
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (self *ManualClock) Now() time.Time {
+	return self.now
+}
+
+func (self *ManualClock) Advance(d time.Duration) {
+	self.now = self.now.Add(d)
+}
@@ -0,0 +1,193 @@
+/*
+Loadtest runs bots against a ROTCS server and reports how it holds up.
+Start the server with -dev so it serves plain websockets, then:
+
+	loadtest -url ws://localhost:8080/ws -bots 300 -behavior mix
+
+Every report interval it prints the server's tick load, the latency of
+moves (from send until an update echoes their timestamp), the bandwidth
+each admitted bot gets, and how many bots are waiting, were turned away
+or dropped. Bots that never got in count as failed.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StCredZero/ROTCS/bot"
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// Each bot's behavior under -behavior mix, in turn
+var mix = []string{"explore", "random", "fight", "chat"}
+
+type totals struct {
+	admitted, queued, refused, dropped int
+	bytesIn, bytesOut                  int64
+	load                               float64
+	pop                                int
+	latencies                          []time.Duration
+}
+
+func sample(bots []*bot.Bot) totals {
+	var t totals
+	for _, b := range bots {
+		stats := b.Sample()
+		switch {
+		case stats.Dropped:
+			t.dropped++
+		case stats.Refused:
+			t.refused++
+		case stats.Admitted:
+			t.admitted++
+		case stats.Queued > 0:
+			t.queued++
+		}
+		t.bytesIn += stats.BytesIn
+		t.bytesOut += stats.BytesOut
+		if stats.Admitted && stats.Load > t.load {
+			t.load, t.pop = stats.Load, stats.Pop
+		}
+		t.latencies = append(t.latencies, stats.Latencies...)
+	}
+	return t
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func report(label string, t, last totals, elapsed time.Duration, failed int) {
+	sort.Sort(durations(t.latencies))
+	var sum time.Duration
+	for _, latency := range t.latencies {
+		sum += latency
+	}
+	var mean time.Duration
+	if len(t.latencies) > 0 {
+		mean = sum / time.Duration(len(t.latencies))
+	}
+	var inRate, outRate float64
+	if t.admitted > 0 && elapsed > 0 {
+		secs := elapsed.Seconds() * float64(t.admitted)
+		inRate = float64(t.bytesIn-last.bytesIn) / secs
+		outRate = float64(t.bytesOut-last.bytesOut) / secs
+	}
+	fmt.Printf("%s in=%d queued=%d refused=%d dropped=%d failed=%d | load=%.2f pop=%d | "+
+		"latency mean=%v p50=%v p95=%v max=%v (%d) | per bot in=%.1fKB/s out=%.0fB/s\n",
+		label, t.admitted, t.queued, t.refused, t.dropped, failed,
+		t.load, t.pop,
+		mean, percentile(t.latencies, 50), percentile(t.latencies, 95), percentile(t.latencies, 100),
+		len(t.latencies), inRate/1024, outRate)
+}
+
+type durations []time.Duration
+
+func (this durations) Len() int           { return len(this) }
+func (this durations) Less(i, j int) bool { return this[i] < this[j] }
+func (this durations) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+func main() {
+	wsURL := flag.String("url", "ws://localhost:8080/ws", "server websocket to connect to")
+	count := flag.Int("bots", 100, "number of bots")
+	behaviorName := flag.String("behavior", "mix", "what the bots do: mix or one of "+strings.Join(bot.BehaviorNames(), ", "))
+	codec := flag.String("codec", "json", "frame codec: json or bin")
+	ramp := flag.Duration("ramp", 20*time.Millisecond, "time between starting bots")
+	duration := flag.Duration("duration", time.Minute, "how long to run")
+	interval := flag.Duration("report", 5*time.Second, "time between reports")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed for the bots' choices")
+	flag.Parse()
+
+	names := mix
+	if *behaviorName != "mix" {
+		names = []string{*behaviorName}
+	}
+	bots := make([]*bot.Bot, *count)
+	for i, _ := range bots {
+		behavior, err := bot.ByName(names[i%len(names)])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		bots[i] = bot.New(*wsURL, behavior, *seed+int64(i))
+		if *codec == "bin" {
+			bots[i].Codec = protocol.CodecBinary
+		}
+	}
+
+	var wg sync.WaitGroup
+	var failMutex sync.Mutex
+	failed := 0
+	stop, started := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(started)
+		for _, b := range bots {
+			select {
+			case <-stop:
+				return
+			case <-time.After(*ramp):
+			}
+			wg.Add(1)
+			go func(b *bot.Bot) {
+				defer wg.Done()
+				err := b.Run()
+				if err != nil && !b.Admitted() {
+					// Drops are counted from the bots' stats
+					failMutex.Lock()
+					failed++
+					failMutex.Unlock()
+				}
+				if err != nil {
+					log.Println("bot:", err)
+				}
+			}(b)
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	deadline := time.After(*duration)
+	start, lastTime := time.Now(), time.Now()
+	var last totals
+	var all []time.Duration
+run:
+	for {
+		select {
+		case now := <-ticker.C:
+			t := sample(bots)
+			all = append(all, t.latencies...)
+			failMutex.Lock()
+			report(fmt.Sprintf("%6.0fs", now.Sub(start).Seconds()), t, last, now.Sub(lastTime), failed)
+			failMutex.Unlock()
+			last, lastTime = t, now
+		case <-deadline:
+			break run
+		case <-interrupt:
+			break run
+		}
+	}
+	ticker.Stop()
+	close(stop)
+	<-started
+
+	for _, b := range bots {
+		b.Close()
+	}
+	wg.Wait()
+	t := sample(bots)
+	t.latencies = append(all, t.latencies...)
+	failMutex.Lock()
+	report(" total", t, totals{}, time.Since(start), failed)
+	failMutex.Unlock()
+}
@@ -0,0 +1,95 @@
+/*
+Rotcs-client plays ROTCS in a terminal instead of a browser:
+
+	rotcs-client -url ws://localhost:8080/ws
+
+Arrows or hjkl move, o opens doors, p flips a life cell, a switches the
+life system on and off and q quits. The map needs a terminal of at least
+79 columns by 29 rows.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/StCredZero/ROTCS/client"
+	"github.com/StCredZero/ROTCS/protocol"
+	"golang.org/x/term"
+)
+
+func main() {
+	wsURL := flag.String("url", "ws://localhost:8080/ws", "server websocket to connect to")
+	codecName := flag.String("codec", "json", "frame codec: json or bin")
+	mapVersion := flag.Int("v", protocol.MapTiles, "map encoding: 1 for the walkable bitmask, 2 for tiles")
+	flag.Parse()
+
+	codec := protocol.CodecJSON
+	if *codecName == "bin" {
+		codec = protocol.CodecBinary
+	}
+	conn, err := client.Dial(*wsURL, codec, *mapVersion)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rotcs-client:", err)
+		os.Exit(1)
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if term.IsTerminal(stdin) {
+		state, err := term.MakeRaw(stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "rotcs-client:", err)
+			os.Exit(1)
+		}
+		defer term.Restore(stdin, state)
+	}
+	if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil &&
+		(width < protocol.ViewWidth || height < client.ScreenHeight) {
+		fmt.Fprintf(os.Stderr, "rotcs-client: the terminal is %dx%d, smaller than the %dx%d screen\r\n",
+			width, height, protocol.ViewWidth, client.ScreenHeight)
+	}
+
+	// Closed when the player quits, so hanging up isn't reported
+	quit := make(chan struct{})
+	go func() {
+		keys := client.NewKeyReader(os.Stdin)
+		for {
+			cmd, done, err := keys.ReadCommand()
+			if err != nil || done {
+				close(quit)
+				conn.Close()
+				return
+			}
+			if _, _, err := conn.Send(cmd); err != nil {
+				return
+			}
+		}
+	}()
+
+	screen := client.NewScreen(os.Stdout)
+	view := client.NewView()
+	screen.Start()
+	var ended error
+	for {
+		frame, size, err := conn.Read()
+		if size == 0 {
+			ended = err
+			break
+		}
+		if err != nil {
+			screen.AddMessage(err.Error())
+		} else {
+			screen.Show(view, frame)
+		}
+		screen.Flush()
+	}
+	screen.Stop()
+	screen.Flush()
+
+	select {
+	case <-quit:
+	default:
+		fmt.Fprintf(os.Stderr, "rotcs-client: connection closed: %v\r\n", ended)
+	}
+}
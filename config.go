@@ -0,0 +1,359 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+/*
+ServerConfig holds the operator's settings for a CstServer. They come
+from the defaults here, then the config file, then command line flags.
+
+The config file is TOML. Top level keys, [world], [net] and [log] are
+read once, at startup. [gameplay] and the log levels are read again on
+SIGHUP and take effect at the next tick boundary. See etc/rotcs.toml for
+every key and its default.
+*/
+type ServerConfig struct {
+	// Ticks per second
+	TickRate int `toml:"tick_rate"`
+	// Nonzero makes the world deterministic, with every RNG seeded from it
+	Seed    int64  `toml:"seed"`
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+	// How long clients are warned before a shutdown closes them
+	ShutdownGrace time.Duration `toml:"shutdown_grace"`
+	// How long a drain waits for players to leave before shutting down
+	DrainTimeout time.Duration `toml:"drain_timeout"`
+
+	World WorldConfig `toml:"world"`
+
+	Net NetConfig `toml:"net"`
+
+	Log LogConfig `toml:"log"`
+
+	Tunables `toml:"gameplay"`
+}
+
+// WorldConfig shapes the world's generation, so it can't change under a
+// running world: DunGenCache regenerates what it evicts. The subgrid size
+// isn't here: it is the client's view size, which the protocol fixes at
+// 79x25.
+type WorldConfig struct {
+	// Subgrids players spawn in. They are never culled or prepopulated
+	// and the life system isn't allowed in them.
+	SpawnGrids     [][2]int64 `toml:"spawn_grids"`
+	DungeonEntropy []byte     `toml:"dungeon_entropy"`
+	// Rooms and corridors DunGen places per subgrid
+	DungeonObjects int `toml:"dungeon_objects"`
+	// Percent chance each is a room
+	DungeonRoomChance int `toml:"dungeon_room_chance"`
+}
+
+// NetConfig guards what clients can send over /ws
+type NetConfig struct {
+	// Origins browsers may open /ws from besides the server's own, such as
+	// "https://example.com". "*" allows any.
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// The largest message a client may send, in bytes
+	MaxMessageSize int64 `toml:"max_message_size"`
+	// How often each client is pinged. One that answers nothing for two
+	// of these is dropped.
+	PingInterval time.Duration `toml:"ping_interval"`
+	// Commands a client may send per second, and at once after a pause,
+	// each move counting as one. The rest are dropped.
+	CommandRate  float64 `toml:"command_rate"`
+	CommandBurst int     `toml:"command_burst"`
+}
+
+// LogConfig says where the log goes and how much of it. Only Level
+// changes on a reload.
+type LogConfig struct {
+	// A default level, then subsystem=level overrides, comma separated
+	Level string `toml:"level"`
+	// "text" or "json"
+	Format string `toml:"format"`
+	// Written along with stdout. Empty for stdout only.
+	File string `toml:"file"`
+	// The file rotates past this many megabytes, keeping this many old ones
+	MaxSize int `toml:"max_size"`
+	Keep    int `toml:"keep"`
+}
+
+// Tunables are the settings that are safe to change mid-run
+type Tunables struct {
+	// Players admitted at once, dropped players waiting to resume included
+	MaxPopulation int `toml:"max_population"`
+	// No one is admitted while the server load is at or above this
+	MaxLoad float64 `toml:"max_load"`
+	// Connections that can wait for admission; more are turned away
+	MaxQueue int `toml:"max_queue"`
+	// Watching connections at once. They don't count toward MaxPopulation.
+	MaxSpectators int `toml:"max_spectators"`
+	// How long a dropped player waits for its client to reconnect
+	ResumeGrace time.Duration `toml:"resume_grace"`
+	// How near a player has to be for a Monster to notice it
+	DetectionRadius int `toml:"detection_radius"`
+	// Random spots tried when placing a new entity in a subgrid
+	PlacementTries int `toml:"placement_tries"`
+	// What a slow tick captures of the ticks after it: CaptureNone,
+	// CaptureCPU or CaptureTrace
+	SlowTickCapture string `toml:"slow_tick_capture"`
+	// Ticks a capture covers
+	SlowTickCaptureTicks int `toml:"slow_tick_ticks"`
+	// Where captures are written
+	SlowTickDir string `toml:"slow_tick_dir"`
+	// How long a quarantined subgrid stays frozen before the server
+	// rebuilds it. Zero leaves it to the admin API.
+	QuarantineRebuild time.Duration `toml:"quarantine_rebuild"`
+}
+
+// Seeds is where the world's RNGs get their seeds under this config
+func (self ServerConfig) Seeds() SeedSource {
+	if self.Seed != 0 {
+		return NewWorldSeed(self.Seed)
+	}
+	return ClockSeeds{}
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		TickRate: 8,
+		TLSCert:  "etc/cert/certificate",
+		TLSKey:   "etc/cert/server.key",
+
+		ShutdownGrace: 15 * time.Second,
+		DrainTimeout:  5 * time.Minute,
+
+		World: WorldConfig{
+			SpawnGrids:        [][2]int64{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {-1, -1}, {-1, 0}, {0, -1}},
+			DungeonEntropy:    []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 55, 13, 14, 15, 16},
+			DungeonObjects:    20,
+			DungeonRoomChance: 50,
+		},
+
+		Net: NetConfig{
+			AllowedOrigins: []string{},
+			MaxMessageSize: 4096,
+			PingInterval:   15 * time.Second,
+			CommandRate:    20,
+			CommandBurst:   64,
+		},
+
+		Log: LogConfig{
+			Level:   "info",
+			Format:  "text",
+			File:    "log",
+			MaxSize: 100,
+			Keep:    5,
+		},
+
+		Tunables: Tunables{
+			MaxPopulation:   200,
+			MaxLoad:         0.8,
+			MaxQueue:        500,
+			MaxSpectators:   50,
+			ResumeGrace:     20 * time.Second,
+			DetectionRadius: 7,
+			PlacementTries:  100,
+
+			SlowTickCapture:      CaptureNone,
+			SlowTickCaptureTicks: 16,
+			SlowTickDir:          ".",
+
+			QuarantineRebuild: 2 * time.Minute,
+		},
+	}
+}
+
+// Flags binds command line flags to the settings that have them
+func (self *ServerConfig) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&self.TickRate, "tick-rate", self.TickRate, "ticks per second")
+	fs.Int64Var(&self.Seed, "seed", self.Seed, "run a deterministic world from this seed")
+	fs.DurationVar(&self.ShutdownGrace, "shutdown-grace", self.ShutdownGrace, "how long clients are warned before a shutdown")
+	fs.DurationVar(&self.DrainTimeout, "drain-timeout", self.DrainTimeout, "how long a drain waits for players to leave")
+
+	fs.Func("allow-origin", "comma separated origins browsers may open /ws from besides the server's own; * for any", func(value string) error {
+		self.Net.AllowedOrigins = splitList(value)
+		return nil
+	})
+	fs.DurationVar(&self.Net.PingInterval, "ping-interval", self.Net.PingInterval, "how often clients are pinged")
+	fs.Float64Var(&self.Net.CommandRate, "command-rate", self.Net.CommandRate, "commands a client may send per second")
+
+	fs.StringVar(&self.Log.Level, "log-level", self.Log.Level, "log level, then subsystem=level overrides, e.g. info,net=trace")
+	fs.StringVar(&self.Log.Format, "log-format", self.Log.Format, "log as text or json")
+	fs.StringVar(&self.Log.File, "log-file", self.Log.File, "log to this file as well as stdout; empty for stdout only")
+
+	fs.IntVar(&self.MaxPopulation, "max-pop", self.MaxPopulation, "most players admitted at once")
+	fs.Float64Var(&self.MaxLoad, "max-load", self.MaxLoad, "server load at which admission stops")
+	fs.IntVar(&self.MaxQueue, "max-queue", self.MaxQueue, "most connections waiting for admission")
+	fs.IntVar(&self.MaxSpectators, "max-spectators", self.MaxSpectators, "most connections watching at once")
+	fs.DurationVar(&self.ResumeGrace, "resume-grace", self.ResumeGrace, "how long a dropped player waits for its client to reconnect")
+
+	fs.StringVar(&self.SlowTickCapture, "slow-tick-capture", self.SlowTickCapture, "capture the ticks after a slow one: cpu for a pprof profile, trace for an execution trace")
+	fs.IntVar(&self.SlowTickCaptureTicks, "slow-tick-ticks", self.SlowTickCaptureTicks, "how many ticks a slow-tick capture covers")
+	fs.StringVar(&self.SlowTickDir, "slow-tick-dir", self.SlowTickDir, "where slow-tick captures are written")
+	fs.DurationVar(&self.QuarantineRebuild, "quarantine-rebuild", self.QuarantineRebuild, "how long a quarantined subgrid stays frozen before it is rebuilt; 0 waits for the admin API")
+}
+
+/*
+LoadConfig reads a config file over the defaults, then sets the flags in
+overrides, by name, so the command line still wins on a reload. An empty
+path reads no file.
+*/
+func LoadConfig(path string, overrides map[string]string) (ServerConfig, error) {
+	config := DefaultServerConfig()
+	if path != "" {
+		meta, err := toml.DecodeFile(path, &config)
+		if err != nil {
+			return config, err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			sort.Strings(keys)
+			return config, fmt.Errorf("%s: unknown keys: %s", path, strings.Join(keys, ", "))
+		}
+	}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	config.Flags(fs)
+	for name, value := range overrides {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return config, err
+		}
+	}
+	return config, config.Validate()
+}
+
+func (self ServerConfig) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(self.TickRate >= 1 && self.TickRate <= 100, "tick_rate %d is not from 1 to 100", self.TickRate)
+	check(self.TLSCert != "" && self.TLSKey != "", "tls_cert and tls_key need paths")
+	check(self.ShutdownGrace >= 0, "shutdown_grace %v is negative", self.ShutdownGrace)
+	check(self.DrainTimeout >= 0, "drain_timeout %v is negative", self.DrainTimeout)
+
+	world := self.World
+	check(len(world.SpawnGrids) > 0, "world.spawn_grids is empty")
+	check(len(world.DungeonEntropy) > 0, "world.dungeon_entropy is empty")
+	check(world.DungeonObjects >= 1, "world.dungeon_objects %d is below 1", world.DungeonObjects)
+	check(world.DungeonRoomChance >= 0 && world.DungeonRoomChance <= 100,
+		"world.dungeon_room_chance %d is not a percentage", world.DungeonRoomChance)
+
+	check(self.Net.MaxMessageSize >= 256, "net.max_message_size %d is below 256", self.Net.MaxMessageSize)
+	check(self.Net.PingInterval >= time.Second, "net.ping_interval %v is under a second", self.Net.PingInterval)
+	check(self.Net.CommandRate > 0, "net.command_rate %g is not above 0", self.Net.CommandRate)
+	check(self.Net.CommandBurst >= 1, "net.command_burst %d is below 1", self.Net.CommandBurst)
+	for _, origin := range self.Net.AllowedOrigins {
+		check(validOrigin(origin), "net.allowed_origins: %q is not * or scheme://host", origin)
+	}
+
+	check(self.Log.Format == "text" || self.Log.Format == "json", "log.format %q is not text or json", self.Log.Format)
+	check(self.Log.MaxSize >= 1, "log.max_size %d is below 1", self.Log.MaxSize)
+	check(self.Log.Keep >= 0, "log.keep %d is negative", self.Log.Keep)
+	if _, err := parseLogLevels(self.Log.Level); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	check(self.MaxPopulation >= 1, "gameplay.max_population %d is below 1", self.MaxPopulation)
+	check(self.MaxLoad > 0, "gameplay.max_load %g is not above 0", self.MaxLoad)
+	check(self.MaxQueue >= 0, "gameplay.max_queue %d is negative", self.MaxQueue)
+	check(self.MaxSpectators >= 0, "gameplay.max_spectators %d is negative", self.MaxSpectators)
+	check(self.ResumeGrace >= 0, "gameplay.resume_grace %v is negative", self.ResumeGrace)
+	check(self.DetectionRadius >= 0 && self.DetectionRadius <= subgrid_width,
+		"gameplay.detection_radius %d is not from 0 to %d", self.DetectionRadius, subgrid_width)
+	check(self.PlacementTries >= 1, "gameplay.placement_tries %d is below 1", self.PlacementTries)
+	check(ValidCaptureKind(self.SlowTickCapture), "gameplay.slow_tick_capture %q is not cpu or trace", self.SlowTickCapture)
+	check(self.SlowTickCaptureTicks >= 1, "gameplay.slow_tick_ticks %d is below 1", self.SlowTickCaptureTicks)
+	check(self.QuarantineRebuild >= 0, "gameplay.quarantine_rebuild %v is negative", self.QuarantineRebuild)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("bad config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// InstallWorld sets the tick rate and the world generation settings. It
+// must run before any CstServer is made.
+func (self ServerConfig) InstallWorld() {
+	setTickRate(self.TickRate)
+	SpawnGrids = make([]GridCoord, len(self.World.SpawnGrids))
+	for i, xy := range self.World.SpawnGrids {
+		SpawnGrids[i] = GridCoord{xy[0], xy[1]}
+	}
+	DungeonEntropy = DunGenEntropy(self.World.DungeonEntropy)
+	DungeonProto.targetObj = self.World.DungeonObjects
+	DungeonProto.chanceRoom = self.World.DungeonRoomChance
+}
+
+// Reload has the tick loop take up the tunables of config at the next
+// tick boundary. Startup settings that differ are logged and left alone.
+func (srv *CstServer) Reload(config ServerConfig) {
+	srv.adminQueue <- adminCommand{run: func(srv *CstServer) (interface{}, error) {
+		srv.reload(config)
+		return nil, nil
+	}}
+}
+
+func (srv *CstServer) reload(config ServerConfig) {
+	old := srv.config
+	if config.TickRate != old.TickRate || config.Seed != old.Seed ||
+		config.TLSCert != old.TLSCert || config.TLSKey != old.TLSKey ||
+		config.ShutdownGrace != old.ShutdownGrace || config.DrainTimeout != old.DrainTimeout ||
+		fmt.Sprint(config.World) != fmt.Sprint(old.World) ||
+		fmt.Sprint(config.Net) != fmt.Sprint(old.Net) ||
+		config.Log.Format != old.Log.Format || config.Log.File != old.Log.File ||
+		config.Log.MaxSize != old.Log.MaxSize || config.Log.Keep != old.Log.Keep {
+		serverLog.Warn("config: startup settings changed; they take effect on restart")
+	}
+	srv.config.Tunables = config.Tunables
+	srv.config.Log.Level = config.Log.Level
+	if err := SetLogLevels(config.Log.Level); err != nil {
+		serverLog.Error("config: log levels not set", "err", err)
+	}
+	srv.profiler.CaptureKind = config.SlowTickCapture
+	srv.profiler.CaptureTicks = config.SlowTickCaptureTicks
+	srv.profiler.CaptureDir = config.SlowTickDir
+	if err := srv.setGameplay(); err != nil {
+		serverLog.Error("config: gameplay not set", "err", err)
+	}
+	serverLog.Info("config reloaded", tickAttr(srv.tickNumber))
+}
+
+// setGameplay puts the tunables the simulation reads into effect, through
+// the replay log. A playback takes them from the log instead.
+func (srv *CstServer) setGameplay() error {
+	if srv.playback != nil {
+		return nil
+	}
+	return srv.change(adminChange{
+		op:        adminGameplay,
+		detection: srv.config.DetectionRadius,
+		tries:     srv.config.PlacementTries,
+	})
+}
+
+// splitList splits a comma separated flag, leaving out empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
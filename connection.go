@@ -1,125 +1,509 @@
 package main
 
 import (
-	"regexp"
+	"context"
+	"io"
+	"net"
+	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/StCredZero/ROTCS/protocol"
 	"github.com/gorilla/websocket"
-	"github.com/satori/go.uuid"
 )
 
+// Map encodings a client can ask for with the "v" query parameter on /ws.
+// Clients that don't ask get the walkable bitmask.
+func protocolVersion(r *http.Request) int {
+	v, err := strconv.Atoi(r.URL.Query().Get("v"))
+	if err != nil || v < protocol.MapBitmask {
+		return protocol.MapBitmask
+	}
+	if v > protocol.MapTiles {
+		return protocol.MapTiles
+	}
+	return v
+}
+
+// Clients pick a frame codec with the "codec" query parameter on /ws. The
+// default is JSON over text messages; codec=bin selects binary frames.
+func codecFor(r *http.Request) int {
+	if r.URL.Query().Get("codec") == "bin" {
+		return protocol.CodecBinary
+	}
+	return protocol.CodecJSON
+}
+
+// Clients that send delta=1 get entity deltas keyed by per-connection
+// handles instead of the full entity string every tick
+func deltasFor(r *http.Request) bool {
+	return r.URL.Query().Get("delta") == "1"
+}
+
 type moveRequest struct {
 	direction rune
 	timestamp uint64
 }
 
+/*
+A connection lives on three goroutines. Its reader takes commands from
+the client, its writer sends frames to it, and the tick goroutine decides
+what it is sent and when it is done with it.
+
+The tick never waits on a client. Frames that must arrive in order, like
+messages and admission, go through send, and a client too far behind to
+take one loses it. Updates go in a slot of their own that holds only the
+newest; one the client hasn't taken when the next tick's is ready is
+replaced, and the replacement is built whole, so the client doesn't need
+the one it missed.
+
+Either the client or the server can end a connection. When the reader or
+writer stops, it cancels ctx, which closes the transport under the other.
+Once both have stopped, the connection goes on droppedQueue, so the tick
+hears of it only after nothing else touches the transport. When the tick
+is done with a connection it hangs up: it closes send, and the writer
+sends what is left and a close frame saying why, and stops.
+*/
+
 func newConnection(ws *websocket.Conn) *connection {
-	return &connection{
-		isOpen: true,
-		send:   make(chan []byte, 256),
-		ws:     ws,
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &connection{
+		ctx:      ctx,
+		cancel:   cancel,
+		protocol: protocol.MapBitmask,
+		send:     make(chan []byte, 256),
+		wake:     make(chan struct{}, 1),
+		written:  make(chan struct{}),
+		ws:       ws,
+	}
+	if ws != nil {
+		c.closer = ws
 	}
+	return c
 }
 
 type connection struct {
 	id EntityID
 
-	deadline time.Time
+	// Closes the client's transport, a websocket or a terminal session
+	closer io.Closer
 
-	IsBlurred bool
+	// Cancelled when the reader or writer stops, or the server takes the
+	// connection over
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	isOpen bool
+	droppedAt time.Time
+
+	// Set by the reader, 1 while the client's window is in the background
+	blurred int32
+
+	// The client's address, for the log
+	remote string
+
+	codec int
 
 	outbox []string
 
+	protocol int
+
+	queuePosition int
+
+	// Set by the tick goroutine once it has closed send, with what the
+	// close frame says
+	hungUp      bool
+	closeCode   int
+	closeReason string
+
+	// Set by the tick goroutine. A reconnect command that comes before
+	// registration leaves its token for it.
+	registered  bool
+	resumeToken string
+
 	player *Player
 
-	// Buffered channel of outbound messages.
+	// The tick goroutine sets player; the reader reads it through
+	// inputPlayer
+	playerMutex sync.Mutex
+
+	// Set instead of player when the client only watches
+	spectator *Spectator
+
+	// Per-connection entity handles, nil unless the client asked for deltas
+	tracker *EntityTracker
+
+	// Commands the client may send, nil for no limit
+	limiter *commandLimiter
+
+	// Buffered channel of outbound frames other than updates
 	send chan []byte
 
+	// The newest update the writer hasn't taken, and when it was made
+	update      []byte
+	updateAt    time.Time
+	updateMutex sync.Mutex
+	// Signalled when update is set
+	wake chan struct{}
+
+	// Closed when the writer has sent all it will and hung up
+	written chan struct{}
+
+	// Kept atomically by the writer and the tick: bytes sent, how long the
+	// last update waited, in nanoseconds, updates replaced before the
+	// client took them, and frames dropped
+	sent      uint64
+	lag       int64
+	coalesced uint64
+	dropped   uint64
+	// Kept atomically by the reader: commands dropped over the rate limit
+	limitedCount uint64
+
+	// Bytes sent in the second before the last sample, and the count
+	// then. Only the tick goroutine uses them.
+	bandwidth uint64
+	lastSent  uint64
+
 	// The websocket connection.
 	ws *websocket.Conn
 }
 
 type reconnect struct {
-	oldId   EntityID
+	token   string
 	newConn *connection
 }
 
+// setPlayer gives the connection its player. Only the tick goroutine
+// calls it.
+func (c *connection) setPlayer(id EntityID, player *Player) {
+	c.playerMutex.Lock()
+	defer c.playerMutex.Unlock()
+	c.id = id
+	c.player = player
+}
+
+// inputPlayer is the player the reader hands commands to, nil while the
+// connection waits for admission
+func (c *connection) inputPlayer() *Player {
+	c.playerMutex.Lock()
+	defer c.playerMutex.Unlock()
+	return c.player
+}
+
+func (c *connection) loggedID() EntityID {
+	c.playerMutex.Lock()
+	defer c.playerMutex.Unlock()
+	return c.id
+}
+
+func (c *connection) Blurred() bool {
+	return atomic.LoadInt32(&c.blurred) != 0
+}
+
+func (c *connection) setBlurred(blurred bool) {
+	var value int32
+	if blurred {
+		value = 1
+	}
+	atomic.StoreInt32(&c.blurred, value)
+}
+
+// queue hands the writer a frame that has to arrive in order. A client
+// too far behind to take it loses it rather than hold up the tick. It may
+// be called concurrently through ParallelExec(), but only while the tick
+// runs.
+func (c *connection) queue(frame []byte) bool {
+	if c.hungUp {
+		return false
+	}
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+		atomic.AddUint64(&droppedFrames, 1)
+		return false
+	}
+}
+
+/*
+offerUpdate makes build's frame the newest update. behind tells build
+the client hasn't taken the last one, which its frame replaces, so it
+has to stand on its own.
+
+The frame is built without the lock, so the writer is never kept
+waiting on it. Only this connection's tick work offers updates, so the
+slot can only be emptied meanwhile; then the frame stands on its own
+needlessly.
+*/
+func (c *connection) offerUpdate(build func(behind bool) []byte) {
+	c.updateMutex.Lock()
+	behind := c.update != nil
+	c.updateMutex.Unlock()
+	update := build(behind)
+
+	c.updateMutex.Lock()
+	defer c.updateMutex.Unlock()
+	if c.update != nil {
+		atomic.AddUint64(&c.coalesced, 1)
+		atomic.AddUint64(&coalescedUpdates, 1)
+	}
+	c.update = update
+	c.updateAt = time.Now()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *connection) takeUpdate() ([]byte, time.Time) {
+	c.updateMutex.Lock()
+	defer c.updateMutex.Unlock()
+	update, at := c.update, c.updateAt
+	c.update = nil
+	return update, at
+}
+
+// hangUp tells the writer the server is done with the connection. Only
+// the tick goroutine calls it, between ticks.
+func (c *connection) hangUp() {
+	c.hangUpFor(websocket.CloseNormalClosure, "")
+}
+
+// hangUpFor hangs up with a close code and reason for the client. The
+// first hang up decides them.
+func (c *connection) hangUpFor(code int, reason string) {
+	if c.hungUp {
+		return
+	}
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+	c.hungUp = true
+}
+
+/*
+next waits for the writer's next frame: queued frames first, so a client
+hears of its admission before it gets updates, then the newest update.
+made is when an update was made, and zero for other frames. ok is false
+once the server has hung up and everything is taken, or the connection
+is cancelled.
+*/
+func (c *connection) next() ([]byte, time.Time, bool) {
+	for {
+		select {
+		case frame, open := <-c.send:
+			return c.fromQueue(frame, open)
+		default:
+		}
+		if update, made := c.takeUpdate(); update != nil {
+			return update, made, true
+		}
+		select {
+		case frame, open := <-c.send:
+			return c.fromQueue(frame, open)
+		case <-c.wake:
+		case <-c.ctx.Done():
+			return nil, time.Time{}, false
+		}
+	}
+}
+
+// fromQueue is what next returns for a frame off send. Once send is
+// closed, the last update is all that is left.
+func (c *connection) fromQueue(frame []byte, open bool) ([]byte, time.Time, bool) {
+	if open {
+		return frame, time.Time{}, true
+	}
+	update, made := c.takeUpdate()
+	return update, made, update != nil
+}
+
+// wrote counts a frame the writer sent
+func (c *connection) wrote(size int, made time.Time) {
+	atomic.AddUint64(&c.sent, uint64(size))
+	atomic.AddUint64(&sentBytes, uint64(size))
+	if !made.IsZero() {
+		atomic.StoreInt64(&c.lag, int64(time.Since(made)))
+	}
+}
+
+// Lag is how far behind the client is: how long the last update it was
+// sent waited, or the one waiting now, if that is longer
+func (c *connection) Lag() time.Duration {
+	lag := time.Duration(atomic.LoadInt64(&c.lag))
+	c.updateMutex.Lock()
+	defer c.updateMutex.Unlock()
+	if c.update != nil {
+		if waiting := time.Since(c.updateAt); waiting > lag {
+			lag = waiting
+		}
+	}
+	return lag
+}
+
+// discard takes frames and throws them away, for connections with no
+// client
+func (c *connection) discard() {
+	for {
+		if _, _, ok := c.next(); !ok {
+			return
+		}
+	}
+}
+
+/*
+serve runs a connection until either end is done with it. read runs here
+and write on a goroutine of its own; whichever returns first cancels c,
+and cancelling closes the transport under the other. The writer closes
+written as it stops.
+*/
+func (srv *CstServer) serve(c *connection, read func(), write func()) {
+	c.limiter = newCommandLimiter(srv.config.Net)
+	context.AfterFunc(c.ctx, func() {
+		c.closer.Close()
+	})
+	srv.register <- c
+	go write()
+	read()
+	c.cancel()
+	<-c.written
+	srv.droppedQueue <- c
+}
+
 func (c *connection) reader(srv *CstServer) {
 
 	defer func() {
-		LogTrace("closing reader")
-		c.isOpen = false
+		logTrace(netLog, "closing reader", "conn", c)
 	}()
 
-readerLoop:
-	for c.isOpen {
+	interval := srv.config.Net.PingInterval
+	c.ws.SetReadLimit(srv.config.Net.MaxMessageSize)
+	c.keepAlive(interval)
+	for c.ctx.Err() == nil {
 		_, message, err := c.ws.ReadMessage()
 		if err != nil {
-			break readerLoop
+			if err == websocket.ErrReadLimit {
+				netLog.Debug("message too long", "conn", c)
+			} else if e, ok := err.(net.Error); ok && e.Timeout() {
+				netLog.Debug("client stopped answering pings", "conn", c)
+			}
+			return
 		}
-		tokens := regexp.MustCompile(":").Split(string(message[:]), 3)
-		timestamp, err := strconv.ParseUint(tokens[0], 10, 64)
+		c.ws.SetReadDeadline(time.Now().Add(2 * interval))
+		cmd, err := protocol.ParseCommand(message)
 		if err != nil {
-			break readerLoop
+			netLog.Debug("malformed command", "conn", c, "err", err)
+			c.closeFor(closeKicked, "malformed command")
+			return
 		}
-		cmdType, data := tokens[1], tokens[2]
-		LogTrace("Got:", data, timestamp)
-		if strings.EqualFold(cmdType, "mv") {
-			for _, mv := range data {
-				c.player.moveQueue <- moveRequest{mv, timestamp}
-			}
-		} else if strings.EqualFold(cmdType, "ch") {
-			//c.player.outbox = append(c.player.outbox, data)
-		} else if strings.EqualFold(cmdType, "bl") {
-			flag, err := strconv.ParseUint(data, 10, 64)
-			if err != nil {
-				break readerLoop
+		c.handle(srv, cmd)
+		runtime.Gosched()
+	}
+
+}
+
+// handle acts on one command from the client, whatever it came over
+func (c *connection) handle(srv *CstServer, cmd protocol.Command) {
+	cost := 1
+	if cmd.Type == protocol.CmdMove {
+		cost = utf8.RuneCountInString(cmd.Data)
+	}
+	if granted := c.allowed(cost); granted < cost {
+		logTrace(netLog, "command over the rate limit", "conn", c, "type", cmd.Type)
+		if cmd.Type != protocol.CmdMove || granted == 0 {
+			return
+		}
+		cmd.Data = string([]rune(cmd.Data)[:granted])
+	}
+	data := cmd.Data
+	if cmd.Type == protocol.CmdChat && strings.HasPrefix(data, "/") {
+		data = loggedSlash(data)
+	} else if cmd.Type == protocol.CmdReconnect {
+		// A logged token could take the session over
+		data = "(token)"
+	}
+	logTrace(netLog, "command", "conn", c, "type", cmd.Type, "data", data, "timestamp", cmd.Timestamp)
+	if c.spectator != nil {
+		switch cmd.Type {
+		case protocol.CmdMove:
+			for _, mv := range cmd.Data {
+				c.spectator.Pan(mv)
 			}
-			c.IsBlurred = flag != 0
-		} else if strings.EqualFold(cmdType, "li") {
-			c.player.SetFlag(LifeCellTogl)
-		} else if strings.EqualFold(cmdType, "al") {
-			c.player.SetFlag(LifeActivateTogl)
-		} else if strings.EqualFold(cmdType, "reconnect") {
-			id, err := uuid.FromString(data)
-			if err != nil {
-				srv.reconnectQueue <- reconnect{EntityID(id), c}
+		case protocol.CmdBlur:
+			c.setBlurred(cmd.Blurred())
+		case protocol.CmdSpeed:
+			if srv.playback != nil {
+				speed, _ := cmd.Speed()
+				srv.playback.SetSpeed(speed)
 			}
 		}
-		runtime.Gosched()
+		return
+	}
+	player := c.inputPlayer()
+	if player == nil && cmd.Type != protocol.CmdReconnect && cmd.Type != protocol.CmdBlur {
+		// still waiting for admission
+		return
+	}
+	switch cmd.Type {
+	case protocol.CmdMove:
+		for _, mv := range cmd.Data {
+			player.QueueMove(moveRequest{mv, cmd.Timestamp})
+		}
+	case protocol.CmdChat:
+		if strings.HasPrefix(cmd.Data, "/") {
+			srv.queueSlash(c, cmd.Data)
+			return
+		}
+		//c.player.outbox = append(c.player.outbox, cmd.Data)
+	case protocol.CmdBlur:
+		c.setBlurred(cmd.Blurred())
+	case protocol.CmdLifeCell:
+		player.Toggle(LifeCellTogl)
+	case protocol.CmdLifeActivate:
+		player.Toggle(LifeActivateTogl)
+	case protocol.CmdInteract:
+		player.Toggle(InteractTogl)
+	case protocol.CmdReconnect:
+		srv.reconnectQueue <- reconnect{cmd.Data, c}
 	}
-
 }
 
 func (c *connection) writer() {
 
 	defer func() {
-		LogTrace("closing writer")
-		c.isOpen = false
-		c.ws.Close()
+		logTrace(netLog, "closing writer", "conn", c)
+		c.cancel()
+		close(c.written)
 	}()
 
-writerLoop:
-	for message := range c.send {
-		if !c.isOpen {
-			break writerLoop
+	messageType := websocket.TextMessage
+	if c.codec == protocol.CodecBinary {
+		messageType = websocket.BinaryMessage
+	}
+	for {
+		message, made, ok := c.next()
+		if !ok {
+			break
 		}
-		LogTrace("writer about to WriteMessage", c.id)
-		c.deadline = time.Now().Add(time.Duration(time.Millisecond * 1200))
-		err1 := c.ws.SetWriteDeadline(c.deadline)
+		err1 := c.ws.SetWriteDeadline(time.Now().Add(time.Duration(time.Millisecond * 1200)))
 		if err1 != nil {
-			break writerLoop
+			return
 		}
-		err2 := c.ws.WriteMessage(websocket.TextMessage, message)
-		LogTrace("wrote WriteMessage", c.id)
+		err2 := c.ws.WriteMessage(messageType, message)
 		if err2 != nil {
-			break writerLoop
+			return
 		}
+		c.wrote(len(message), made)
 		runtime.Gosched()
 	}
+	if c.ctx.Err() == nil {
+		// The server hung up, so it is done with this client
+		closing := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+		c.ws.WriteControl(websocket.CloseMessage, closing, time.Now().Add(time.Second))
+	}
 }
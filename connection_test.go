@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+These run connections through their reader and writer goroutines over a
+real websocket, with the test standing in for the tick goroutine. Run them
+with -race.
+*/
+
+// dialTest connects a client to a server that doesn't tick, and returns
+// the server's end of the connection
+func dialTest(t *testing.T, srv *CstServer) (*websocket.Conn, *connection) {
+	ts := httptest.NewServer(http.HandlerFunc(srv.wsHandler))
+	t.Cleanup(ts.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	select {
+	case c := <-srv.register:
+		return ws, c
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not registered")
+	}
+	return nil, nil
+}
+
+func newTestServer() *CstServer {
+	return NewCstServer(DefaultServerConfig(), NewWorldSeed(1))
+}
+
+// expectDropped waits for c to reach droppedQueue, which it does once its
+// reader and writer have both stopped
+func expectDropped(t *testing.T, srv *CstServer, c *connection) {
+	select {
+	case dropped := <-srv.droppedQueue:
+		if dropped != c {
+			t.Fatal("another connection dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not dropped")
+	}
+	if c.ctx.Err() == nil {
+		t.Fatal("dropped connection not cancelled")
+	}
+}
+
+func expectClose(t *testing.T, ws *websocket.Conn, code int, reason string) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) || !strings.Contains(err.Error(), reason) {
+			t.Fatalf("closed with %v, expected %d %s", err, code, reason)
+		}
+		return
+	}
+}
+
+// A client that isn't reading never holds up the tick. Updates it hasn't
+// taken are replaced, and it gets the newest once it reads again.
+func TestSlowClient(t *testing.T) {
+	srv := newTestServer()
+	ws, c := dialTest(t, srv)
+
+	padding := strings.Repeat("x", 256<<10)
+	const updates = 100
+	start := time.Now()
+	for i := 0; i < updates; i++ {
+		frame := []byte(fmt.Sprintf("%06d%s", i, padding))
+		c.offerUpdate(func(behind bool) []byte { return frame })
+	}
+	for i := 0; i < 2*cap(c.send); i++ {
+		c.queue([]byte("m"))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second/4 {
+		t.Fatalf("offering to a slow client took %v", elapsed)
+	}
+	if atomic.LoadUint64(&c.coalesced) == 0 {
+		t.Fatal("no updates coalesced")
+	}
+	if atomic.LoadUint64(&c.dropped) == 0 {
+		t.Fatal("no frames dropped from a full queue")
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	last, got := -1, 0
+	for last < updates-1 {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(message) < 6 {
+			continue
+		}
+		var seq int
+		fmt.Sscanf(string(message[:6]), "%d", &seq)
+		if seq <= last {
+			t.Fatalf("update %d after %d", seq, last)
+		}
+		last = seq
+		got++
+	}
+	if got == updates {
+		t.Fatal("every update was sent")
+	}
+	if c.Lag() <= 0 {
+		t.Fatal("no lag measured")
+	}
+}
+
+// The writer can take an update while the next one is being built
+func TestBuildUnlocked(t *testing.T) {
+	c := newConnection(nil)
+	building, release, offered := make(chan bool), make(chan bool), make(chan bool)
+	go func() {
+		c.offerUpdate(func(behind bool) []byte {
+			close(building)
+			<-release
+			return []byte("update")
+		})
+		close(offered)
+	}()
+	<-building
+	taken := make(chan bool)
+	go func() {
+		c.takeUpdate()
+		close(taken)
+	}()
+	select {
+	case <-taken:
+	case <-time.After(time.Second):
+		t.Fatal("the writer waited for a frame to be built")
+	}
+	close(release)
+	<-offered
+	if update, _ := c.takeUpdate(); string(update) != "update" {
+		t.Fatalf("took %q", update)
+	}
+}
+
+// When the server hangs up, the client gets what was queued, then a close
+// frame saying why
+func TestHangUp(t *testing.T) {
+	srv := newTestServer()
+	ws, c := dialTest(t, srv)
+	c.queue([]byte("bye"))
+	c.hangUpFor(closeKicked, "kicked")
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != "bye" {
+		t.Fatalf("read %q, %v", message, err)
+	}
+	expectClose(t, ws, closeKicked, "kicked")
+	expectDropped(t, srv, c)
+}
+
+func TestClientGone(t *testing.T) {
+	srv := newTestServer()
+	ws, c := dialTest(t, srv)
+	ws.Close()
+	expectDropped(t, srv, c)
+}
+
+// Cancelling, as taking a session over does, closes the transport under
+// both goroutines
+func TestCancel(t *testing.T) {
+	srv := newTestServer()
+	ws, c := dialTest(t, srv)
+	c.cancel()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("read from a cancelled connection")
+	}
+	expectDropped(t, srv, c)
+}
+
+// A reader with more moves than its player takes keeps reading, so the
+// connection still ends when the client goes
+func TestReaderNeverBlocks(t *testing.T) {
+	srv := newTestServer()
+	srv.config.Net.CommandRate = 1e6
+	srv.config.Net.CommandBurst = 1e6
+	ws, c := dialTest(t, srv)
+	c.setPlayer(srv.world.NewEntityID(), NewPlayer(c, srv.world, srv.world.offsets))
+	for i := 0; i < 4; i++ {
+		move := fmt.Sprintf("%d:mv:%s", i+1, strings.Repeat("e", 100))
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(move)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A command after the moves shows they were all read
+	ws.WriteMessage(websocket.TextMessage, []byte("5:bl:1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.Blurred() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !c.Blurred() {
+		t.Fatal("reader stuck behind the move queue")
+	}
+	if len(c.player.moveQueue) != cap(c.player.moveQueue) {
+		t.Fatalf("%d moves queued", len(c.player.moveQueue))
+	}
+	ws.Close()
+	expectDropped(t, srv, c)
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := newTestServer()
+	srv.config.Net.CommandRate = 1
+	srv.config.Net.CommandBurst = 10
+	ws, c := dialTest(t, srv)
+	c.setPlayer(srv.world.NewEntityID(), NewPlayer(c, srv.world, srv.world.offsets))
+	ws.WriteMessage(websocket.TextMessage, []byte("1:mv:"+strings.Repeat("e", 30)))
+	ws.WriteMessage(websocket.TextMessage, []byte("2:bl:1"))
+	time.Sleep(100 * time.Millisecond)
+	if n := len(c.player.moveQueue); n != 10 {
+		t.Fatalf("%d moves let through, expected 10", n)
+	}
+	if c.Blurred() {
+		t.Fatal("command let through past the limit")
+	}
+	if n := atomic.LoadUint64(&c.limitedCount); n != 21 {
+		t.Fatalf("%d limited, expected 21", n)
+	}
+}
+
+func TestMalformedCommand(t *testing.T) {
+	srv := newTestServer()
+	ws, c := dialTest(t, srv)
+	ws.WriteMessage(websocket.TextMessage, []byte("nonsense"))
+	expectClose(t, ws, closeKicked, "malformed command")
+	expectDropped(t, srv, c)
+}
+
+func TestReadLimit(t *testing.T) {
+	srv := newTestServer()
+	ws, c := dialTest(t, srv)
+	ws.WriteMessage(websocket.TextMessage, []byte("1:ch:"+strings.Repeat("x", 10000)))
+	expectClose(t, ws, websocket.CloseMessageTooBig, "")
+	expectDropped(t, srv, c)
+}
+
+func TestOrigin(t *testing.T) {
+	srv := newTestServer()
+	srv.config.Net.AllowedOrigins = []string{"https://Example.com/"}
+	try := func(origin string) bool {
+		r := httptest.NewRequest("GET", "http://game.local:8080/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return srv.checkOrigin(r)
+	}
+	for _, origin := range []string{"", "http://game.local:8080", "https://example.com"} {
+		if !try(origin) {
+			t.Errorf("%q refused", origin)
+		}
+	}
+	for _, origin := range []string{"https://evil.example", "http://game.local:9090"} {
+		if try(origin) {
+			t.Errorf("%q allowed", origin)
+		}
+	}
+	srv.config.Net.AllowedOrigins = []string{"*"}
+	if !try("https://evil.example") {
+		t.Error("* refused an origin")
+	}
+}
@@ -6,10 +6,15 @@ import (
 	"math/big"
 	//"math/rand"
 	"sort"
+
+	"github.com/StCredZero/ROTCS/protocol"
 )
 
-const subgrid_width = 79
-const subgrid_height = 25
+// A subgrid is exactly one client view, which the protocol fixes, so its
+// size isn't in the config. Map frames and the life grid both assume the
+// two match.
+const subgrid_width = protocol.ViewWidth
+const subgrid_height = protocol.ViewHeight
 
 type GridSize struct {
 	x int
@@ -108,13 +113,11 @@ func (self Coord) VisibleGrids(xdist int64, ydist int64, sizer Sizer, gcoords []
 	return gcoords[:count]
 }
 
-var Base91Table = []rune{'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '!', '#', '$', '%', '&', '(', ')', '*', '+', ',', '.', '/', ':', ';', '<', '=', '>', '?', '@', '[', ']', '^', '_', '`', '{', '|', '}', '~', '-'}
-
-func (self Coord) WriteDisplay(player Entity, buffer *bytes.Buffer) {
+// DisplayOffset is the position relative to the player's view corner
+func (self Coord) DisplayOffset(player Entity) (uint8, uint8) {
 	dx := self.x - player.Coord().x + (subgrid_width / 2)
 	dy := self.y - player.Coord().y + (subgrid_height / 2)
-	buffer.WriteRune(Base91Table[dx])
-	buffer.WriteRune(Base91Table[dy])
+	return uint8(dx), uint8(dy)
 }
 
 func (self Coord) InRange(other Coord, xrange int, yrange int) bool {
@@ -158,6 +161,21 @@ func (self LCoord) inBounds(sizer Sizer) bool {
 		self.x < size.x && self.y < size.y
 }
 
+// MovedBack is the neighbor on the opposite side from a DunGen direction
+func (self LCoord) MovedBack(dir int) LCoord {
+	switch dir {
+	case North:
+		return LCoord{self.x, self.y + 1}
+	case South:
+		return LCoord{self.x, self.y - 1}
+	case East:
+		return LCoord{self.x - 1, self.y}
+	case West:
+		return LCoord{self.x + 1, self.y}
+	}
+	return self
+}
+
 type SortableLCoords []LCoord
 
 func (this SortableLCoords) Len() int {
@@ -1,30 +1,75 @@
 package main
 
 import (
-	"bytes"
-	"math/rand"
+	"net"
 	"net/http"
 	"runtime"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type CstServer struct {
+	admission *AdmissionQueue
+
+	// Commands from the admin API and slash commands, run between ticks
+	adminQueue chan adminCommand
+
+	clock Clock
+
+	config ServerConfig
+
 	// Registered connections.
 	connections map[*connection]EntityID
 
+	// Closed once a shutdown has finished
+	done chan struct{}
+
 	dropped map[EntityID](*connection)
 
 	droppedQueue chan *connection
 
+	// healthServing, healthDraining or healthStopping, read off the tick
+	// goroutine by the health check
+	health int32
+
+	// Closed by Shutdown so no one new can connect
+	listeners       []net.Listener
+	listenersClosed bool
+	listenerMutex   sync.Mutex
+
+	resumeSigner *ResumeSigner
+
 	load float64
 
+	metrics *Metrics
+
+	profiler *TickProfiler
+
+	// When the tick phase under way started, and how long each took
+	phaseStart time.Time
+	phaseTimes [phaseCount]time.Duration
+
+	// Set when the server plays a replay instead of running live
+	playback *Playback
+
+	// Set once the server is draining or shutting down
+	stopping *shutdown
+
 	population int
 
+	recorder *ReplayRecorder
+
+	// Who may run which slash commands, and where what they ran is logged
+	roles *Roles
+	audit *AuditLog
+
 	reconnectQueue chan reconnect
 
+	// Watching connections. They have no entity in the world.
+	spectators map[*connection]*Spectator
+
 	// Register requests from the connections.
 	register chan *connection
 
@@ -33,37 +78,68 @@ type CstServer struct {
 	// Unregister requests from connections.
 	unregister chan *connection
 
+	// Upgrades /ws requests from allowed origins
+	upgrader *websocket.Upgrader
+
 	//entityIdGen chan EntityID
 
 	world *WorldGrid
 }
 
-func NewCstServer() *CstServer {
+// NewCstServer builds the world from seeds. A recording server passes
+// RecordingSeeds and then sets recorder; a playback server passes the
+// Playback's seeds.
+func NewCstServer(config ServerConfig, seeds SeedSource) *CstServer {
 
 	var srv = CstServer{
+		admission:      NewAdmissionQueue(),
+		adminQueue:     make(chan adminCommand, 64),
+		clock:          SystemClock{},
+		config:         config,
+		done:           make(chan struct{}),
 		reconnectQueue: make(chan reconnect, 1000),
 		register:       make(chan *connection, 1000),
 		dropped:        make(map[EntityID](*connection)),
 		droppedQueue:   make(chan *connection, 1000),
+		metrics:        NewMetrics(),
+		profiler:       NewTickProfiler(config.SlowTickCapture, config.SlowTickCaptureTicks, config.SlowTickDir),
+		resumeSigner:   NewResumeSigner(),
+		roles:          &Roles{},
+		spectators:     make(map[*connection]*Spectator),
 		unregister:     make(chan *connection, 1000),
 		connections:    make(map[*connection]EntityID),
 	}
-	srv.world = NewWorldGrid()
+	srv.upgrader = newUpgrader(&srv)
+	srv.world = NewWorldGrid(seeds)
 
 	for _, gc := range srv.world.spawnGrids {
 		sg := srv.world.subgridAtGrid(gc)
 		sg.lifeAllowed = false
 	}
 
-	srv.world.PutEntityAt(NewShipGuard(), Coord{10, 12})
-	srv.world.PutEntityAt(NewShipGuard(), Coord{19, 9})
-	srv.world.PutEntityAt(NewShipGuard(), Coord{19, 15})
-	srv.world.PutEntityAt(NewShipGuard(), Coord{33, 9})
-	srv.world.PutEntityAt(NewShipGuard(), Coord{33, 15})
+	Prefabs.SpawnAll(srv.world)
+
+	// The tunables the simulation reads go into effect, and into a
+	// recording, in the first tick
+	srv.adminQueue <- adminCommand{run: func(srv *CstServer) (interface{}, error) {
+		return nil, srv.setGameplay()
+	}}
 
 	return &srv
 }
 
+func (srv *CstServer) Now() time.Time {
+	return srv.clock.Now()
+}
+
+// EndPhase times the phase of the tick that just finished, for the
+// metrics
+func (srv *CstServer) EndPhase(phase int) {
+	now := srv.clock.Now()
+	srv.phaseTimes[phase] += now.Sub(srv.phaseStart)
+	srv.phaseStart = now
+}
+
 func (srv *CstServer) ServerLoad() float64 {
 	return srv.load
 }
@@ -76,161 +152,226 @@ func (srv *CstServer) TickNumber() uint64 {
 	return srv.tickNumber
 }
 
+// registerConnection resumes, admits or queues a new connection. Clients
+// whose reconnect command came in first take their player back without
+// waiting.
 func (srv *CstServer) registerConnection(c *connection) {
-	LogTrace("starting register")
-	var buffer bytes.Buffer
-
-	x := 1.0 - srv.load
-	p := x * x
-
-	if rand.Float64() < p {
-		player := NewPlayer(c, srv.world)
-		entity, _ := srv.world.NewEntity(player)
-		c.id = entity.EntityID()
-		c.player = player
-		srv.connections[c] = c.id
-		buffer.WriteString(`{"type":"init",`)
-
-		buffer.WriteString(`"uuid":"`)
-		buffer.WriteString(c.id.String())
-		buffer.WriteString(`",`)
-
-		buffer.WriteString(`"approved":1}`)
-		LogTrace("Initialized entity: ", entity)
-	} else {
-		buffer.WriteString(`{"type":"init",`)
-		buffer.WriteString(`"pop":`)
-		buffer.WriteString(strconv.FormatInt(int64(srv.population), 10))
-		buffer.WriteRune(',')
-
-		buffer.WriteString(`"load":`)
-		buffer.WriteString(strconv.FormatFloat(srv.load, 'f', 2, 64))
-		buffer.WriteString(`}`)
-		LogTrace("refused registration")
-	}
-	c.send <- buffer.Bytes()
-
+	c.registered = true
+	if c.spectator != nil {
+		if srv.stopping != nil {
+			srv.sendAway(c)
+			return
+		}
+		srv.addSpectator(c)
+		return
+	}
+	lane := laneNew
+	if c.resumeToken != "" {
+		claim, valid := srv.resumeSigner.Verify(c.resumeToken, srv.clock.Now())
+		if valid && srv.takeSession(claim, c) {
+			return
+		}
+		srv.refuseResume(c)
+		if valid {
+			lane = laneResume
+		}
+	}
+	if srv.stopping != nil {
+		// Players can still take their sessions back, but no one new
+		// gets in
+		srv.sendAway(c)
+		return
+	}
+	if srv.admission.Len() == 0 && srv.hasCapacity() {
+		srv.admit(c)
+		return
+	}
+	if srv.admission.Len() >= srv.config.MaxQueue {
+		srv.metrics.CountRejected(rejectQueueFull)
+		srv.turnAway(c)
+		return
+	}
+	srv.admission.Push(c, lane)
+	srv.notifyQueue(false)
 }
 
 func (srv *CstServer) unregisterConnection(c *connection) {
-	LogTrace("closing-final")
+	logTrace(netLog, "unregistered", "conn", c, tickAttr(srv.tickNumber))
 	srv.world.RemoveEntityID(c.id)
 	delete(srv.connections, c)
+	c.hangUp()
+	srv.recorder.Leave(c.id)
+	srv.admission.NoteDeparture(srv.clock.Now())
 }
 
 func (srv *CstServer) reconnect(oldConn, newConn *connection) {
-	LogTrace("reconnecting: ", oldConn.id)
 	delete(srv.connections, oldConn)
+	oldConn.hangUp()
 
-	newConn.id = oldConn.id
-	newConn.player = oldConn.player
+	newConn.setPlayer(oldConn.id, oldConn.player)
+	newConn.player.Connection = newConn
+	newConn.player.dropped = false
+	newConn.player.SetInitialized(false)
 
 	srv.connections[newConn] = oldConn.id
-	LogTrace("Reconnected player: ", newConn.id)
+	srv.recorder.Resume(newConn.id)
+	logTrace(netLog, "reconnected", "conn", newConn, tickAttr(srv.tickNumber))
 }
 
-const ticksPerSec = 8
-const tickSecs = 1.0 / ticksPerSec
+// collectInputs starts every player's tick with what its client sent
+func (srv *CstServer) collectInputs() {
+	for c := range srv.connections {
+		input := c.player.takeInput()
+		srv.recordInput(c.player, input)
+		c.player.applyInput(input)
+	}
+}
 
-func (srv *CstServer) runLoop() {
-	var load [ticksPerSec]float64
-	for {
-		startTime := time.Now()
-		runtime.Gosched()
+// The tick rate. main sets it from the config with setTickRate before
+// making a server; it never changes after.
+var ticksPerSec uint64 = 8
+var tickSecs = 1.0 / float64(ticksPerSec)
+
+// setTickRate sets the tick rate and the intervals counted in ticks
+func setTickRate(rate int) {
+	ticksPerSec = uint64(rate)
+	tickSecs = 1.0 / float64(rate)
+	queueRefreshTicks = ticksPerSec * 5
+	keyframeInterval = ticksPerSec * 4
+	followRetryTicks = ticksPerSec
+	digestTicks = ticksPerSec
+}
 
-	dropped:
-		for {
-			select {
-			case c := <-srv.droppedQueue:
-				srv.dropped[c.id] = c
-			default:
-				break dropped
-			}
+/*
+Step advances the server exactly one tick. It takes in everything the
+connection goroutines queued since the last tick, runs the simulation and
+sends the displays. It never sleeps and reads time only from the server's
+Clock, so a harness can drive it directly.
+*/
+func (srv *CstServer) Step() {
+	srv.recorder.Tick(srv.tickNumber)
+
+	now := srv.clock.Now()
+	srv.phaseStart = now
+	srv.phaseTimes = [phaseCount]time.Duration{}
+dropped:
+	for {
+		select {
+		case c := <-srv.droppedQueue:
+			srv.dropConnection(c, now)
+		default:
+			break dropped
 		}
+	}
 
-		now := time.Now()
-		for id, c := range srv.dropped {
-			if c.deadline.Add(time.Second * 20).After(now) {
-				LogTrace("Remove from dropped: ", id)
-				delete(srv.dropped, id)
-				srv.unregister <- c
-			}
-		}
+	srv.expireDropped(now)
 
-	reconnect:
-		for {
-			select {
-			case rc := <-srv.reconnectQueue:
-				oldConn, present := srv.dropped[rc.oldId]
-				if present {
-					delete(srv.dropped, rc.oldId)
-					srv.reconnect(oldConn, rc.newConn)
-				}
-			default:
-				break reconnect
-			}
+reconnect:
+	for {
+		select {
+		case rc := <-srv.reconnectQueue:
+			srv.resume(rc)
+		default:
+			break reconnect
 		}
-	register:
-		for {
-			select {
-			case c := <-srv.register:
-				srv.registerConnection(c)
-			default:
-				break register
-			}
+	}
+register:
+	for {
+		select {
+		case c := <-srv.register:
+			srv.registerConnection(c)
+		default:
+			break register
 		}
-	unregister:
-		for {
-			select {
-			case c := <-srv.unregister:
-				srv.unregisterConnection(c)
-			default:
-				break unregister
-			}
+	}
+unregister:
+	for {
+		select {
+		case c := <-srv.unregister:
+			srv.unregisterConnection(c)
+		default:
+			break unregister
 		}
-		prepop, cull := srv.world.prepopCullGrids()
+	}
+	srv.runAdminCommands()
+	srv.rebuildFrozen()
+	srv.stepShutdown()
+	srv.admitWaiting()
+	srv.collectInputs()
+	srv.EndPhase(phaseDrain)
+
+	srv.world.Step(srv)
+	srv.updateSpectators()
+	srv.sendSpectatorDisplays()
+	srv.EndPhase(phaseSpectators)
+
+	if srv.tickNumber%digestTicks == 0 {
+		srv.recorder.Digest(srv.world.Digest())
+	}
+	srv.recorder.Flush()
+	if srv.tickNumber%ticksPerSec == 0 {
+		srv.population = srv.world.playerCount()
+	}
+	srv.tickNumber++
+}
 
-		srv.world.prepopulateGrids(prepop)
-		srv.world.cullGrids(cull)
-		srv.world.UpdateMovers(srv)
-		srv.world.SendDisplays(srv)
-		srv.world.discardEmpty()
+// runLoop steps the server in real time and measures the load, until it
+// shuts down
+func (srv *CstServer) runLoop() {
+	load := make([]float64, ticksPerSec)
+	for {
+		startTime := srv.clock.Now()
+		runtime.Gosched()
+		phase := int(srv.tickNumber % ticksPerSec)
+
+		srv.Step()
+		if srv.stopped() {
+			srv.finish()
+			return
+		}
 
+		srv.phaseStart = srv.clock.Now()
 		runtime.GC()
+		srv.EndPhase(phaseGC)
 
-		tickDuration := time.Since(startTime).Seconds()
-		phase := int(srv.tickNumber % ticksPerSec)
+		elapsed := srv.clock.Now().Sub(startTime)
+		srv.metrics.ObserveTick(&srv.phaseTimes, elapsed)
+		srv.profiler.EndTick(srv, elapsed)
+		tickDuration := elapsed.Seconds()
 		load[phase] = tickDuration / tickSecs
 
 		if phase == 0 {
 			var sum float64
-			for i := 0; i < ticksPerSec; i++ {
-				sum += load[i]
+			for _, l := range load {
+				sum += l
 			}
-			srv.load = sum / ticksPerSec
-			srv.population = srv.world.playerCount()
-			//message := fmt.Sprintf("Load: %f", avg)
-			//LogProfile("Players, Load: ", srv.population, srv.load)
+			srv.load = sum / float64(ticksPerSec)
+			srv.sampleWorld()
 		}
 
 		if tickDuration < tickSecs {
 			time.Sleep(time.Duration((tickSecs-tickDuration)*1000) * time.Millisecond)
 		}
-		srv.tickNumber++
 	}
 }
 
 func (srv *CstServer) wsHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := websocket.Upgrade(w, r, nil, 4096, 4096)
-	if _, ok := err.(websocket.HandshakeError); ok {
-		http.Error(w, "Not a websocket handshake", 400)
-		return
-	} else if err != nil {
+	ws, err := srv.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered with an HTTP error
 		return
 	}
 	c := newConnection(ws)
-	srv.register <- c
-	defer func() { srv.droppedQueue <- c }()
-	go c.writer()
-	c.reader(srv)
+	c.remote = r.RemoteAddr
+	c.codec = codecFor(r)
+	c.protocol = protocolVersion(r)
+	c.spectator, _ = spectatorFor(c, r)
+	if srv.playback != nil && c.spectator == nil {
+		// No one plays a recording
+		c.spectator = NewSpectator(c)
+	}
+	if deltasFor(r) {
+		c.tracker = NewEntityTracker()
+	}
+	srv.serve(c, func() { c.reader(srv) }, c.writer)
 }
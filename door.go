@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// Door state lives on top of the immutable DunGen tiles. A SubGrid holds
+// the state its prefab starts doors in, and the WorldGrid the state players
+// have left them in, which outlasts the SubGrid being culled. A door tile
+// with neither is closed.
+const DoorClosed int8 = 0
+const DoorOpen int8 = 1
+const DoorLocked int8 = 2
+
+// Display-only tile codes for doors that aren't open. DunGen never stores
+// these; DisplayTileAt reports them so clients can draw door state.
+const TileDoorClosed = protocol.TileDoorClosed
+const TileDoorLocked = protocol.TileDoorLocked
+
+var DoorStateNames = map[int8]string{
+	DoorClosed: "closed",
+	DoorOpen:   "open",
+	DoorLocked: "locked",
+}
+
+// DoorStateAt may be called concurrently through ParallelExec(). Door state
+// is only written by WorldGrid.Interact, after the parallel phase.
+func (self *SubGrid) DoorStateAt(loc Coord) int8 {
+	if self.OutOfBounds(loc) {
+		if self.parent != nil {
+			return self.parent.DoorStateAt(loc)
+		}
+		return DoorClosed
+	}
+	if self.parent != nil {
+		if state, present := self.parent.doors[loc]; present {
+			return state
+		}
+	}
+	return self.startDoorState(loc)
+}
+
+// startDoorState is the state the door at loc starts in
+func (self *SubGrid) startDoorState(loc Coord) int8 {
+	state, present := self.doors[loc]
+	if !present {
+		return DoorClosed
+	}
+	return state
+}
+
+// SetDoorState sets the state a door starts in
+func (self *SubGrid) SetDoorState(loc Coord, state int8) {
+	if state == DoorClosed {
+		delete(self.doors, loc)
+	} else {
+		self.doors[loc] = state
+	}
+}
+
+func (self *SubGrid) DeferInteract(ntt Entity, loc Coord) {
+	self.InteractQueue <- DeferredMove{
+		id:  ntt.EntityID(),
+		loc: loc,
+	}
+}
+
+func (self *WorldGrid) DoorStateAt(loc Coord) int8 {
+	if state, present := self.doors[loc]; present {
+		return state
+	}
+	subgrid, present := self.grid[loc.Grid(self)]
+	if !present {
+		return DoorClosed
+	}
+	return subgrid.DoorStateAt(loc)
+}
+
+// SetDoorState records the state a player left a door in. A door put back
+// the way it starts needs no record, so only doors that differ are kept.
+func (self *WorldGrid) SetDoorState(loc Coord, state int8) {
+	if state == self.subgridAtGrid(loc.Grid(self)).startDoorState(loc) {
+		delete(self.doors, loc)
+	} else {
+		self.doors[loc] = state
+	}
+	self.tileChanges = append(self.tileChanges, loc)
+	self.refreshViewers(loc)
+}
+
+/*
+refreshViewers has the players who can see loc redraw it. Clients that
+take tile patches get it in their next update's patch; the rest only get
+door state in a full map, so they're sent one.
+*/
+func (self *WorldGrid) refreshViewers(loc Coord) {
+	var gcoords [4]GridCoord
+	for _, gcoord := range loc.VisibleGrids(subgrid_width/2, subgrid_height/2, self, gcoords[:]) {
+		subgrid, present := self.grid[gcoord]
+		if !present {
+			continue
+		}
+		for _, ntt := range subgrid.Entities {
+			if ntt.IsPlayer() && ntt.ProtocolVersion() < protocol.MapTiles &&
+				ntt.Coord().InRange(loc, subgrid_width/2, subgrid_height/2) {
+				ntt.SetInitialized(false)
+			}
+		}
+	}
+}
+
+// Interact opens or closes the door at loc on behalf of ntt
+func (self *WorldGrid) Interact(ntt Entity, loc Coord) {
+	if self.DungeonAt(loc) != TileDoor {
+		ntt.AddMessage("nothing to use there")
+		return
+	}
+	subgrid := self.subgridAtGrid(loc.Grid(self))
+	switch subgrid.DoorStateAt(loc) {
+	case DoorLocked:
+		ntt.AddMessage("the door is locked")
+	case DoorOpen:
+		if !subgrid.EmptyAt(loc) {
+			ntt.AddMessage("something is in the doorway")
+			return
+		}
+		self.SetDoorState(loc, DoorClosed)
+		ntt.AddMessage("door closed")
+	case DoorClosed:
+		self.SetDoorState(loc, DoorOpen)
+		ntt.AddMessage("door opened")
+	}
+}
+
+func doorDisplayTile(state int8) int8 {
+	switch state {
+	case DoorOpen:
+		return TileDoor
+	case DoorLocked:
+		return TileDoorLocked
+	}
+	return TileDoorClosed
+}
+
+func (self *SubGrid) DisplayTileAt(loc Coord) int8 {
+	tile := self.DungeonAt(loc)
+	if tile == TileDoor {
+		return doorDisplayTile(self.DoorStateAt(loc))
+	}
+	return tile
+}
+
+func (self *WorldGrid) DisplayTileAt(loc Coord) int8 {
+	tile := self.DungeonAt(loc)
+	if tile == TileDoor {
+		return doorDisplayTile(self.DoorStateAt(loc))
+	}
+	return tile
+}
+
+// FillTilePatch lists the tiles changed this tick that the player can see.
+// Line and entity maps don't resend the whole view, so this keeps doors
+// current.
+func (self *SubGrid) FillTilePatch(player Entity, update *protocol.Update) {
+	for _, loc := range self.parent.tileChanges {
+		if !player.Coord().InRange(loc, subgrid_width/2, subgrid_height/2) {
+			continue
+		}
+		dx, dy := loc.DisplayOffset(player)
+		update.Patch = append(update.Patch, protocol.TilePatch{X: dx, Y: dy, Tile: self.DisplayTileAt(loc)})
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"math/rand"
-	"os"
 	"sort"
 )
 
@@ -246,6 +244,16 @@ func (self *DunGen) randomWall(dir int) (LCoord, bool) {
 	return keys[self.rng.Intn(n)], true
 }
 
+func (self *DunGen) inRoom(coord LCoord) bool {
+	for _, room := range self.rooms {
+		if coord.x >= room.x && coord.x < room.right() &&
+			coord.y >= room.y && coord.y < room.bottom() {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *DunGen) pickStartDir(dir int) LCoord {
 	var ok bool = false
 	var coord LCoord
@@ -302,7 +310,11 @@ func (self *DunGen) tryCorridor(coord LCoord, dir int) bool {
 	}
 	result := self.setRect(rect)
 	if result {
-		self.setCell(coord.x, coord.y, TileFloor)
+		if self.inRoom(coord.MovedBack(dir)) {
+			self.setCell(coord.x, coord.y, TileDoor)
+		} else {
+			self.setCell(coord.x, coord.y, TileFloor)
+		}
 		switch dir {
 		case North, South:
 			self.clearWalls(coord.x+1, coord.y)
@@ -337,7 +349,7 @@ func (self *DunGen) tryRoom(coord LCoord, dir int) bool {
 
 	result := self.setRoom(rect)
 	if result {
-		self.setCell(coord.x, coord.y, TileFloor)
+		self.setCell(coord.x, coord.y, TileDoor)
 		switch dir {
 		case North, South:
 			self.clearWalls(coord.x+1, coord.y)
@@ -475,29 +487,3 @@ func (self *DunGen) makePassagesWest(westDg *DunGen) {
 func (self *DunGen) TileAt(lcoord LCoord) int8 {
 	return self.dungeon_map[lcoord.x+(lcoord.y*self.size.x)]
 }
-
-func (self *DunGen) readFile(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	j := 0
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		for i, c := range line {
-			if i >= self.size.x {
-				break
-			}
-			if c == '0' {
-				self.setCell(i, j, TileWall)
-			} else {
-				self.setCell(i, j, TileFloor)
-			}
-		}
-		j++
-	}
-	return scanner.Err()
-}
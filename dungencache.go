@@ -1,16 +1,22 @@
 package main
 
 import (
-	"bytes"
-	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/StCredZero/ROTCS/protocol"
 
 	//"github.com/golang/groupcache/lru"
 )
 
+// The players in one SubGrid get their displays in parallel, and a lookup
+// may generate grids and carve passages into their neighbors, so lookups
+// hold mutex
 type DunGenCache struct {
 	entropy DunGenEntropy
 	cache   map[GridCoord]*DunGen
 	proto   DunGen
+	mutex   sync.Mutex
 }
 
 func NewDunGenCache(maxEntries int, entropy DunGenEntropy, proto DunGen) *DunGenCache {
@@ -29,12 +35,14 @@ func (self *DunGenCache) GridSize() GridSize {
 func (self *DunGenCache) basicDungeonAt(gcoord GridCoord) *DunGen {
 	dg, present := self.cache[gcoord]
 	if present {
+		atomic.AddUint64(&dunGenHits, 1)
 		return dg
 	} else {
+		atomic.AddUint64(&dunGenMisses, 1)
 		newdg := NewDunGen(&self.proto)
 		newdg.createDungeon(gcoord, self.entropy)
-		if gcoord == (GridCoord{0, 0}) {
-			newdg.readFile("resources/shipmap0")
+		if prefab, present := Prefabs.At(gcoord); present {
+			prefab.Apply(newdg)
 		}
 		self.cache[gcoord] = newdg
 		return newdg
@@ -42,6 +50,8 @@ func (self *DunGenCache) basicDungeonAt(gcoord GridCoord) *DunGen {
 }
 
 func (self *DunGenCache) InitAtGrid(gcoord GridCoord) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	self.DungeonAtGrid(gcoord)
 	var x, y int64
 	for y = -1; y <= 1; y++ {
@@ -53,6 +63,7 @@ func (self *DunGenCache) InitAtGrid(gcoord GridCoord) {
 	}
 }
 
+// DungeonAtGrid is only called with mutex held
 func (self *DunGenCache) DungeonAtGrid(gcoord GridCoord) *DunGen {
 	dg := self.basicDungeonAt(gcoord)
 	if !dg.passagedNorth {
@@ -75,92 +86,81 @@ func (self *DunGenCache) DungeonAtGrid(gcoord GridCoord) *DunGen {
 }
 
 func (self *DunGenCache) DungeonAt(coord Coord) int8 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	dgrid := self.DungeonAtGrid(coord.Grid(self))
 	lcoord := coord.LCoord(self)
 	return dgrid.TileAt(lcoord)
 }
 
 func (self *DunGenCache) WalkableAt(coord Coord) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	dgrid := self.DungeonAtGrid(coord.Grid(self))
 	lcoord := coord.LCoord(self)
 	return dgrid.isWalkable(lcoord.x, lcoord.y)
 }
 
-func (self *DunGenCache) WriteMap(ntt Entity, buffer *bytes.Buffer) {
+// TileMap is the view of the dungeon that map writers encode. A SubGrid
+// layers door state over its DunGenCache.
+type TileMap interface {
+	DisplayTileAt(Coord) int8
+	DungeonAt(Coord) int8
+	WalkableAt(Coord) bool
+}
+
+func (self *DunGenCache) FillMap(ntt Entity, tiles TileMap, m *protocol.MapUpdate) {
 	if ntt.Initialized() && manhattanDist(ntt.Coord(), ntt.LastDispCoord()) == 0 {
-		self.WriteEntityMap(ntt, buffer)
+		m.Type = protocol.MapEntity
 	} else if ntt.Initialized() && manhattanDist(ntt.Coord(), ntt.LastDispCoord()) == 1 {
-		self.WriteLineMap(ntt, buffer)
+		self.FillLineMap(ntt, tiles, m)
 	} else {
-		self.WriteBasicMap(ntt, buffer)
+		self.FillBasicMap(ntt, tiles, m)
 	}
 }
 
-func (self *DunGenCache) WriteEntityMap(ntt Entity, buffer *bytes.Buffer) {
-	buffer.WriteString(`"maptype":"entity"`)
-}
-
-func (self *DunGenCache) WriteLineMap(ntt Entity, buffer *bytes.Buffer) {
+// lineStart finds the row or column newly in view after a one step move
+func (self *DunGenCache) lineStart(ntt Entity) (Coord, rune) {
 	size := self.GridSize()
 	corner := ntt.Coord().Corner(self)
 	move := ntt.LastDispCoord().AsMoveTo(ntt.Coord())
-	var start Coord
 	switch move {
 	case 's':
-		start = Coord{corner.x, corner.y + int64(size.y) - 1}
+		return Coord{corner.x, corner.y + int64(size.y) - 1}, move
 	case 'e':
-		start = Coord{corner.x + int64(size.x) - 1, corner.y}
-	default:
-		start = corner
+		return Coord{corner.x + int64(size.x) - 1, corner.y}, move
 	}
-	buffer.WriteString(`"maptype":"line",`)
-	buffer.WriteString(`"start":[`)
-	buffer.WriteString(strconv.FormatInt(start.x, 10))
-	buffer.WriteRune(',')
-	buffer.WriteString(strconv.FormatInt(start.y, 10))
-	buffer.WriteString(`],`)
-	buffer.WriteString(`"orientation":"`)
-	buffer.WriteRune(move)
-	buffer.WriteString(`",`)
-	buffer.WriteString(`"line":"`)
+	return corner, move
+}
+
+func (self *DunGenCache) FillLineMap(ntt Entity, tiles TileMap, m *protocol.MapUpdate) {
+	size := self.GridSize()
+	start, move := self.lineStart(ntt)
+	m.Type = protocol.MapLine
+	m.StartX, m.StartY = start.x, start.y
+	m.Orientation = move
 	switch move {
 	case 'n', 's':
-		WriteBase64Map(start, size.x, 1, self, buffer)
+		fillMapData(start, size.x, 1, ntt, tiles, m)
 	case 'w', 'e':
-		WriteBase64Map(start, 1, size.y, self, buffer)
+		fillMapData(start, 1, size.y, ntt, tiles, m)
 	}
-	buffer.WriteRune('"')
 }
 
-func (self *DunGenCache) WriteBasicMap(ntt Entity, buffer *bytes.Buffer) {
+func (self *DunGenCache) FillBasicMap(ntt Entity, tiles TileMap, m *protocol.MapUpdate) {
 	size := self.GridSize()
-	buffer.WriteString(`"maptype":"basic",`)
-	buffer.WriteString(`"map":"`)
-	xstart := ntt.Coord().x - (int64(size.x) / 2)
-	ystart := ntt.Coord().y - (int64(size.y) / 2)
-	WriteBase64Map(Coord{xstart, ystart}, size.x, size.y, self, buffer)
-	buffer.WriteRune('"')
+	m.Type = protocol.MapBasic
+	fillMapData(ntt.Coord().Corner(self), size.x, size.y, ntt, tiles, m)
 	ntt.SetInitialized(true)
 }
 
-var Base64Runes = []rune{'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '+', '/'}
-
-func WriteBase64Map(corner Coord, xsize int, ysize int, dungeon *DunGenCache, buffer *bytes.Buffer) {
-	var v int = 0
-	i := 0
+// fillMapData reads the display tiles of a rectangle, row by row, in the
+// encoding the entity's client asked for
+func fillMapData(corner Coord, xsize int, ysize int, ntt Entity, tiles TileMap, m *protocol.MapUpdate) {
+	m.Encoding = ntt.ProtocolVersion()
 	for y := corner.y; y < corner.y+int64(ysize); y++ {
 		for x := corner.x; x < corner.x+int64(xsize); x++ {
-			if dungeon.WalkableAt(Coord{x, y}) {
-				v += int(1 << uint32(i%6))
-			}
-			if (i+1)%6 == 0 {
-				buffer.WriteRune(Base64Runes[v])
-				v = 0
-			}
-			i += 1
+			m.Tiles = append(m.Tiles, tiles.DisplayTileAt(Coord{x, y}))
 		}
 	}
-	if i%6 != 0 {
-		buffer.WriteRune(Base64Runes[v])
-	}
 }
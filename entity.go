@@ -7,13 +7,11 @@ import (
 	"html/template"
 	"math/rand"
 	"strings"
-	"time"
 
+	"github.com/StCredZero/ROTCS/protocol"
 	"github.com/satori/go.uuid"
 )
 
-var offsetRNG = rand.New(rand.NewSource(time.Now().UnixNano()))
-
 type EntityID [16]byte
 
 func (id EntityID) String() string {
@@ -21,12 +19,27 @@ func (id EntityID) String() string {
 	return myUuid.String()
 }
 
+// NewEntityID is for IDs outside the simulation. Entities in the world
+// get theirs from WorldGrid.NewEntityID.
 func NewEntityID() EntityID {
 	return EntityID(uuid.NewV1())
 }
 
+type SortableIDs []EntityID
+
+func (this SortableIDs) Len() int {
+	return len(this)
+}
+func (this SortableIDs) Less(i, j int) bool {
+	return bytes.Compare(this[i][:], this[j][:]) < 0
+}
+func (this SortableIDs) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
+
 const LifeActivateTogl uint64 = 0x01 << 1
 const LifeCellTogl uint64 = 0x01 << 2
+const InteractTogl uint64 = 0x01 << 3
 
 type Entity interface {
 	EntityID() EntityID
@@ -40,12 +53,15 @@ type Entity interface {
 	Collided() bool
 	CollideWall()
 	CollisionFrom(other Entity)
+	Codec() int
 	Coord() Coord
 	DeathSpawn() (Entity, bool)
 	Detect(Entity)
 	Direction() rune
 	DisplayString() string
+	DisplaySymbol() rune
 	DoToggleActions(*SubGrid, GridProcessor)
+	EntityTracker() *EntityTracker
 	FlagAt(uint64) bool
 	FormattedMessage(string) string
 	GetSubgrid() *SubGrid
@@ -63,6 +79,7 @@ type Entity interface {
 	MoveCommit()
 	MoveTimestamp() uint64
 	Outbox() []string
+	ProtocolVersion() int
 	SendDisplay(GridKeeper, GridProcessor)
 	SetCoord(Coord)
 	SetCollided()
@@ -72,7 +89,6 @@ type Entity interface {
 	SetInitialized(bool)
 	SetSubgrid(*SubGrid)
 	TickZero(GridProcessor) bool
-	WriteFor(Entity, *bytes.Buffer)
 }
 
 type EntityStoreT map[EntityID]Entity
@@ -111,6 +127,9 @@ func (ntt *EntityT) Collided() bool {
 }
 func (ntt *EntityT) CollideWall()         {}
 func (ntt *EntityT) CollisionFrom(Entity) {}
+func (ntt *EntityT) Codec() int {
+	return protocol.CodecJSON
+}
 func (ntt *EntityT) Coord() Coord {
 	return ntt.Location
 }
@@ -124,10 +143,16 @@ func (ntt *EntityT) Direction() rune {
 func (ntt *EntityT) DisplayString() string {
 	return fmt.Sprintf("%X%X%X%X", ntt.ID[0], ntt.ID[1], ntt.ID[2], ntt.ID[3])
 }
+func (ntt *EntityT) DisplaySymbol() rune {
+	return ntt.Symbol
+}
 func (ntt *EntityT) DoToggleActions(sg *SubGrid, gp GridProcessor) {}
 func (ntt *EntityT) EntityID() EntityID {
 	return ntt.ID
 }
+func (ntt *EntityT) EntityTracker() *EntityTracker {
+	return nil
+}
 func (ntt *EntityT) FlagAt(uint64) bool {
 	return false
 }
@@ -184,6 +209,9 @@ func (ntt *EntityT) MoveTimestamp() uint64 {
 func (ntt *EntityT) Outbox() []string {
 	return nil
 }
+func (ntt *EntityT) ProtocolVersion() int {
+	return protocol.MapBitmask
+}
 func (ntt *EntityT) SendDisplay(grid GridKeeper, gproc GridProcessor) {}
 func (ntt *EntityT) SetCollided()                                     {}
 func (ntt *EntityT) SetCoord(coord Coord) {
@@ -212,39 +240,56 @@ func (ntt *EntityT) TurnLeft() {
 func (ntt *EntityT) TurnRight() {
 	ntt.direction = rightOf(ntt.direction)
 }
-func (self *EntityT) WriteFor(player Entity, buffer *bytes.Buffer) {
-	self.Location.WriteDisplay(player, buffer)
-	buffer.WriteRune(self.Symbol)
-}
 
 type Player struct {
 	EntityT
+	blurred       bool
 	collided      bool
 	Connection    *connection
+	dropped       bool
+	flagQueue     chan uint64
 	flags         uint64
+	god           bool
 	inbox         []string
 	LastUpdateLoc Coord
+	missed        chan string
 	moveBuffer    []moveRequest
 	moveQueue     chan moveRequest
 	moveTimestamp uint64
+	muted         bool
 	outbox        []string
 	outQueue      chan string
+	// Only the newest resume token, with this nonce, is good
+	resumeNonce uint64
+	role        Role
+	roleName    string
+
+	// Messages in the update the client hasn't taken yet
+	unsent []string
 }
 
-func NewPlayer(c *connection, sizer Sizer) *Player {
+// A player starts with playerHealth and dies at playerDeadHealth
+const playerHealth = 80
+const playerDeadHealth = -10
+
+// offsets staggers entities' move schedules. It is the world's, so a seeded
+// world schedules them the same way every run.
+func NewPlayer(c *connection, sizer Sizer, offsets *rand.Rand) *Player {
 	entity := EntityT{
 		direction:    '0',
-		health:       80,
+		health:       playerHealth,
 		ID:           c.id,
 		Symbol:       '@',
 		MoveSchedule: 0xFF,
-		TickOffset:   uint64(offsetRNG.Intn(23)),
+		TickOffset:   uint64(offsets.Intn(23)),
 	}
 	size := sizer.GridSize()
 	return &Player{
 		Connection: c,
 		EntityT:    entity,
+		flagQueue:  make(chan uint64, 64),
 		inbox:      make([]string, 0, (size.x * size.y)),
+		missed:     make(chan string, maxMissedMessages),
 		moveBuffer: make([]moveRequest, 0, 4),
 		moveQueue:  make(chan moveRequest, 64),
 		outbox:     make([]string, 0, 20),
@@ -256,20 +301,6 @@ func (ntt *Player) AddMessage(msg string) {
 	ntt.inbox = append(ntt.inbox, msg)
 }
 func (ntt *Player) CalcMove(grid GridKeeper) Coord {
-	select {
-	case mv := <-ntt.moveQueue:
-		ntt.moveBuffer = append(make([]moveRequest, 0, 4), mv)
-	default:
-	}
-moveqloop:
-	for {
-		select {
-		case mv := <-ntt.moveQueue:
-			ntt.moveBuffer = append(ntt.moveBuffer, mv)
-		default:
-			break moveqloop
-		}
-	}
 	if len(ntt.moveBuffer) > 0 {
 		move := ntt.moveBuffer[0]
 		ntt.moveTimestamp = move.timestamp
@@ -283,9 +314,18 @@ func (ntt *Player) CanDamage(other Entity) bool {
 func (ntt *Player) CanSwapWith(other Entity) bool {
 	return other.IsPlayer()
 }
+func (ntt *Player) ChangeHealth(delta int) {
+	if delta < 0 && ntt.god {
+		return
+	}
+	ntt.health += delta
+}
 func (ntt *Player) ClearFlag(x uint64) {
 	ntt.flags &= ^x
 }
+func (ntt *Player) Codec() int {
+	return ntt.Connection.codec
+}
 func (ntt *Player) Collided() bool {
 	return ntt.collided
 }
@@ -294,7 +334,7 @@ func (ntt *Player) CollideWall() {
 }
 func (ntt *Player) CollisionFrom(other Entity) {
 	other.SetCollided()
-	if other.CanDamage(ntt) {
+	if other.CanDamage(ntt) && !ntt.god {
 		if other.Coord() == ntt.LocAhead() {
 			ntt.ChangeHealth(-1)
 			ntt.AddMessage("shield hit, damage -1")
@@ -308,12 +348,18 @@ func (ntt *Player) Detect(player Entity) {
 	//if player.IsPlayer() {
 	var buffer bytes.Buffer
 	for _, message := range player.Outbox() {
-		safe := template.HTMLEscapeString(message)
-		buffer.WriteString(`{"type":"message","data":"`)
-		buffer.WriteString(player.FormattedMessage(safe))
-		buffer.WriteString(`"}`)
-		ntt.Connection.send <- []byte(buffer.Bytes())
-		buffer.Truncate(0)
+		if ntt.dropped {
+			ntt.missMessage(player.FormattedMessage(message))
+			continue
+		}
+		if ntt.Codec() != protocol.CodecBinary {
+			message = template.HTMLEscapeString(message)
+		}
+		frame := protocol.Message{Data: player.FormattedMessage(message)}
+		protocol.Encode(ntt.Codec(), &frame, &buffer)
+		ntt.Connection.queue(buffer.Bytes())
+		// The writer has that one now
+		buffer = bytes.Buffer{}
 	}
 	//}
 }
@@ -339,6 +385,13 @@ func (ntt *Player) DoToggleActions(subgrid *SubGrid, gp GridProcessor) {
 			subgrid.SetLifeGridAt(loc, !value)
 		}
 	}
+	if ntt.FlagAt(InteractTogl) {
+		ntt.ClearFlag(InteractTogl)
+		subgrid.DeferInteract(ntt, ntt.LocAhead())
+	}
+}
+func (ntt *Player) EntityTracker() *EntityTracker {
+	return ntt.Connection.tracker
 }
 func (ntt *Player) FormattedMessage(msg string) string {
 	s := []string{ntt.DisplayString(), `: `, msg}
@@ -354,10 +407,10 @@ func (ntt *Player) InMaxRange(other Entity) bool {
 	return ntt.Location.InRange(other.Coord(), 39, 12)
 }
 func (ntt *Player) IsBlurred() bool {
-	return ntt.Connection.IsBlurred
+	return ntt.blurred
 }
 func (ntt *Player) IsDead() bool {
-	return ntt.Health() <= -10
+	return ntt.Health() <= playerDeadHealth
 }
 func (ntt *Player) IsPlayer() bool       { return true }
 func (ntt *Player) IsTransient() bool    { return false }
@@ -372,27 +425,103 @@ func (ntt *Player) MoveTimestamp() uint64 {
 	return ntt.moveTimestamp
 }
 func (ntt *Player) Outbox() []string {
+	if ntt.muted {
+		return nil
+	}
 	return ntt.outbox
 }
+func (ntt *Player) ProtocolVersion() int {
+	return ntt.Connection.protocol
+}
 func (ntt *Player) SendDisplay(grid GridKeeper, gproc GridProcessor) {
-	LogTrace("Start SendDisplay ", ntt.Location)
+	if ntt.dropped {
+		for _, msg := range ntt.inbox {
+			ntt.missMessage(msg)
+		}
+		ntt.collided = false
+		ntt.inbox = ntt.inbox[:0]
+		ntt.outbox = ntt.outbox[:0]
+		return
+	}
 	if ntt.IsBlurred() {
-		LogTrace("No SendDisplay: Blurred ", ntt.Location)
 		return
 	}
-	var buffer bytes.Buffer
-	grid.WriteDisplay(ntt, gproc, &buffer)
-	ntt.Connection.send <- buffer.Bytes()
+	ntt.Connection.offerUpdate(func(behind bool) []byte {
+		if behind {
+			// This frame replaces one the client never got
+			ntt.SetInitialized(false)
+			if tracker := ntt.EntityTracker(); tracker != nil {
+				tracker.ForceKeyframe()
+			}
+			ntt.inbox = append(append([]string{}, ntt.unsent...), ntt.inbox...)
+		}
+		ntt.unsent = append(ntt.unsent[:0], ntt.inbox...)
+		var buffer bytes.Buffer
+		grid.WriteDisplay(ntt, gproc, &buffer)
+		return buffer.Bytes()
+	})
 	ntt.LastUpdateLoc = ntt.Location
 	ntt.collided = false
 	ntt.inbox = ntt.inbox[:0]
 	ntt.outbox = ntt.outbox[:0]
-	LogTrace("End SendDisplay ", ntt.Location)
 }
 func (ntt *Player) SetFlag(x uint64) {
 	ntt.flags |= x
 }
 
+// Toggle queues a flag from the connection's reader for the next tick
+func (ntt *Player) Toggle(x uint64) {
+	select {
+	case ntt.flagQueue <- x:
+	default:
+	}
+}
+
+// QueueMove queues a move from the connection's reader for the next tick.
+// A full queue drops it, so a reader never waits on a player that has
+// left.
+func (ntt *Player) QueueMove(move moveRequest) {
+	select {
+	case ntt.moveQueue <- move:
+	default:
+	}
+}
+
+// playerInput is everything a client changed about its player for one
+// tick
+type playerInput struct {
+	moves   []moveRequest
+	flags   uint64
+	blurred bool
+}
+
+// takeInput drains what the client sent since the last tick. It is only
+// called from runLoop before UpdateMovers, so each tick sees one fixed set
+// of inputs, and that set is what a replay records.
+func (ntt *Player) takeInput() playerInput {
+	input := playerInput{blurred: ntt.Connection.Blurred()}
+	for {
+		select {
+		case mv := <-ntt.moveQueue:
+			input.moves = append(input.moves, mv)
+		case flag := <-ntt.flagQueue:
+			input.flags |= flag
+		default:
+			return input
+		}
+	}
+}
+
+// applyInput starts the tick with input. New moves replace whatever is
+// left of the last path.
+func (ntt *Player) applyInput(input playerInput) {
+	if len(input.moves) > 0 {
+		ntt.moveBuffer = append(make([]moveRequest, 0, len(input.moves)), input.moves...)
+	}
+	ntt.SetFlag(input.flags)
+	ntt.blurred = input.blurred
+}
+
 type detection struct {
 	id   EntityID
 	loc  Coord
@@ -410,13 +539,13 @@ const mstStart int = 0
 const mstToWall int = 1
 const mstFollow int = 2
 
-func NewMonster(id EntityID, sizer Sizer) Entity {
+func NewMonster(id EntityID, sizer Sizer, offsets *rand.Rand) Entity {
 	entity := EntityT{
 		health:       8,
 		ID:           id,
 		Symbol:       '%',
 		MoveSchedule: 0x55,
-		TickOffset:   uint64(offsetRNG.Intn(23)),
+		TickOffset:   uint64(offsets.Intn(23)),
 	}
 	size := sizer.GridSize()
 	return &Monster{
@@ -442,7 +571,9 @@ detectqloop:
 	}
 	minFound := false
 	for _, det := range ntt.detections {
-		if det.dist < min.dist {
+		// Detections arrive from players in parallel, so ties go by ID
+		if det.dist < min.dist || (det.dist == min.dist &&
+			bytes.Compare(det.id[:], min.id[:]) < 0) {
 			min = det
 			minFound = true
 		}
@@ -518,11 +649,16 @@ func (ntt *Monster) CollisionFrom(other Entity) {
 func (ntt *Monster) DeathSpawn() (Entity, bool) {
 	return NewLoot(), true
 }
+
+// How near a player has to be for a Monster to notice it. Set between
+// ticks, from the config.
+var detectionRadius = 7
+
 func (ntt *Monster) Detect(player Entity) {
 	if player.IsPlayer() {
 		loc1, loc2 := ntt.Coord(), player.Coord()
 		dist := distance(loc1, loc2)
-		if dist <= 7 {
+		if dist <= float64(detectionRadius) {
 			det := detection{
 				id:   player.EntityID(),
 				loc:  loc2,
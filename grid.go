@@ -2,14 +2,21 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	//"fmt"
+	"log/slog"
 	"math/rand"
-	"strconv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/StCredZero/ROTCS/protocol"
 )
 
 type GridProcessor interface {
+	EndPhase(int)
+	Now() time.Time
 	ServerLoad() float64
 	ServerPopulation() int
 	TickNumber() uint64
@@ -38,7 +45,7 @@ type GridKeeper interface {
 	UpdateMovers(GridProcessor)
 	WalkableAt(Coord) bool
 	WriteDisplay(Entity, GridProcessor, *bytes.Buffer)
-	WriteEntities(Entity, *bytes.Buffer)
+	FillEntities(Entity, *protocol.Update)
 }
 
 func ExecuteMove(ntt Entity, grid GridKeeper, loc Coord) {
@@ -78,24 +85,40 @@ type DeferredMove struct {
 }
 
 type SubGrid struct {
-	chatQueue   chan string
-	deaths      []EntityID
-	dunGenCache *DunGenCache
-	Entities    map[EntityID]Entity
-	GridCoord   GridCoord
-	Grid        map[Coord]EntityID
-	lifeActive  bool
-	lifeAllowed bool
-	lifeGrid    [][]bool
-	lifePhase   int
-	parent      *WorldGrid
-	ParentQueue chan DeferredMove
-	PlayerCount int
-	rng         *rand.Rand
-	size        GridSize
-}
-
-func NewSubGrid(gcoord GridCoord, sizer Sizer) *SubGrid {
+	chatQueue     chan string
+	deaths        []EntityID
+	doors         map[Coord]int8
+	dunGenCache   *DunGenCache
+	Entities      map[EntityID]Entity
+	GridCoord     GridCoord
+	Grid          map[Coord]EntityID
+	InteractQueue chan DeferredMove
+	lifeActive    bool
+	lifeAllowed   bool
+	lifeGrid      [][]bool
+	lifePhase     int
+	order         []EntityID
+	parent        *WorldGrid
+	ParentQueue   chan DeferredMove
+	// Time spent on the SubGrid in the last ParallelExec and PlayerExec,
+	// for the tick profiler. playerTime is nanoseconds, added atomically.
+	parallelTime time.Duration
+	playerTime   int64
+	PlayerCount  int
+	// Why the SubGrid stopped stepping, and the entities that broke
+	// invariants in it. See quarantine.go.
+	quarantined     string
+	suspects        []EntityID
+	quarantineMutex sync.Mutex
+	frozenAt        uint64
+	frozenNoticed   bool
+	rng             *rand.Rand
+	size            GridSize
+	// The entity being moved, for a panic's log
+	stepping EntityID
+}
+
+func NewSubGrid(gcoord GridCoord, sizer Sizer, seed int64) *SubGrid {
 	dgc := NewDunGenCache(10, DungeonEntropy, DungeonProto)
 	dgc.InitAtGrid(gcoord)
 
@@ -106,19 +129,25 @@ func NewSubGrid(gcoord GridCoord, sizer Sizer) *SubGrid {
 		lg[i] = make([]bool, size.x*size.y)
 	}
 
-	return &SubGrid{
-		chatQueue:   make(chan string, (size.x * size.y)),
-		deaths:      make([]EntityID, 0, 10),
-		dunGenCache: dgc,
-		Entities:    make(map[EntityID]Entity),
-		GridCoord:   gcoord,
-		Grid:        make(map[Coord]EntityID),
-		lifeAllowed: true,
-		lifeGrid:    lg,
-		ParentQueue: make(chan DeferredMove, ((2 * size.x) + (2 * size.y))),
-		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
-		size:        size,
+	subgrid := &SubGrid{
+		chatQueue:     make(chan string, (size.x * size.y)),
+		deaths:        make([]EntityID, 0, 10),
+		doors:         make(map[Coord]int8),
+		dunGenCache:   dgc,
+		Entities:      make(map[EntityID]Entity),
+		GridCoord:     gcoord,
+		Grid:          make(map[Coord]EntityID),
+		InteractQueue: make(chan DeferredMove, (size.x * size.y)),
+		lifeAllowed:   true,
+		lifeGrid:      lg,
+		ParentQueue:   make(chan DeferredMove, ((2 * size.x) + (2 * size.y))),
+		rng:           rand.New(rand.NewSource(seed)),
+		size:          size,
+	}
+	if prefab, present := Prefabs.At(gcoord); present {
+		prefab.ApplyDoors(subgrid)
 	}
+	return subgrid
 }
 
 func (self *SubGrid) DungeonAt(coord Coord) int8 {
@@ -126,6 +155,9 @@ func (self *SubGrid) DungeonAt(coord Coord) int8 {
 }
 
 func (srv *SubGrid) WalkableAt(coord Coord) bool {
+	if srv.dunGenCache.DungeonAt(coord) == TileDoor {
+		return srv.DoorStateAt(coord) == DoorOpen
+	}
 	return srv.dunGenCache.WalkableAt(coord)
 }
 
@@ -173,12 +205,13 @@ func (self *SubGrid) MarkDead(ntt Entity) {
 	self.deaths = append(self.deaths, ntt.EntityID())
 }
 
-const subgrid_placement_trys = 100
+// Random spots NewEntity tries. Set between ticks, from the config.
+var placementTries = 100
 
 func (self *SubGrid) MoveEntity(ntt Entity, loc Coord) {
 	if ntt.Coord() != loc {
 		if loc.Grid(self) != self.GridCoord {
-			ERROR.Panic(`Should not be here!`)
+			self.quarantine(ntt, "moved outside its subgrid", slog.Any("to", loc))
 		} else {
 			delete(self.Grid, ntt.Coord())
 			self.Grid[loc] = ntt.EntityID()
@@ -196,7 +229,7 @@ func (self *SubGrid) RandomCoord() Coord {
 
 func (self *SubGrid) NewEntity(ntt Entity) (Entity, bool) {
 	loc := self.RandomCoord()
-	for n := 0; (!(self.EmptyAt(loc) && self.WalkableAt(loc))) && (n < subgrid_placement_trys); n++ {
+	for n := 0; (!(self.EmptyAt(loc) && self.WalkableAt(loc))) && (n < placementTries); n++ {
 		loc = self.RandomCoord()
 	}
 	if !self.EmptyAt(loc) {
@@ -219,7 +252,8 @@ func (self *SubGrid) PassableAt(loc Coord) bool {
 }
 func (self *SubGrid) PutEntityAt(ntt Entity, loc Coord) {
 	if loc.Grid(self) != self.GridCoord {
-		ERROR.Panic("Should not put outside coord!")
+		self.quarantine(ntt, "put outside the subgrid", slog.Any("at", loc))
+		return
 	}
 	ntt.SetCoord(loc)
 	ntt.SetSubgrid(self)
@@ -257,30 +291,39 @@ func (self *SubGrid) SwapEntities(ntt, other Entity) {
 	nttLoc, otherLoc := ntt.Coord(), other.Coord()
 	grid1, grid2 := nttLoc.Grid(self), otherLoc.Grid(self)
 	if grid1 != self.GridCoord || grid2 != self.GridCoord {
-		ERROR.Panic(`Subgrid swapping outside bounds!`)
+		self.quarantine(ntt, "swapped outside the subgrid", slog.Any("with", other.EntityID()))
+		return
 	}
 	ntt.SetCoord(otherLoc)
 	other.SetCoord(nttLoc)
 	self.Grid[nttLoc] = other.EntityID()
 	self.Grid[otherLoc] = ntt.EntityID()
 }
-func (self *SubGrid) WriteEntities(player Entity, buffer *bytes.Buffer) {
+func (self *SubGrid) FillEntities(player Entity, update *protocol.Update) {
+	tracker := player.EntityTracker()
 	for _, id := range self.Grid {
 		if id != player.EntityID() {
 			ntt := self.Entities[id]
 			if player.InMaxRange(ntt) {
-				ntt.WriteFor(player, buffer)
+				if tracker != nil {
+					tracker.Observe(ntt)
+				} else {
+					dx, dy := ntt.Coord().DisplayOffset(player)
+					update.Entities = append(update.Entities, protocol.Mark{X: dx, Y: dy, Symbol: ntt.DisplaySymbol()})
+				}
 				ntt.Detect(player)
 			}
 		}
 	}
 }
 
-/*Any live cell with fewer than two live neighbours dies, as if caused by under-population.
+/*
+Any live cell with fewer than two live neighbours dies, as if caused by under-population.
 Any live cell with two or three live neighbours lives on to the next generation.
 Any live cell with more than three live neighbours dies, as if by overcrowding.
 Any dead cell with exactly three live neighbours becomes a live cell,
-	as if by reproduction.*/
+as if by reproduction.
+*/
 func (self *SubGrid) lifeGridLocal(x, y int) bool {
 	if x >= 0 && x < self.size.x && y >= 0 && y < self.size.y {
 		return self.lifeGrid[self.lifePhase][y*self.size.x+x]
@@ -312,8 +355,25 @@ func (self *SubGrid) updateLifeGrid() {
 	}
 	self.lifePhase = nextPhase
 }
+
+// UpdateMovers goes through the entities in ID order, so who gets to a
+// square first doesn't change from run to run
 func (self *SubGrid) UpdateMovers(gproc GridProcessor) {
-	for _, ntt := range self.Entities {
+	if self.Quarantined() {
+		return
+	}
+	self.order = self.order[:0]
+	for id, _ := range self.Entities {
+		self.order = append(self.order, id)
+	}
+	sort.Sort(SortableIDs(self.order))
+	for _, id := range self.order {
+		ntt, present := self.Entities[id]
+		if !present {
+			// replaced earlier this tick
+			continue
+		}
+		self.stepping = id
 		ntt.DoToggleActions(self, gproc)
 		if ntt.HasMove(gproc) {
 			loc := ntt.CalcMove(self)
@@ -323,6 +383,7 @@ func (self *SubGrid) UpdateMovers(gproc GridProcessor) {
 			self.MarkDead(ntt)
 		}
 	}
+	self.stepping = EntityID{}
 	if self.lifeActive { //&& (gproc.TickNumber()%4 == 0) {
 		self.updateLifeGrid()
 	}
@@ -333,70 +394,48 @@ func (self *SubGrid) SendDisplays(gproc GridProcessor) {
 	}
 }
 
+// updatePool recycles the frames WriteDisplay fills, since every player
+// gets one per tick
+var updatePool = sync.Pool{
+	New: func() interface{} { return protocol.NewUpdate() },
+}
+
 // WriteDisplay can only be called on the SubGrid through ParallelExec()
 // It is not concurrent
 func (self *SubGrid) WriteDisplay(ntt Entity, gproc GridProcessor, buffer *bytes.Buffer) {
-	x, y := ntt.Coord().x, ntt.Coord().y
-	buffer.WriteString(`{"type":"update",`)
-
-	buffer.WriteString(`"pop":`)
-	buffer.WriteString(strconv.FormatInt(int64(gproc.ServerPopulation()), 10))
-	buffer.WriteRune(',')
-
-	buffer.WriteString(`"load":`)
-	buffer.WriteString(strconv.FormatFloat(gproc.ServerLoad(), 'f', 2, 64))
-	buffer.WriteRune(',')
+	update := updatePool.Get().(*protocol.Update)
+	defer updatePool.Put(update)
+	update.Reset()
 
-	buffer.WriteString(`"location":[`)
-	buffer.WriteString(strconv.FormatInt(x, 10))
-	buffer.WriteRune(',')
-	buffer.WriteString(strconv.FormatInt(y, 10))
-	buffer.WriteString(`],`)
-
-	// direction
-	buffer.WriteString(`"d":"`)
-	buffer.WriteRune(ntt.Direction())
-	buffer.WriteString(`",`)
-
-	buffer.WriteString(`"health":`)
-	buffer.WriteString(strconv.FormatInt(int64(ntt.Health()), 10))
-	buffer.WriteRune(',')
+	update.Pop = gproc.ServerPopulation()
+	update.Load = gproc.ServerLoad()
+	update.X, update.Y = ntt.Coord().x, ntt.Coord().y
+	update.Direction = ntt.Direction()
+	update.Health = ntt.Health()
 
 	if gproc.TickNumber()%7 == 0 {
-		self.dunGenCache.WriteBasicMap(ntt, buffer)
+		self.dunGenCache.FillBasicMap(ntt, self, &update.Map)
 	} else {
-		self.dunGenCache.WriteMap(ntt, buffer)
+		self.dunGenCache.FillMap(ntt, self, &update.Map)
+	}
+	if ntt.ProtocolVersion() >= protocol.MapTiles {
+		self.FillTilePatch(ntt, update)
 	}
-	buffer.WriteRune(',')
 
-	buffer.WriteString(`"entities":`)
 	// This call to parent works concurrently. It's read only.
 	// It has to be the parent to coordinate all visible SubGrids
-	self.parent.WriteEntities(ntt, buffer)
-	buffer.WriteRune(',')
-
-	buffer.WriteString(`"li":`)
-	self.parent.WriteLife(ntt, buffer)
-	buffer.WriteRune(',')
-
-	if self.lifeAllowed {
-		buffer.WriteString(`"la":1,`)
+	self.parent.FillEntities(ntt, update)
+	if tracker := ntt.EntityTracker(); tracker != nil {
+		tracker.Flush(gproc.TickNumber(), update)
 	}
+	self.parent.FillLife(ntt, update)
 
-	buffer.WriteString(`"collided":`)
-	buffer.WriteRune(bool2rune(ntt.Collided()))
-	buffer.WriteRune(',')
-	buffer.WriteString(`"messages":[`)
-	for _, msg := range ntt.Inbox() {
-		buffer.WriteRune('"')
-		buffer.WriteString(msg)
-		buffer.WriteString(`",`)
-	}
-	buffer.WriteString(`""],`)
+	update.LifeAllowed = self.lifeAllowed
+	update.Collided = ntt.Collided()
+	update.Messages = append(update.Messages, ntt.Inbox()...)
+	update.Timestamp = ntt.MoveTimestamp()
 
-	buffer.WriteString(`"timestamp":`)
-	buffer.WriteString(strconv.FormatUint(ntt.MoveTimestamp(), 10))
-	buffer.WriteRune('}')
+	protocol.Encode(ntt.Codec(), update, buffer)
 }
 
 func (self *SubGrid) SendMessages() {
@@ -408,34 +447,92 @@ type WorldGrid struct {
 	dunGenCache *DunGenCache
 	grid        map[GridCoord]*SubGrid
 	entityGrid  map[EntityID]GridCoord
+	ids         *rand.Rand
+	// Staggers the move schedules of the entities it creates
+	offsets     *rand.Rand
 	rng         *rand.Rand
+	seeds       SeedSource
 	size        GridSize
 	spawnGrids  []GridCoord
+	tileChanges []Coord
+	// Door states players have set that differ from how the doors start.
+	// They outlast their SubGrid being culled.
+	doors map[Coord]int8
+	// The tick under way, for the log
+	tick uint64
 }
 
-func NewWorldGrid() *WorldGrid {
-	spawnGrids := []GridCoord{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {-1, -1}, {-1, 0}, {0, -1}}
+// Subgrids players spawn in, from the config
+var SpawnGrids = []GridCoord{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {-1, -1}, {-1, 0}, {0, -1}}
+
+func NewWorldGrid(seeds SeedSource) *WorldGrid {
+	spawnGrids := append([]GridCoord{}, SpawnGrids...)
 	dgCache := NewDunGenCache(1000, DungeonEntropy, DungeonProto)
 
 	return &WorldGrid{
+		doors:       make(map[Coord]int8),
 		dunGenCache: dgCache,
 		grid:        make(map[GridCoord]*SubGrid),
 		entityGrid:  make(map[EntityID]GridCoord),
-		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		ids:         rand.New(rand.NewSource(seeds.Seed(seedIDs, GridCoord{}))),
+		offsets:     rand.New(rand.NewSource(seeds.Seed(seedOffset, GridCoord{}))),
+		rng:         rand.New(rand.NewSource(seeds.Seed(seedWorld, GridCoord{}))),
+		seeds:       seeds,
 		size:        GridSize{subgrid_width, subgrid_height},
 		spawnGrids:  spawnGrids,
+		tileChanges: make([]Coord, 0, 8),
 	}
 }
 
 func (self *WorldGrid) subgridAtGrid(gridCoord GridCoord) *SubGrid {
 	subgrid, present := self.grid[gridCoord]
 	if !present {
-		subgrid = NewSubGrid(gridCoord, self)
+		subgrid = NewSubGrid(gridCoord, self, self.seeds.Seed(seedSubGrid, gridCoord))
 		subgrid.parent = self
 		self.grid[gridCoord] = subgrid
 	}
 	return subgrid
 }
+
+// gridCoords lists the SubGrids in a fixed order, for the serial phases
+// whose outcome depends on which SubGrid goes first
+func (self *WorldGrid) gridCoords() []GridCoord {
+	gcoords := make([]GridCoord, 0, len(self.grid))
+	for gcoord, _ := range self.grid {
+		gcoords = append(gcoords, gcoord)
+	}
+	sort.Sort(SortableGCoords(gcoords))
+	return gcoords
+}
+
+// NewEntityID draws IDs from the world's own RNG, so a seeded world names
+// its entities the same way every run. They are laid out as version 4
+// UUIDs.
+func (self *WorldGrid) NewEntityID() EntityID {
+	var id EntityID
+	binary.BigEndian.PutUint64(id[:8], self.ids.Uint64())
+	binary.BigEndian.PutUint64(id[8:], self.ids.Uint64())
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+// viewGrid finds the SubGrid to display the view at loc from. Where the
+// world has none, a detached one is made that sees the world's entities
+// but is never simulated, so watching a place doesn't change it. last is
+// reused if it covers the same grid.
+func (self *WorldGrid) viewGrid(loc Coord, last *SubGrid) *SubGrid {
+	gridCoord := loc.Grid(self)
+	if subgrid, present := self.grid[gridCoord]; present {
+		return subgrid
+	}
+	if last != nil && last.GridCoord == gridCoord {
+		return last
+	}
+	subgrid := NewSubGrid(gridCoord, self, time.Now().UnixNano())
+	subgrid.parent = self
+	return subgrid
+}
 func (self *WorldGrid) safeSubgridAtGrid(gridCoord GridCoord) *SubGrid {
 	subgrid, present := self.grid[gridCoord]
 	if !present {
@@ -463,13 +560,15 @@ func (self *WorldGrid) playerGrids() *(map[GridCoord]bool) {
 }
 
 func (self *WorldGrid) discardEmpty() {
-	for gc, subgrid := range self.grid {
+	for _, gc := range self.gridCoords() {
+		subgrid := self.grid[gc]
 		for _, id := range subgrid.deaths {
 			dead := self.EntityByID(id)
 			loc := dead.Coord()
 			spawn, spawned := dead.DeathSpawn()
 			self.RemoveEntityID(id)
 			if spawned {
+				spawn.SetEntityID(self.NewEntityID())
 				self.PutEntityAt(spawn, loc)
 			}
 		}
@@ -484,6 +583,7 @@ func (self *WorldGrid) discardEmpty() {
 		spawn, spawned := dead.DeathSpawn()
 		self.RemoveEntityID(id)
 		if spawned {
+			spawn.SetEntityID(self.NewEntityID())
 			self.PutEntityAt(spawn, loc)
 		}
 	}
@@ -521,24 +621,17 @@ func (self *WorldGrid) prepopulateGrids(grids *(map[GridCoord]bool)) {
 	if len(*grids) <= 0 {
 		return
 	}
-	n := self.rng.Intn(len(*grids))
-	i := 0
-	for gcoord, _ := range *grids {
-		if i == n {
-			ok := true
-			// monster population
-			for tries := 0; ok && tries < 3; tries++ {
-				monster := NewMonster(NewEntityID(), self)
-				_, ok = self.NewEntityInGrid(monster, gcoord)
-			}
-			break
-		}
-		i++
+	gcoord := sortedGrids(grids)[self.rng.Intn(len(*grids))]
+	ok := true
+	// monster population
+	for tries := 0; ok && tries < 3; tries++ {
+		monster := NewMonster(self.NewEntityID(), self, self.offsets)
+		_, ok = self.NewEntityInGrid(monster, gcoord)
 	}
 }
 
 func (self *WorldGrid) cullGrids(grids *(map[GridCoord]bool)) {
-	for gcoord, _ := range *grids {
+	for _, gcoord := range sortedGrids(grids) {
 		subgrid := self.subgridAtGrid(gcoord)
 		for id, ntt := range subgrid.Entities {
 			if ntt.IsTransient() {
@@ -549,42 +642,26 @@ func (self *WorldGrid) cullGrids(grids *(map[GridCoord]bool)) {
 	}
 }
 
-func (self *WorldGrid) WriteEntities(player Entity, buffer *bytes.Buffer) {
+func (self *WorldGrid) FillEntities(player Entity, update *protocol.Update) {
 	coord := player.Coord()
 	var gcoords [4]GridCoord
 	visibleGrids := coord.VisibleGrids(39, 12, self, gcoords[:])
-	buffer.WriteRune('"')
 	for _, gcoord := range visibleGrids {
 		subgrid, present := self.grid[gcoord]
 		if present {
-			subgrid.WriteEntities(player, buffer)
+			subgrid.FillEntities(player, update)
 		}
 	}
-	buffer.WriteRune('"')
 }
 
-func (self *WorldGrid) WriteLife(player Entity, buffer *bytes.Buffer) {
-	coord := player.Coord()
-	corner := Coord{coord.x - int64(self.size.x/2), coord.y - int64(self.size.y/2)}
-	buffer.WriteRune('"')
+func (self *WorldGrid) FillLife(player Entity, update *protocol.Update) {
+	corner := player.Coord().Corner(self)
 	var x, y int64
-	i, v := 0, 0
 	for y = 0; int(y) < self.size.y; y++ {
 		for x = 0; int(x) < self.size.x; x++ {
-			if self.LifeGridAt(Coord{corner.x + x, corner.y + y}) {
-				v += int(1 << uint32(i%6))
-			}
-			if (i+1)%6 == 0 {
-				buffer.WriteRune(Base64Runes[v])
-				v = 0
-			}
-			i += 1
+			update.Life = append(update.Life, self.LifeGridAt(Coord{corner.x + x, corner.y + y}))
 		}
 	}
-	if i%6 != 0 {
-		buffer.WriteRune(Base64Runes[v])
-	}
-	buffer.WriteRune('"')
 }
 
 func (self *WorldGrid) DungeonAt(coord Coord) int8 {
@@ -592,6 +669,12 @@ func (self *WorldGrid) DungeonAt(coord Coord) int8 {
 }
 
 func (srv *WorldGrid) WalkableAt(coord Coord) bool {
+	if srv.quarantinedAt(coord) {
+		return false
+	}
+	if srv.dunGenCache.DungeonAt(coord) == TileDoor {
+		return srv.DoorStateAt(coord) == DoorOpen
+	}
 	return srv.dunGenCache.WalkableAt(coord)
 }
 
@@ -636,7 +719,8 @@ func (self *WorldGrid) MarkDead(ntt Entity) {
 func (self *WorldGrid) MoveEntity(ntt Entity, loc Coord) {
 	gc1, present := self.entityGrid[ntt.EntityID()]
 	if !present {
-		ERROR.Panic("Moving nonexistent Entity")
+		self.quarantine(ntt, "moved but not in the world", slog.Any("to", loc))
+		return
 	}
 	sg1 := self.subgridAtGrid(gc1)
 	gc2 := loc.Grid(self)
@@ -651,10 +735,10 @@ func (self *WorldGrid) MoveEntity(ntt Entity, loc Coord) {
 }
 func (self *WorldGrid) NewEntity(ntt Entity) (Entity, bool) {
 	var newEntity Entity
-	ntt.SetEntityID(NewEntityID())
+	ntt.SetEntityID(self.NewEntityID())
 	ok := false
 	for !ok {
-		i := rand.Intn(len(self.spawnGrids))
+		i := self.rng.Intn(len(self.spawnGrids))
 		gridCoord := self.spawnGrids[i]
 		subgrid := self.subgridAtGrid(gridCoord)
 		newEntity, ok = subgrid.NewEntity(ntt)
@@ -666,7 +750,7 @@ func (self *WorldGrid) NewEntity(ntt Entity) (Entity, bool) {
 }
 func (self *WorldGrid) NewEntityInGrid(ntt Entity, gridCoord GridCoord) (Entity, bool) {
 	var newEntity Entity
-	ntt.SetEntityID(NewEntityID())
+	ntt.SetEntityID(self.NewEntityID())
 	done := false
 	subgrid := self.subgridAtGrid(gridCoord)
 	for tries := 0; !done && tries < 50; tries++ {
@@ -684,7 +768,8 @@ func (self *WorldGrid) PassableAt(loc Coord) bool {
 func (self *WorldGrid) PutEntityAt(ntt Entity, loc Coord) {
 	_, present := self.entityGrid[ntt.EntityID()]
 	if present {
-		ERROR.Panic("Placing already existing Entity")
+		self.quarantine(ntt, "put but already in the world", slog.Any("at", loc))
+		return
 	}
 	gridCoord := loc.Grid(self)
 	self.entityGrid[ntt.EntityID()] = gridCoord
@@ -719,14 +804,17 @@ func (self *WorldGrid) SwapEntities(ntt, other Entity) {
 	self.PutEntityAt(ntt, otherLoc)
 	self.PutEntityAt(other, nttLoc)
 }
-func (self *WorldGrid) ParallelExec(doWork func(*SubGrid)) {
+func (self *WorldGrid) ParallelExec(doWork func(*SubGrid), gproc GridProcessor) {
 	n := len(self.grid)
 	var wg sync.WaitGroup
 	wg.Add(n)
 	for _, subgrid := range self.grid {
 		go func(sg *SubGrid) {
 			defer wg.Done()
+			defer sg.recoverPanic(nil)
+			start := gproc.Now()
 			doWork(sg)
+			sg.parallelTime = gproc.Now().Sub(start)
 		}(subgrid)
 	}
 	wg.Wait()
@@ -735,12 +823,18 @@ func (self *WorldGrid) PlayerExec(doWork func(Entity, GridKeeper, GridProcessor)
 	n := self.playerCount()
 	var wg sync.WaitGroup
 	wg.Add(n)
+	for _, subgrid := range self.grid {
+		subgrid.playerTime = 0
+	}
 	for _, subgrid := range self.grid {
 		for _, ntt := range subgrid.Entities {
 			if ntt.IsPlayer() {
-				go func(e Entity, sg GridKeeper, gp GridProcessor) {
+				go func(e Entity, sg *SubGrid, gp GridProcessor) {
 					defer wg.Done()
+					defer sg.recoverPanic(e)
+					start := gp.Now()
 					doWork(e, sg, gp)
+					atomic.AddInt64(&sg.playerTime, int64(gp.Now().Sub(start)))
 				}(ntt, subgrid, gproc)
 			}
 		}
@@ -748,32 +842,79 @@ func (self *WorldGrid) PlayerExec(doWork func(Entity, GridKeeper, GridProcessor)
 	wg.Wait()
 }
 func (self *WorldGrid) UpdateMovers(gproc GridProcessor) {
+	self.tileChanges = self.tileChanges[:0]
 	self.ParallelExec(func(subgrid *SubGrid) {
 		subgrid.UpdateMovers(gproc)
-	})
-	for _, subgrid := range self.grid {
-		done := false
-		for !done {
-			select {
-			case deferred := <-subgrid.ParentQueue:
-				ntt := subgrid.Entities[deferred.id]
-				loc := ntt.CalcMove(self)
-				ExecuteMove(ntt, self, loc)
-				if ntt.IsDead() {
-					self.MarkDead(ntt)
-				}
-			default:
-				done = true
+	}, gproc)
+	// SubGrids share nothing while they run in parallel. Moves between
+	// them wait for here, and are done in a fixed order.
+	for _, gcoord := range self.gridCoords() {
+		self.drainQueues(self.grid[gcoord])
+	}
+}
+
+// drainQueues does the moves and interactions a SubGrid deferred. Nothing
+// leaves a quarantined SubGrid, so its queues are emptied instead.
+func (self *WorldGrid) drainQueues(subgrid *SubGrid) {
+	defer subgrid.recoverPanic(nil)
+	frozen := subgrid.Quarantined()
+	done := false
+	for !done {
+		select {
+		case deferred := <-subgrid.ParentQueue:
+			ntt := subgrid.Entities[deferred.id]
+			if ntt == nil || frozen {
+				// Removed after it deferred its move, or held where it is
+				continue
 			}
+			subgrid.stepping = deferred.id
+			loc := ntt.CalcMove(self)
+			ExecuteMove(ntt, self, loc)
+			if ntt.IsDead() {
+				self.MarkDead(ntt)
+			}
+		default:
+			done = true
+		}
+	}
+	subgrid.stepping = EntityID{}
+	done = false
+	for !done {
+		select {
+		case deferred := <-subgrid.InteractQueue:
+			// The entity may have crossed into another SubGrid this tick
+			ntt := self.EntityByID(deferred.id)
+			if ntt != nil && !frozen {
+				self.Interact(ntt, deferred.loc)
+			}
+		default:
+			done = true
 		}
 	}
 }
 
+// Step runs the simulation for one tick, after the server has taken in
+// joins, leaves and inputs
+func (self *WorldGrid) Step(gproc GridProcessor) {
+	self.tick = gproc.TickNumber()
+	prepop, cull := self.prepopCullGrids()
+	self.prepopulateGrids(prepop)
+	self.cullGrids(cull)
+	gproc.EndPhase(phasePrepopCull)
+	self.UpdateMovers(gproc)
+	gproc.EndPhase(phaseUpdateMovers)
+	self.SendDisplays(gproc)
+	self.noticeFrozen()
+	gproc.EndPhase(phaseSendDisplays)
+	self.discardEmpty()
+	gproc.EndPhase(phaseDiscardEmpty)
+}
+
 func (self *WorldGrid) SendDisplays(gproc GridProcessor) {
 	self.PlayerExec(func(ntt Entity, grid GridKeeper, gproc GridProcessor) {
 		ntt.SendDisplay(grid, gproc)
 	}, gproc)
 }
 func (self *WorldGrid) WriteDisplay(ntt Entity, gproc GridProcessor, buffer *bytes.Buffer) {
-	ERROR.Panic("Should not call on World!")
+	worldLog.Error("WriteDisplay called on the WorldGrid", "entity", ntt.EntityID())
 }
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Harness runs a seeded server with no websockets and no sleeping. Players
+are placed by hand, their moves are scripted, and Run advances the world a
+tick at a time on a ManualClock, so what happens can be checked exactly.
+*/
+type Harness struct {
+	Clock  *ManualClock
+	Server *CstServer
+	World  *WorldGrid
+}
+
+func NewHarness(seed int64) *Harness {
+	config := DefaultServerConfig()
+	config.Seed = seed
+	srv := NewCstServer(config, NewWorldSeed(seed))
+	clock := NewManualClock(time.Unix(0, 0))
+	srv.clock = clock
+	return &Harness{
+		Clock:  clock,
+		Server: srv,
+		World:  srv.world,
+	}
+}
+
+// PlacePlayer puts a player with a connection but no client at loc
+func (self *Harness) PlacePlayer(loc Coord) *Player {
+	c := newConnection(nil)
+	c.id = self.World.NewEntityID()
+	player := NewPlayer(c, self.World, self.World.offsets)
+	c.setPlayer(c.id, player)
+	self.World.PutEntityAt(player, loc)
+	self.Server.connections[c] = c.id
+	return player
+}
+
+// Place gives ntt a world ID and puts it at loc
+func (self *Harness) Place(ntt Entity, loc Coord) Entity {
+	ntt.SetEntityID(self.World.NewEntityID())
+	self.World.PutEntityAt(ntt, loc)
+	return ntt
+}
+
+// Script queues moves as if the player's client had sent them, one
+// direction rune per tick
+func (self *Harness) Script(player *Player, moves string) {
+	for i, move := range moves {
+		player.moveQueue <- moveRequest{direction: move, timestamp: uint64(i + 1)}
+	}
+}
+
+// Run steps the server n ticks and throws away what it sent
+func (self *Harness) Run(n int) {
+	for i := 0; i < n; i++ {
+		self.Server.Step()
+		self.Clock.Advance(time.Second / time.Duration(ticksPerSec))
+		self.drain()
+	}
+}
+
+func (self *Harness) drain() {
+	for c, _ := range self.Server.connections {
+	sent:
+		for {
+			select {
+			case <-c.send:
+			default:
+				break sent
+			}
+		}
+		c.takeUpdate()
+	}
+}
+
+// Find scans the grid at gcoord row by row for a location that fits
+func (self *Harness) Find(gcoord GridCoord, fits func(Coord) bool) (Coord, bool) {
+	size := self.World.GridSize()
+	for ly := 0; ly < size.y; ly++ {
+		for lx := 0; lx < size.x; lx++ {
+			loc := Coord{
+				gcoord.x*int64(size.x) + int64(lx),
+				gcoord.y*int64(size.y) + int64(ly),
+			}
+			if fits(loc) {
+				return loc, true
+			}
+		}
+	}
+	return Coord{}, false
+}
+
+func (self *Harness) Open(loc Coord) bool {
+	return self.World.PassableAt(loc)
+}
+
+func (self *Harness) ExpectAt(ntt Entity, loc Coord) error {
+	found, present := self.World.EntityAt(loc)
+	if ntt.Coord() != loc || !present || found.EntityID() != ntt.EntityID() {
+		return fmt.Errorf("%c at %v, expected %v", ntt.DisplaySymbol(), ntt.Coord(), loc)
+	}
+	return nil
+}
+
+func (self *Harness) ExpectHealth(ntt Entity, health int) error {
+	if ntt.Health() != health {
+		return fmt.Errorf("%c has health %d, expected %d", ntt.DisplaySymbol(), ntt.Health(), health)
+	}
+	return nil
+}
+
+func (self *Harness) ExpectLife(loc Coord, alive bool) error {
+	if self.World.LifeGridAt(loc) != alive {
+		return fmt.Errorf("life cell at %v is %v, expected %v", loc, !alive, alive)
+	}
+	return nil
+}
+
+// The grid the tests set up in, away from the spawn grids
+var testGrid = GridCoord{10, 10}
+
+// Each test gets a fresh world, so none depends on another
+
+func TestMoveOpen(t *testing.T) {
+	h := NewHarness(1)
+	loc, found := h.Find(testGrid, func(loc Coord) bool {
+		return h.Open(loc) && h.Open(loc.MovedBy('e'))
+	})
+	if !found {
+		t.Fatalf("no open floor in %v", testGrid)
+	}
+	player := h.PlacePlayer(loc)
+	h.Script(player, "e")
+	h.Run(1)
+	if err := h.ExpectAt(player, loc.MovedBy('e')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveWall(t *testing.T) {
+	h := NewHarness(1)
+	loc, found := h.Find(testGrid, func(loc Coord) bool {
+		return h.Open(loc) && !h.World.WalkableAt(loc.MovedBy('e'))
+	})
+	if !found {
+		t.Fatalf("no wall in %v", testGrid)
+	}
+	player := h.PlacePlayer(loc)
+	h.Script(player, "e")
+	h.Run(1)
+	if err := h.ExpectAt(player, loc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoot(t *testing.T) {
+	h := NewHarness(1)
+	loc, found := h.Find(testGrid, func(loc Coord) bool {
+		return h.Open(loc) && h.Open(loc.MovedBy('e'))
+	})
+	if !found {
+		t.Fatalf("no open floor in %v", testGrid)
+	}
+	player := h.PlacePlayer(loc)
+	h.Place(NewLoot(), loc.MovedBy('e'))
+	h.Script(player, "e")
+	h.Run(1)
+	if err := h.ExpectAt(player, loc.MovedBy('e')); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ExpectHealth(player, 82); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCrossGrid walks a player off the east edge of a subgrid. The move
+// is deferred to the WorldGrid, which has to hand the player over.
+func TestCrossGrid(t *testing.T) {
+	h := NewHarness(1)
+	size := h.World.GridSize()
+	var loc Coord
+	found := false
+	for gx := testGrid.x; !found && gx < testGrid.x+20; gx++ {
+		loc, found = h.Find(GridCoord{gx, testGrid.y}, func(loc Coord) bool {
+			return loc.LCoord(h.World).x == size.x-1 &&
+				h.Open(loc) && h.Open(loc.MovedBy('e'))
+		})
+	}
+	if !found {
+		t.Fatalf("no open subgrid edge near %v", testGrid)
+	}
+	dest := loc.MovedBy('e')
+	player := h.PlacePlayer(loc)
+	h.Script(player, "e")
+	h.Run(1)
+	if err := h.ExpectAt(player, dest); err != nil {
+		t.Fatal(err)
+	}
+	if player.GetSubgrid() == nil || player.GetSubgrid().GridCoord != dest.Grid(h.World) {
+		t.Fatalf("player not handed to subgrid %v", dest.Grid(h.World))
+	}
+	if h.World.EntityByID(player.EntityID()) != Entity(player) {
+		t.Fatal("player lost from the world's index")
+	}
+}
+
+// TestGuardPush walks a player into a ShipGuard, which throws the player
+// through to the far side
+func TestGuardPush(t *testing.T) {
+	h := NewHarness(1)
+	loc, found := h.Find(testGrid, func(loc Coord) bool {
+		return h.Open(loc) && h.Open(loc.MovedBy('e')) &&
+			h.Open(loc.MovedBy('e').MovedBy('e')) &&
+			loc.MovedBy('e').MovedBy('e').Grid(h.World) == testGrid
+	})
+	if !found {
+		t.Fatalf("no open floor in %v", testGrid)
+	}
+	player := h.PlacePlayer(loc)
+	guard := h.Place(NewShipGuard(), loc.MovedBy('e'))
+	h.Script(player, "e")
+	h.Run(1)
+	if err := h.ExpectAt(guard, loc.MovedBy('e')); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ExpectAt(player, loc.MovedBy('e').MovedBy('e')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// byDoor finds a closed door in testGrid and puts a player next to it
+func byDoor(t *testing.T, h *Harness) (Coord, *Player) {
+	var door Coord
+	var step rune
+	_, found := h.Find(testGrid, func(loc Coord) bool {
+		if h.World.DungeonAt(loc) != TileDoor {
+			return false
+		}
+		for _, dir := range "nsew" {
+			if h.Open(loc.MovedBy(dir)) && loc.MovedBy(dir).Grid(h.World) == testGrid {
+				door, step = loc, dir
+				return true
+			}
+		}
+		return false
+	})
+	if !found {
+		t.Fatalf("no door in %v", testGrid)
+	}
+	return door, h.PlacePlayer(door.MovedBy(step))
+}
+
+// TestDoorOutlastsCull opens a door, empties its subgrid so it's
+// discarded, and checks the rebuilt one still has the door open
+func TestDoorOutlastsCull(t *testing.T) {
+	h := NewHarness(1)
+	door, player := byDoor(t, h)
+	h.World.Interact(player, door)
+	h.World.RemoveEntityID(player.EntityID())
+	delete(h.Server.connections, player.Connection)
+	h.World.discardEmpty()
+	if _, present := h.World.grid[testGrid]; present {
+		t.Fatalf("%v not discarded", testGrid)
+	}
+	if state := h.World.subgridAtGrid(testGrid).DoorStateAt(door); state != DoorOpen {
+		t.Fatalf("door %s after its subgrid was rebuilt", DoorStateNames[state])
+	}
+}
+
+// TestDoorOverrides closes a door a player opened, which leaves nothing
+// to remember about it
+func TestDoorOverrides(t *testing.T) {
+	h := NewHarness(1)
+	door, player := byDoor(t, h)
+	h.World.Interact(player, door)
+	if len(h.World.doors) != 1 {
+		t.Fatalf("%d door states kept for one open door", len(h.World.doors))
+	}
+	h.World.Interact(player, door)
+	if h.World.DoorStateAt(door) != DoorClosed || len(h.World.doors) != 0 {
+		t.Fatalf("%d door states kept after the door closed again", len(h.World.doors))
+	}
+}
+
+// TestDoorViewers checks a player who sees a door change, without using
+// it, is sent a map showing it
+func TestDoorViewers(t *testing.T) {
+	h := NewHarness(1)
+	door, player := byDoor(t, h)
+	loc, found := h.Find(testGrid, func(loc Coord) bool {
+		return h.Open(loc) && h.World.EmptyAt(loc)
+	})
+	if !found {
+		t.Fatalf("no open floor in %v", testGrid)
+	}
+	viewer := h.PlacePlayer(loc)
+	h.Run(1)
+	if !viewer.Initialized() {
+		t.Fatal("viewer not sent a map")
+	}
+	h.World.Interact(player, door)
+	if viewer.Initialized() {
+		t.Fatal("viewer keeps a map with the door closed")
+	}
+}
+
+// TestLifeBlinker starts a row of three cells, which should turn into a
+// column after one generation
+func TestLifeBlinker(t *testing.T) {
+	h := NewHarness(1)
+	subgrid := h.World.subgridAtGrid(testGrid)
+	subgrid.lifeActive = true
+	size := h.World.GridSize()
+	center := Coord{
+		testGrid.x*int64(size.x) + 10,
+		testGrid.y*int64(size.y) + 10,
+	}
+	for _, move := range []rune{'w', '0', 'e'} {
+		subgrid.SetLifeGridAt(center.MovedBy(move), true)
+	}
+	h.Run(1)
+	for _, move := range []rune{'n', '0', 's'} {
+		if err := h.ExpectLife(center.MovedBy(move), true); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, move := range []rune{'w', 'e'} {
+		if err := h.ExpectLife(center.MovedBy(move), false); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestQuarantine puts a player in the world twice. The grid should
+// quarantine its subgrid rather than panic, and the player should stop.
+func TestQuarantine(t *testing.T) {
+	h := NewHarness(1)
+	loc, found := h.Find(testGrid, func(loc Coord) bool {
+		return h.Open(loc) && h.Open(loc.MovedBy('e'))
+	})
+	if !found {
+		t.Fatalf("no open floor in %v", testGrid)
+	}
+	player := h.PlacePlayer(loc)
+	h.World.PutEntityAt(player, loc)
+	subgrid := h.World.subgridAtGrid(testGrid)
+	if !subgrid.Quarantined() {
+		t.Fatalf("subgrid %v not quarantined", testGrid)
+	}
+	h.Script(player, "e")
+	h.Run(1)
+	if h.World.WalkableAt(loc.MovedBy('e')) {
+		t.Fatal("quarantined subgrid still walkable")
+	}
+	if err := h.ExpectAt(player, loc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// faulty stands in for an entity with a bug: it panics every tick
+type faulty struct {
+	Entity
+}
+
+func (ntt *faulty) DoToggleActions(sg *SubGrid, gp GridProcessor) {
+	panic("faulty entity")
+}
+
+// TestPanic has an entity panic. Its subgrid should freeze, the rest of
+// the world keep ticking, and a rebuild drop the entity.
+func TestPanic(t *testing.T) {
+	h := NewHarness(1)
+	open := func(loc Coord) bool {
+		return h.Open(loc) && h.Open(loc.MovedBy('e')) && h.Open(loc.MovedBy('s'))
+	}
+	loc, found := h.Find(testGrid, open)
+	other := GridCoord{testGrid.x + 1, testGrid.y}
+	otherLoc, otherFound := h.Find(other, open)
+	if !found || !otherFound {
+		t.Fatalf("no open floor in %v and %v", testGrid, other)
+	}
+	player := h.PlacePlayer(loc)
+	bystander := h.PlacePlayer(otherLoc)
+	bug := h.Place(&faulty{NewMonster(EntityID{}, h.World, h.World.offsets)}, loc.MovedBy('s'))
+	h.Script(bystander, "e")
+	h.Run(1)
+	subgrid := h.World.subgridAtGrid(testGrid)
+	if !subgrid.Quarantined() {
+		t.Fatalf("subgrid %v not quarantined", testGrid)
+	}
+	if len(subgrid.suspects) != 1 || subgrid.suspects[0] != bug.EntityID() {
+		t.Fatalf("suspects %v, expected the faulty entity", subgrid.suspects)
+	}
+	if len(player.inbox) == 0 || player.inbox[len(player.inbox)-1] != frozenMessage {
+		t.Fatal("player wasn't told the subgrid froze")
+	}
+	if err := h.ExpectAt(bystander, otherLoc.MovedBy('e')); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Server.change(adminChange{op: adminRebuild, gcoord: testGrid}); err != nil {
+		t.Fatal(err)
+	}
+	if h.World.EntityByID(bug.EntityID()) != nil {
+		t.Fatal("faulty entity survived the rebuild")
+	}
+	h.Script(player, "e")
+	h.Run(1)
+	if err := h.ExpectAt(player, loc.MovedBy('e')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// digests runs a world from seed with players walking about, and hashes
+// it after each tick. Run together, worlds from one seed share nothing.
+func digests(seeds []int64, ticks int) [][]uint64 {
+	harnesses := make([]*Harness, len(seeds))
+	for i, seed := range seeds {
+		h := NewHarness(seed)
+		for p := 0; p < 3; p++ {
+			c := newConnection(nil)
+			player := NewPlayer(c, h.World, h.World.offsets)
+			entity, _ := h.World.NewEntity(player)
+			c.setPlayer(entity.EntityID(), player)
+			h.Server.connections[c] = c.id
+			h.Script(player, strings.Repeat("nneessww", 4))
+		}
+		harnesses[i] = h
+	}
+	hashes := make([][]uint64, len(seeds))
+	for tick := 0; tick < ticks; tick++ {
+		for i, h := range harnesses {
+			h.Run(1)
+			hashes[i] = append(hashes[i], h.World.Digest())
+		}
+	}
+	return hashes
+}
+
+func TestSeedDeterminism(t *testing.T) {
+	hashes := digests([]int64{7, 7, 8}, 40)
+	for tick := range hashes[0] {
+		if hashes[0][tick] != hashes[1][tick] {
+			t.Fatalf("worlds from one seed differ at tick %d", tick)
+		}
+	}
+	if reflect.DeepEqual(hashes[0], hashes[2]) {
+		t.Fatal("worlds from different seeds are the same")
+	}
+}
+
+// TestSpectatorsShareGrid has two spectators watch the SubGrid a player
+// and a monster are in. Run it with -race.
+func TestSpectatorsShareGrid(t *testing.T) {
+	h := NewHarness(1)
+	loc, found := h.Find(testGrid, func(loc Coord) bool {
+		return h.Open(loc) && h.Open(loc.MovedBy('e'))
+	})
+	if !found {
+		t.Fatalf("no open floor in %v", testGrid)
+	}
+	player := h.PlacePlayer(loc)
+	h.Place(NewMonster(EntityID{}, h.World, h.World.offsets), loc.MovedBy('e'))
+	var spectators []*Spectator
+	for i := 0; i < 2; i++ {
+		c := newConnection(nil)
+		c.spectator = NewSpectator(c)
+		c.spectator.followName = player.DisplayString()
+		h.Server.registerConnection(c)
+		spectators = append(spectators, c.spectator)
+	}
+	h.Run(3)
+	if spectators[0].view != spectators[1].view || spectators[0].view.GridCoord != testGrid {
+		t.Fatalf("spectators not both watching %v", testGrid)
+	}
+	for _, spectator := range spectators {
+		if update, _ := spectator.Connection.takeUpdate(); update == nil {
+			t.Fatal("spectator sent no update")
+		}
+	}
+}
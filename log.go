@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+Logging goes through log/slog, one logger per subsystem, each with its
+own level. Records carry fields instead of formatted text: tick, subgrid,
+entity and conn where they apply, so a JSON log can be searched for
+everything that happened to one player or one subgrid.
+
+-log-level takes a default and per-subsystem overrides, such as
+"info,net=trace,world=debug". Levels take effect again on SIGHUP. The
+log file rotates once it passes its size limit.
+
+The loggers log text to stderr at info until main calls ConfigureLogging.
+*/
+
+// LevelTrace is below slog's debug, for what used to be -trace
+const LevelTrace = slog.LevelDebug - 4
+
+// The subsystems
+const (
+	// Startup, config, shutdown
+	logServer = iota
+	// Connections, admission, resumes, terminals
+	logNet
+	// The simulation
+	logWorld
+	// Recording and playback
+	logReplay
+	// The admin API and slash commands
+	logAdmin
+	// Slow ticks and captures
+	logProfile
+	logSubsystems
+)
+
+var logSubsystemNames = [logSubsystems]string{
+	logServer:  "server",
+	logNet:     "net",
+	logWorld:   "world",
+	logReplay:  "replay",
+	logAdmin:   "admin",
+	logProfile: "profile",
+}
+
+var logLevels [logSubsystems]slog.LevelVar
+
+var (
+	serverLog  *slog.Logger
+	netLog     *slog.Logger
+	worldLog   *slog.Logger
+	replayLog  *slog.Logger
+	adminLog   *slog.Logger
+	profileLog *slog.Logger
+)
+
+func init() {
+	setLogHandler(newLogHandler(os.Stderr, false))
+}
+
+// ConfigureLogging points every subsystem's logger at the config's
+// output and sets their levels. The file it returns is nil if the config
+// names none.
+func ConfigureLogging(config LogConfig) (*RotatingFile, error) {
+	levels, err := parseLogLevels(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	var out io.Writer = os.Stdout
+	var file *RotatingFile
+	if config.File != "" {
+		file, err = OpenRotatingFile(config.File, int64(config.MaxSize)<<20, config.Keep)
+		if err != nil {
+			return nil, err
+		}
+		out = io.MultiWriter(file, os.Stdout)
+	}
+	setLogHandler(newLogHandler(out, config.Format == "json"))
+	setLogLevels(levels)
+	return file, nil
+}
+
+// SetLogLevels changes the levels while the server runs
+func SetLogLevels(spec string) error {
+	levels, err := parseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+	setLogLevels(levels)
+	return nil
+}
+
+func setLogLevels(levels [logSubsystems]slog.Level) {
+	for i, level := range levels {
+		logLevels[i].Set(level)
+	}
+}
+
+func parseLogLevels(spec string) ([logSubsystems]slog.Level, error) {
+	var levels [logSubsystems]slog.Level
+	for i, _ := range levels {
+		levels[i] = slog.LevelInfo
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, levelName := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			name, levelName = part[:i], part[i+1:]
+		}
+		level, err := parseLogLevel(levelName)
+		if err != nil {
+			return levels, err
+		}
+		if name == "" {
+			for i, _ := range levels {
+				levels[i] = level
+			}
+			continue
+		}
+		found := false
+		for i, subsystem := range logSubsystemNames {
+			if subsystem == name {
+				levels[i] = level
+				found = true
+			}
+		}
+		if !found {
+			return levels, fmt.Errorf("log level: no subsystem %q", name)
+		}
+	}
+	return levels, nil
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("log level: no level %q", name)
+}
+
+func newLogHandler(out io.Writer, json bool) slog.Handler {
+	options := &slog.HandlerOptions{
+		Level: LevelTrace,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.LevelKey && len(groups) == 0 {
+				if level, ok := attr.Value.Any().(slog.Level); ok && level <= LevelTrace {
+					attr.Value = slog.StringValue("TRACE")
+				}
+			}
+			return attr
+		},
+	}
+	if json {
+		return slog.NewJSONHandler(out, options)
+	}
+	return slog.NewTextHandler(out, options)
+}
+
+func setLogHandler(handler slog.Handler) {
+	loggers := [logSubsystems]**slog.Logger{
+		logServer:  &serverLog,
+		logNet:     &netLog,
+		logWorld:   &worldLog,
+		logReplay:  &replayLog,
+		logAdmin:   &adminLog,
+		logProfile: &profileLog,
+	}
+	for i, logger := range loggers {
+		leveled := &levelHandler{level: &logLevels[i], Handler: handler}
+		*logger = slog.New(leveled).With("sys", logSubsystemNames[i])
+	}
+	// What still goes through the standard log, log.Fatal included
+	slog.SetDefault(serverLog)
+}
+
+// levelHandler holds a subsystem to its own level
+type levelHandler struct {
+	level *slog.LevelVar
+	slog.Handler
+}
+
+func (self *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= self.level.Level()
+}
+
+func (self *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: self.level, Handler: self.Handler.WithAttrs(attrs)}
+}
+
+func (self *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: self.level, Handler: self.Handler.WithGroup(name)}
+}
+
+// logTrace logs at LevelTrace, which slog has no method for
+func logTrace(logger *slog.Logger, msg string, args ...interface{}) {
+	logger.Log(context.Background(), LevelTrace, msg, args...)
+}
+
+// Fields that records share
+
+func tickAttr(tick uint64) slog.Attr {
+	return slog.Uint64("tick", tick)
+}
+
+func (self Coord) LogValue() slog.Value {
+	return slog.StringValue(fmt.Sprintf("%d,%d", self.x, self.y))
+}
+
+func (self GridCoord) LogValue() slog.Value {
+	return slog.StringValue(fmt.Sprintf("%d,%d", self.x, self.y))
+}
+
+func (id EntityID) LogValue() slog.Value {
+	return slog.StringValue(id.String())
+}
+
+func (c *connection) LogValue() slog.Value {
+	attrs := make([]slog.Attr, 0, 2)
+	if c.remote != "" {
+		attrs = append(attrs, slog.String("remote", c.remote))
+	}
+	if id := c.loggedID(); id != (EntityID{}) {
+		attrs = append(attrs, slog.Any("entity", id))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// RotatingFile is an append-only log file that moves itself aside to
+// path.1, path.2 and so on once it passes maxSize, keeping keep of them
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	self := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := self.open(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *RotatingFile) open() error {
+	file, err := os.OpenFile(self.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	self.file = file
+	self.size = info.Size()
+	return nil
+}
+
+func (self *RotatingFile) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.size > 0 && self.size+int64(len(p)) > self.maxSize {
+		if err := self.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := self.file.Write(p)
+	self.size += int64(n)
+	return n, err
+}
+
+func (self *RotatingFile) rotate() error {
+	if err := self.file.Close(); err != nil {
+		return err
+	}
+	if self.keep == 0 {
+		os.Remove(self.path)
+	} else {
+		for i := self.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", self.path, i), fmt.Sprintf("%s.%d", self.path, i+1))
+		}
+		if err := os.Rename(self.path, self.path+".1"); err != nil {
+			return err
+		}
+	}
+	return self.open()
+}
+
+func (self *RotatingFile) Close() error {
+	if self == nil {
+		return nil
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.file.Close()
+}
@@ -3,14 +3,15 @@ package main
 import (
 	"flag"
 	//"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"text/template"
+	"time"
 )
 
 /*
@@ -28,65 +29,10 @@ var DungeonProto = DunGen{
 	chanceRoom: 50,
 }
 
-var (
-	TRACE   *log.Logger
-	PROF    *log.Logger
-	INFO    *log.Logger
-	WARNING *log.Logger
-	ERROR   *log.Logger
-
-	traceFlag *bool
-	profFlag  *bool
-	infoFlag  *bool
-	warnFlag  *bool
-	errFlag   *bool
-)
-
-func LogTrace(args ...interface{}) {
-	if *traceFlag {
-		TRACE.Println(args...)
-	}
-}
-func LogProfile(args ...interface{}) {
-	if *profFlag {
-		PROF.Println(args...)
-	}
-}
-func LogInfo(args ...interface{}) {
-	if *infoFlag {
-		INFO.Println(args...)
-	}
-}
-func LogWarn(args ...interface{}) {
-	if *warnFlag {
-		WARNING.Println(args...)
-	}
-}
-func LogError(args ...interface{}) {
-	if *errFlag {
-		ERROR.Println(args...)
-	}
-}
-
-func initLogging(traceHandle, profHandle, infoHandle, warningHandle, errorHandle io.Writer) {
-	TRACE = log.New(traceHandle, "TRACE: ", log.Ldate|log.Ltime|log.Lshortfile)
-	PROF = log.New(profHandle, "PROFILE: ", log.Ldate|log.Ltime|log.Lshortfile)
-	INFO = log.New(infoHandle, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	WARNING = log.New(warningHandle, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-	ERROR = log.New(errorHandle, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-}
-
 func homeHandler(c http.ResponseWriter, req *http.Request, homeTempl *template.Template) {
 	homeTempl.Execute(c, req.Host)
 }
 
-func logWriter(shouldWrite bool, file io.Writer) io.Writer {
-	if shouldWrite {
-		return file
-	}
-	return ioutil.Discard
-}
-
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -125,65 +71,196 @@ func main() {
 	assets := flag.String("assets", ".", "path to assets")
 	htmlPath := filepath.Join(*assets, "static")
 
-	traceFlag = flag.Bool("trace", false, "log trace messages")
-	profFlag = flag.Bool("prof", true, "log profile messages")
-	infoFlag = flag.Bool("info", true, "log info messages")
-	warnFlag = flag.Bool("warn", true, "log warnings")
-	errFlag = flag.Bool("error", true, "log errors")
-
 	dev := flag.Bool("dev", false, "develop - run without TLS")
 
-	flag.Parse()
+	telnetAddr := flag.String("telnet", "", "also serve terminal sessions over telnet on this address, e.g. :2323")
+	sshAddr := flag.String("ssh", "", "also serve terminal sessions over SSH on this address, e.g. :2222")
+	sshKey := flag.String("ssh-key", "etc/ssh_host_key", "SSH host key file, made on first use")
+
+	configPath := flag.String("config", "", "TOML config file; SIGHUP reloads its [gameplay] settings")
+	config := DefaultServerConfig()
+	config.Flags(flag.CommandLine)
+	adminAddr := flag.String("admin", "localhost:8081", "serve the admin API on this address; empty for none")
+	adminTokenPath := flag.String("admin-token", "etc/admin_token", "file holding the admin API's bearer token, made on first use")
+	rolesPath := flag.String("roles", "etc/roles", "file of the keys that log players in as moderators and admins")
+	auditPath := flag.String("audit-log", "etc/audit.log", "append privileged slash commands to this file")
 
-	logPath := filepath.Join(*assets, "log")
-	profPath := filepath.Join(*assets, "prof")
+	recordPath := flag.String("record", "", "record a replay log to this file")
+	replayPath := flag.String("replay", "", "play this replay log to spectators instead of running live")
+	replaySpeed := flag.Float64("replay-speed", 1, "replay ticks per real tick; spectators can change it")
 
-	logfile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	flag.Parse()
+
+	// Flags given on the command line win over the file, on reloads too
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		overrides[f.Name] = f.Value.String()
+	})
+	config, err := LoadConfig(*configPath, overrides)
 	if err != nil {
-		log.Fatalln("Failed to open log file:", err)
+		log.Fatalln("Failed to load config:", err)
 	}
-	var writer, profWriter io.Writer
-	writer = io.MultiWriter(logfile, os.Stdout)
+	config.InstallWorld()
 
-	profile, err := os.OpenFile(profPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if config.Log.File != "" && !filepath.IsAbs(config.Log.File) {
+		config.Log.File = filepath.Join(*assets, config.Log.File)
+	}
+	logFile, err := ConfigureLogging(config.Log)
 	if err != nil {
-		log.Fatalln("Failed to open profile log:", err)
+		log.Fatalln("Failed to open log:", err)
+	}
+	defer logFile.Close()
+
+	prefabs, errs := LoadPrefabs(filepath.Join(*assets, "resources"))
+	for _, err := range errs {
+		serverLog.Error("prefab not loaded", "err", err)
 	}
-	if *profFlag {
-		profWriter = profile
+	Prefabs = prefabs
+	serverLog.Info("prefabs loaded", "count", len(Prefabs))
+
+	// Instantiate Server and start runLoop, or play back a recording
+	var srv *CstServer
+	var loop func()
+	if *replayPath != "" {
+		replayFile, err := os.Open(*replayPath)
+		if err != nil {
+			log.Fatalln("Failed to open replay:", err)
+		}
+		playback, err := OpenReplay(replayFile)
+		if err != nil {
+			log.Fatalln("Failed to read replay:", err)
+		}
+		playback.SetSpeed(*replaySpeed)
+		srv = NewCstServer(config, playback.Seeds())
+		srv.playback = playback
+		loop = srv.playbackLoop
+		replayLog.Info("replaying", "path", *replayPath)
+	} else if *recordPath != "" {
+		recordFile, err := os.OpenFile(*recordPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Fatalln("Failed to open replay log:", err)
+		}
+		recorder := NewReplayRecorder(recordFile)
+		srv = NewCstServer(config, NewRecordingSeeds(config.Seeds(), recorder))
+		srv.recorder = recorder
+		loop = srv.runLoop
+		replayLog.Info("recording", "path", *recordPath)
 	} else {
-		profWriter = ioutil.Discard
+		srv = NewCstServer(config, config.Seeds())
+		loop = srv.runLoop
 	}
 
-	initLogging(
-		logWriter(*traceFlag, writer),
-		profWriter,
-		logWriter(*infoFlag, writer),
-		logWriter(*warnFlag, writer),
-		logWriter(*errFlag, writer))
+	roles, err := LoadRoles(*rolesPath)
+	if err != nil {
+		log.Fatalln("Failed to load roles:", err)
+	}
+	srv.roles = roles
+	srv.audit, err = OpenAuditLog(*auditPath)
+	if err != nil {
+		log.Fatalln("Failed to open audit log:", err)
+	}
+	serverLog.Info("roles loaded", "count", len(roles.grants))
+	go loop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for _ = range hup {
+			next, err := LoadConfig(*configPath, overrides)
+			if err != nil {
+				serverLog.Error("config not reloaded", "err", err)
+				continue
+			}
+			srv.Reload(next)
+		}
+	}()
 
-	log.SetOutput(writer)
+	serverLog.Info("serving", "port", *port, "assets", *assets)
 
-	// Instantiate Server and start runLoop
-	var srv = NewCstServer()
-	go srv.runLoop()
+	if *telnetAddr != "" {
+		if err := srv.listenTelnet(*telnetAddr); err != nil {
+			log.Fatalln("Failed to serve telnet:", err)
+		}
+		serverLog.Info("serving telnet", "addr", *telnetAddr)
+	}
+	if *sshAddr != "" {
+		if err := srv.listenSSH(*sshAddr, *sshKey); err != nil {
+			log.Fatalln("Failed to serve SSH:", err)
+		}
+		serverLog.Info("serving SSH", "addr", *sshAddr)
+	}
 
-	LogInfo("Port:", *port)
-	LogInfo("Asset Path:", *assets)
+	if *adminAddr != "" {
+		token, err := loadAdminToken(*adminTokenPath)
+		if err != nil {
+			log.Fatalln("Failed to load admin token:", err)
+		}
+		admin := NewAdminAPI(srv, token)
+		go func() {
+			if err := http.ListenAndServe(*adminAddr, admin); err != nil {
+				adminLog.Error("admin API stopped", "err", err)
+			}
+		}()
+		serverLog.Info("serving the admin API", "addr", *adminAddr)
+	}
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		srv.wsHandler(w, r)
 	})
 
+	http.Handle("/metrics", srv.metrics)
+
+	http.HandleFunc("/healthz", srv.ServeHealth)
+
 	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(htmlPath))))
 
-	if *dev {
-		if err := http.ListenAndServe(*port, nil); err != nil {
-			log.Fatal("ListenAndServe:", err)
+	listener, err := srv.Listen(*port)
+	if err != nil {
+		log.Fatalln("Failed to listen:", err)
+	}
+	web := &http.Server{}
+	go func() {
+		var err error
+		if *dev {
+			err = web.Serve(listener)
+		} else {
+			err = web.ServeTLS(listener, config.TLSCert, config.TLSKey)
 		}
-	} else {
-		if err := http.ListenAndServeTLS(*port, "etc/cert/certificate", "etc/cert/server.key", nil); err != nil {
-			log.Fatal("ListenAndServeTLS:", err)
+		if srv.Accepting() {
+			log.Fatal("Serve:", err)
 		}
-	}
+	}()
+
+	// SIGTERM and SIGINT shut down, and a second one exits at once. SIGUSR2
+	// drains for a rolling restart.
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	go func() {
+		exitBy := func(wait time.Duration) {
+			time.AfterFunc(wait+shutdownSlack, func() {
+				serverLog.Error("shutdown overran its deadline")
+				os.Exit(1)
+			})
+		}
+		stopping := false
+		for sig := range stop {
+			if sig == syscall.SIGUSR2 {
+				serverLog.Info("signaled", "signal", sig.String())
+				srv.Drain(config.DrainTimeout, config.ShutdownGrace)
+				exitBy(config.DrainTimeout + config.ShutdownGrace)
+				continue
+			}
+			if stopping {
+				serverLog.Warn("exiting without waiting for the shutdown")
+				os.Exit(1)
+			}
+			stopping = true
+			serverLog.Info("signaled", "signal", sig.String())
+			srv.Shutdown(config.ShutdownGrace)
+			exitBy(config.ShutdownGrace)
+		}
+	}()
+
+	<-srv.Done()
+	serverLog.Info("exiting")
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of a tick, timed separately. Step marks the end of each with
+// EndPhase; runLoop times the collection after it.
+const (
+	phaseDrain = iota
+	phasePrepopCull
+	phaseUpdateMovers
+	phaseSendDisplays
+	phaseDiscardEmpty
+	phaseSpectators
+	phaseGC
+	phaseCount
+)
+
+var phaseNames = [phaseCount]string{
+	phaseDrain:        "drain_queues",
+	phasePrepopCull:   "prepop_cull",
+	phaseUpdateMovers: "update_movers",
+	phaseSendDisplays: "send_displays",
+	phaseDiscardEmpty: "discard_empty",
+	phaseSpectators:   "spectators",
+	phaseGC:           "gc",
+}
+
+// Upper bounds of the tick duration histograms, in seconds. At the default
+// tick rate a tick has 0.125 to run in.
+var tickBuckets = [...]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.125, 0.25, 0.5}
+
+// Why a connection was turned away
+const (
+	rejectQueueFull = iota
+	rejectSpectatorsFull
+	rejectStopping
+	rejectOrigin
+	rejectCount
+)
+
+var rejectReasons = [rejectCount]string{
+	rejectQueueFull:      "queue_full",
+	rejectSpectatorsFull: "spectators_full",
+	rejectStopping:       "stopping",
+	rejectOrigin:         "origin",
+}
+
+// DunGenCache lookups, across every cache. Subgrids come and go with
+// their caches, so these are kept apart from them.
+var dunGenHits, dunGenMisses uint64
+
+// What the writers sent, updates replaced before a slow client took them,
+// and frames dropped for clients too far behind, across every connection
+var sentBytes, coalescedUpdates, droppedFrames uint64
+
+type histogram struct {
+	// Counts per bucket, not cumulative; the last is past every bound
+	counts [len(tickBuckets) + 1]uint64
+	count  uint64
+	sum    float64
+}
+
+func (self *histogram) observe(seconds float64) {
+	i := sort.SearchFloat64s(tickBuckets[:], seconds)
+	self.counts[i]++
+	self.count++
+	self.sum += seconds
+}
+
+func (self *histogram) write(out *bytes.Buffer, name, labels string) {
+	if labels != "" {
+		labels += ","
+	}
+	var cumulative uint64
+	for i, bound := range tickBuckets {
+		cumulative += self.counts[i]
+		fmt.Fprintf(out, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, self.count)
+	labels = trimLabels(labels)
+	fmt.Fprintf(out, "%s_sum%s %g\n", name, labels, self.sum)
+	fmt.Fprintf(out, "%s_count%s %d\n", name, labels, self.count)
+}
+
+func trimLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels[:len(labels)-1] + "}"
+}
+
+// worldSample is the state of the world, taken once a second by runLoop
+type worldSample struct {
+	subgrids     int
+	players      int
+	entities     map[string]int
+	lifeGrids    int
+	dunGenSize   int
+	sendQueue    int
+	sendQueueMax int
+	bandwidth    uint64
+	lagMax       time.Duration
+	waiting      int
+	spectators   int
+	load         float64
+}
+
+/*
+Metrics holds what /metrics reports, in the Prometheus text format. The
+tick goroutine writes it and the HTTP handler reads it, so everything in
+it is behind mutex. The world itself is never read from the handler.
+*/
+type Metrics struct {
+	mutex    sync.Mutex
+	tick     histogram
+	phases   [phaseCount]histogram
+	world    worldSample
+	dropped  uint64
+	rejected [rejectCount]uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{world: worldSample{entities: make(map[string]int)}}
+}
+
+func (self *Metrics) ObserveTick(phases *[phaseCount]time.Duration, total time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.tick.observe(total.Seconds())
+	for i, d := range phases {
+		self.phases[i].observe(d.Seconds())
+	}
+}
+
+func (self *Metrics) CountDropped() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.dropped++
+}
+
+func (self *Metrics) CountRejected(reason int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.rejected[reason]++
+}
+
+func (self *Metrics) setWorld(sample worldSample) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.world = sample
+}
+
+func entityKind(ntt Entity) string {
+	switch ntt.(type) {
+	case *Player:
+		return "player"
+	case *Monster:
+		return "monster"
+	case *Loot:
+		return "loot"
+	case *ShipGuard:
+		return "guard"
+	}
+	return "other"
+}
+
+// sampleWorld counts what is in the world. Only the tick goroutine may
+// call it, between ticks.
+func (srv *CstServer) sampleWorld() {
+	sample := worldSample{
+		subgrids:   len(srv.world.grid),
+		players:    srv.world.playerCount(),
+		entities:   make(map[string]int),
+		dunGenSize: len(srv.world.dunGenCache.cache),
+		waiting:    srv.admission.Len(),
+		spectators: len(srv.spectators),
+		load:       srv.load,
+	}
+	for _, subgrid := range srv.world.grid {
+		for _, ntt := range subgrid.Entities {
+			sample.entities[entityKind(ntt)]++
+		}
+		if subgrid.lifeActive {
+			sample.lifeGrids++
+		}
+		sample.dunGenSize += len(subgrid.dunGenCache.cache)
+	}
+	queued := func(c *connection) {
+		depth := len(c.send)
+		sample.sendQueue += depth
+		if depth > sample.sendQueueMax {
+			sample.sendQueueMax = depth
+		}
+		// Sampled once a second, so this is bytes per second
+		sent := atomic.LoadUint64(&c.sent)
+		c.bandwidth, c.lastSent = sent-c.lastSent, sent
+		sample.bandwidth += c.bandwidth
+		if lag := c.Lag(); lag > sample.lagMax {
+			sample.lagMax = lag
+		}
+	}
+	for c := range srv.connections {
+		queued(c)
+	}
+	for c := range srv.spectators {
+		queued(c)
+	}
+	srv.metrics.setWorld(sample)
+}
+
+func (self *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var out bytes.Buffer
+	self.write(&out)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
+
+func (self *Metrics) write(out *bytes.Buffer) {
+	hits, misses := atomic.LoadUint64(&dunGenHits), atomic.LoadUint64(&dunGenMisses)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	header := func(name, kind, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("rotcs_tick_seconds", "histogram", "Time to run one tick, garbage collection included.")
+	self.tick.write(out, "rotcs_tick_seconds", "")
+	header("rotcs_tick_phase_seconds", "histogram", "Time spent in each phase of a tick.")
+	for i := range self.phases {
+		self.phases[i].write(out, "rotcs_tick_phase_seconds", fmt.Sprintf("phase=%q", phaseNames[i]))
+	}
+
+	world := &self.world
+	header("rotcs_load", "gauge", "Tick time over the time a tick has, averaged over a second.")
+	fmt.Fprintf(out, "rotcs_load %g\n", world.load)
+	header("rotcs_subgrids", "gauge", "Subgrids in the world.")
+	fmt.Fprintf(out, "rotcs_subgrids %d\n", world.subgrids)
+	header("rotcs_players", "gauge", "Players in the world, dropped players waiting to resume included.")
+	fmt.Fprintf(out, "rotcs_players %d\n", world.players)
+	header("rotcs_entities", "gauge", "Entities in the world by type.")
+	kinds := make([]string, 0, len(world.entities))
+	for kind := range world.entities {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(out, "rotcs_entities{type=%q} %d\n", kind, world.entities[kind])
+	}
+	header("rotcs_life_grids_active", "gauge", "Subgrids with the life system running.")
+	fmt.Fprintf(out, "rotcs_life_grids_active %d\n", world.lifeGrids)
+	header("rotcs_spectators", "gauge", "Connections watching.")
+	fmt.Fprintf(out, "rotcs_spectators %d\n", world.spectators)
+	header("rotcs_admission_queue_length", "gauge", "Connections waiting for admission.")
+	fmt.Fprintf(out, "rotcs_admission_queue_length %d\n", world.waiting)
+
+	header("rotcs_dungen_cache_entries", "gauge", "Generated dungeon grids held in every DunGenCache.")
+	fmt.Fprintf(out, "rotcs_dungen_cache_entries %d\n", world.dunGenSize)
+	header("rotcs_dungen_cache_lookups_total", "counter", "DunGenCache lookups by result.")
+	fmt.Fprintf(out, "rotcs_dungen_cache_lookups_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(out, "rotcs_dungen_cache_lookups_total{result=\"miss\"} %d\n", misses)
+	header("rotcs_dungen_cache_hit_ratio", "gauge", "DunGenCache hits over lookups since the server started.")
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	fmt.Fprintf(out, "rotcs_dungen_cache_hit_ratio %g\n", ratio)
+
+	header("rotcs_send_queue_depth", "gauge", "Frames waiting in the send queues of every connection.")
+	fmt.Fprintf(out, "rotcs_send_queue_depth %d\n", world.sendQueue)
+	header("rotcs_send_queue_depth_max", "gauge", "Frames waiting in the fullest send queue.")
+	fmt.Fprintf(out, "rotcs_send_queue_depth_max %d\n", world.sendQueueMax)
+	header("rotcs_sent_bytes_total", "counter", "Bytes sent to clients.")
+	fmt.Fprintf(out, "rotcs_sent_bytes_total %d\n", atomic.LoadUint64(&sentBytes))
+	header("rotcs_sent_bytes_per_second", "gauge", "Bytes sent to clients in the last second.")
+	fmt.Fprintf(out, "rotcs_sent_bytes_per_second %d\n", world.bandwidth)
+	header("rotcs_client_lag_seconds_max", "gauge", "How long the update the slowest client is behind on has waited.")
+	fmt.Fprintf(out, "rotcs_client_lag_seconds_max %g\n", world.lagMax.Seconds())
+	header("rotcs_updates_coalesced_total", "counter", "Updates replaced by a newer one before a slow client took them.")
+	fmt.Fprintf(out, "rotcs_updates_coalesced_total %d\n", atomic.LoadUint64(&coalescedUpdates))
+	header("rotcs_frames_dropped_total", "counter", "Frames dropped because a client's send queue was full.")
+	fmt.Fprintf(out, "rotcs_frames_dropped_total %d\n", atomic.LoadUint64(&droppedFrames))
+	header("rotcs_commands_limited_total", "counter", "Commands and moves from clients dropped over the rate limit.")
+	fmt.Fprintf(out, "rotcs_commands_limited_total %d\n", atomic.LoadUint64(&limitedCommands))
+
+	header("rotcs_connections_dropped_total", "counter", "Players whose connection was lost.")
+	fmt.Fprintf(out, "rotcs_connections_dropped_total %d\n", self.dropped)
+	header("rotcs_connections_rejected_total", "counter", "Connections turned away, by reason.")
+	for i, count := range self.rejected {
+		fmt.Fprintf(out, "rotcs_connections_rejected_total{reason=%q} %d\n", rejectReasons[i], count)
+	}
+}
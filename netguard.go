@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+What a websocket client can do to the server is bounded by the [net]
+config.
+
+Browsers may only open /ws from the server's own origin and the allowed
+ones, so another site can't play, or chat, as its visitors. Clients that
+aren't browsers send no Origin and aren't checked.
+
+A message longer than max_message_size closes the connection. Every
+client is pinged each ping_interval, and one that has sent nothing, pongs
+included, for two of them is dropped, so a dead peer is noticed even when
+nothing is written to it.
+
+Each connection has a token bucket of commands, refilled at command_rate
+up to command_burst. A command takes a token, and a move command one per
+move. Commands that find it empty are dropped before they reach the
+player, as are the moves past what is left of it. Terminal sessions share
+the limit. A message that isn't a command closes the connection.
+
+When the server ends a connection, the close frame says why, with one of
+the close codes below.
+*/
+
+// Why the server hung up, for close frames
+const (
+	closeServerFull = websocket.CloseTryAgainLater
+	// Also for clients that send what no client would
+	closeKicked   = websocket.ClosePolicyViolation
+	closeShutdown = websocket.CloseGoingAway
+	closeRestart  = websocket.CloseServiceRestart
+)
+
+// Commands and moves dropped over the rate limit, across every connection
+var limitedCommands uint64
+
+// validOrigin reports whether origin can go in allowed_origins
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme != "" && u.Host != "" && (u.Path == "" || u.Path == "/")
+}
+
+func newUpgrader(srv *CstServer) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     srv.checkOrigin,
+	}
+}
+
+// checkOrigin lets a handshake through if it came from no browser, the
+// server's own origin or an allowed one
+func (srv *CstServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range srv.config.Net.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	srv.metrics.CountRejected(rejectOrigin)
+	netLog.Debug("origin not allowed", "remote", r.RemoteAddr, "origin", origin)
+	return false
+}
+
+/*
+keepAlive gives the client two ping intervals to send something, and
+starts pinging it. Only the reader calls it, before it reads; pongs reach
+the handler while the reader waits for a message.
+*/
+func (c *connection) keepAlive(interval time.Duration) {
+	c.ws.SetReadDeadline(time.Now().Add(2 * interval))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(2 * interval))
+	})
+	go c.ping(interval)
+}
+
+// ping pings the client every interval until the connection ends. Control
+// frames can be written alongside the writer's messages.
+func (c *connection) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// closeFor sends the client a close frame from the reader, which then
+// stops. The tick hangs up with hangUpFor instead.
+func (c *connection) closeFor(code int, reason string) {
+	closing := websocket.FormatCloseMessage(code, reason)
+	c.ws.WriteControl(websocket.CloseMessage, closing, time.Now().Add(time.Second))
+}
+
+// commandLimiter is a token bucket of commands. Only the reader uses it.
+type commandLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newCommandLimiter(config NetConfig) *commandLimiter {
+	return &commandLimiter{
+		rate:   config.CommandRate,
+		burst:  float64(config.CommandBurst),
+		tokens: float64(config.CommandBurst),
+	}
+}
+
+// take takes up to n tokens, as many as there are, and says how many
+func (self *commandLimiter) take(now time.Time, n int) int {
+	if !self.last.IsZero() {
+		self.tokens += now.Sub(self.last).Seconds() * self.rate
+		if self.tokens > self.burst {
+			self.tokens = self.burst
+		}
+	}
+	self.last = now
+	if float64(n) > self.tokens {
+		n = int(self.tokens)
+	}
+	self.tokens -= float64(n)
+	return n
+}
+
+// allowed is how many of n commands or moves from the client are within
+// its rate. It counts the rest.
+func (c *connection) allowed(n int) int {
+	if c.limiter == nil {
+		return n
+	}
+	granted := c.limiter.take(time.Now(), n)
+	if granted < n {
+		atomic.AddUint64(&c.limitedCount, uint64(n-granted))
+		atomic.AddUint64(&limitedCommands, uint64(n-granted))
+	}
+	return granted
+}
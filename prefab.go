@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+A prefab is a hand-authored map stamped over the generated dungeon of one
+subgrid. The file starts with a header of directives, one per line, and
+ends with the map rows after a line containing only "map":
+
+	# comment
+	name shipmap0
+	grid 0 0
+	legend 0 wall
+	legend ~ unpass
+	legend L lockeddoor
+	spawn G guard
+	map
+	0000000000
+	0   G    0
+
+The character right after "legend " or "spawn " is the map character, so a
+space can be given a meaning too. A spawn marker puts the archetype on a
+floor tile at that cell. Door tiles can start "opendoor" or "lockeddoor";
+a plain "door" starts closed. Characters not in the legend leave the generated
+tile alone, and so do rows and columns beyond the end of the map.
+*/
+
+var TileNames = map[string]int8{
+	"unused":   TileUnused,
+	"wall":     TileWall,
+	"floor":    TileFloor,
+	"unpass":   TileUnpass,
+	"corridor": TileCorridor,
+	"door":     TileDoor,
+}
+
+// DoorTileNames are legend entries for door tiles with a starting state
+var DoorTileNames = map[string]int8{
+	"opendoor":   DoorOpen,
+	"lockeddoor": DoorLocked,
+}
+
+func defaultLegend() map[rune]int8 {
+	return map[rune]int8{
+		'0': TileWall,
+		' ': TileFloor,
+		'.': TileFloor,
+		'#': TileCorridor,
+		'+': TileDoor,
+		'X': TileUnpass,
+		'~': TileUnused,
+	}
+}
+
+// Archetypes are created for a world, which gives them their ID after
+var SpawnArchetypes = map[string]func(world *WorldGrid) Entity{
+	"guard": func(world *WorldGrid) Entity {
+		return NewShipGuard()
+	},
+	"loot": func(world *WorldGrid) Entity {
+		return NewLoot()
+	},
+	"monster": func(world *WorldGrid) Entity {
+		return NewMonster(NewEntityID(), world, world.offsets)
+	},
+}
+
+type PrefabSpawn struct {
+	archetype string
+	loc       LCoord
+}
+
+type Prefab struct {
+	doorLegend map[rune]int8
+	doors      map[LCoord]int8
+	GridCoord  GridCoord
+	legend     map[rune]int8
+	Name       string
+	rows       []string
+	spawns     map[rune]string
+	Spawns     []PrefabSpawn
+}
+
+func NewPrefab() *Prefab {
+	return &Prefab{
+		doorLegend: make(map[rune]int8),
+		doors:      make(map[LCoord]int8),
+		legend:     defaultLegend(),
+		rows:       make([]string, 0, subgrid_height),
+		spawns:     make(map[rune]string),
+		Spawns:     make([]PrefabSpawn, 0, 4),
+	}
+}
+
+// markerArg splits a "legend" or "spawn" argument into the marker character
+// and the rest of the line
+func markerArg(arg string) (rune, string, error) {
+	c, n := utf8.DecodeRuneInString(arg)
+	if c == utf8.RuneError || n >= len(arg) || arg[n] != ' ' {
+		return c, "", fmt.Errorf("expected <char> <name>, got %q", arg)
+	}
+	return c, strings.TrimSpace(arg[n:]), nil
+}
+
+func (self *Prefab) parseDirective(line string) error {
+	directive, arg := line, ""
+	if i := strings.IndexRune(line, ' '); i >= 0 {
+		directive, arg = line[:i], line[i+1:]
+	}
+	switch directive {
+	case "name":
+		self.Name = strings.TrimSpace(arg)
+	case "grid":
+		fields := strings.Fields(arg)
+		if len(fields) != 2 {
+			return fmt.Errorf("grid needs 2 coordinates, got %q", arg)
+		}
+		x, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		y, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		self.GridCoord = GridCoord{x, y}
+	case "legend":
+		c, name, err := markerArg(arg)
+		if err != nil {
+			return err
+		}
+		if state, present := DoorTileNames[name]; present {
+			self.legend[c] = TileDoor
+			self.doorLegend[c] = state
+			break
+		}
+		tile, present := TileNames[name]
+		if !present {
+			return fmt.Errorf("unknown tile type %q", name)
+		}
+		self.legend[c] = tile
+		delete(self.doorLegend, c)
+	case "spawn":
+		c, name, err := markerArg(arg)
+		if err != nil {
+			return err
+		}
+		if _, present := SpawnArchetypes[name]; !present {
+			return fmt.Errorf("unknown spawn archetype %q", name)
+		}
+		self.spawns[c] = name
+	default:
+		return fmt.Errorf("unknown directive %q", directive)
+	}
+	return nil
+}
+
+func (self *Prefab) addRow(row string) {
+	y := len(self.rows)
+	x := 0
+	for _, c := range row {
+		if archetype, present := self.spawns[c]; present {
+			self.Spawns = append(self.Spawns, PrefabSpawn{archetype, LCoord{x, y}})
+		} else if state, present := self.doorLegend[c]; present {
+			self.doors[LCoord{x, y}] = state
+		}
+		x++
+	}
+	self.rows = append(self.rows, row)
+}
+
+func ReadPrefab(path string) (*Prefab, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefab := NewPrefab()
+	prefab.Name = filepath.Base(path)
+	hasGrid, inMap := false, false
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineNo++
+		if inMap {
+			prefab.addRow(line)
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == "map" {
+			inMap = true
+			continue
+		}
+		if strings.HasPrefix(trimmed, "grid") {
+			hasGrid = true
+		}
+		if err := prefab.parseDirective(trimmed); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !hasGrid {
+		return nil, fmt.Errorf("%s: missing grid directive", path)
+	}
+	if !inMap {
+		return nil, fmt.Errorf("%s: missing map section", path)
+	}
+	return prefab, nil
+}
+
+// Apply stamps the prefab over a freshly generated DunGen
+func (self *Prefab) Apply(dg *DunGen) {
+	for y, row := range self.rows {
+		if y >= dg.size.y {
+			break
+		}
+		x := 0
+		for _, c := range row {
+			if x >= dg.size.x {
+				break
+			}
+			if _, spawn := self.spawns[c]; spawn {
+				dg.setCell(x, y, TileFloor)
+			} else if tile, present := self.legend[c]; present {
+				dg.setCell(x, y, tile)
+			}
+			x++
+		}
+	}
+}
+
+// ApplyDoors sets the starting state of the prefab's doors on a new SubGrid
+func (self *Prefab) ApplyDoors(subgrid *SubGrid) {
+	for lcoord, state := range self.doors {
+		subgrid.SetDoorState(self.LocalCoord(lcoord, subgrid), state)
+	}
+}
+
+// LocalCoord converts a coordinate within the prefab to a world Coord
+func (self *Prefab) LocalCoord(lcoord LCoord, sizer Sizer) Coord {
+	size := sizer.GridSize()
+	return Coord{
+		x: self.GridCoord.x*int64(size.x) + int64(lcoord.x),
+		y: self.GridCoord.y*int64(size.y) + int64(lcoord.y),
+	}
+}
+
+// SpawnCoord converts a spawn's local coordinate to a world Coord
+func (self *Prefab) SpawnCoord(spawn PrefabSpawn, sizer Sizer) Coord {
+	return self.LocalCoord(spawn.loc, sizer)
+}
+
+type PrefabSet map[GridCoord]*Prefab
+
+var Prefabs = make(PrefabSet)
+
+// LoadPrefabs reads every prefab file in dir. A bad file is reported and
+// skipped so the rest of the world still loads.
+func LoadPrefabs(dir string) (PrefabSet, []error) {
+	set := make(PrefabSet)
+	errs := make([]error, 0)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return set, append(errs, err)
+	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		prefab, err := ReadPrefab(filepath.Join(dir, info.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if other, present := set[prefab.GridCoord]; present {
+			errs = append(errs, fmt.Errorf("%s: grid %v already taken by %s",
+				info.Name(), prefab.GridCoord, other.Name))
+			continue
+		}
+		set[prefab.GridCoord] = prefab
+	}
+	return set, errs
+}
+
+func (self PrefabSet) At(gcoord GridCoord) (*Prefab, bool) {
+	prefab, present := self[gcoord]
+	return prefab, present
+}
+
+// SpawnAll places every prefab's spawn markers into the world, in grid
+// order so a seeded world spawns the same way every run
+func (self PrefabSet) SpawnAll(world *WorldGrid) {
+	gcoords := make(SortableGCoords, 0, len(self))
+	for gcoord, _ := range self {
+		gcoords = append(gcoords, gcoord)
+	}
+	sort.Sort(gcoords)
+	for _, gcoord := range gcoords {
+		prefab := self[gcoord]
+		for _, spawn := range prefab.Spawns {
+			ntt := SpawnArchetypes[spawn.archetype](world)
+			ntt.SetEntityID(world.NewEntityID())
+			world.PutEntityAt(ntt, prefab.SpawnCoord(spawn, world))
+		}
+	}
+}
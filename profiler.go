@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A slow-tick report names this many of the busiest subgrids
+const slowTickSubgrids = 5
+
+// How many slow-tick reports the admin endpoint keeps
+const slowTickReports = 32
+
+// Captures start at most this often, so a server that stays slow isn't
+// profiled without end
+const captureInterval = time.Minute
+
+// What a slow tick can capture of the ticks after it
+const (
+	CaptureNone  = ""
+	CaptureCPU   = "cpu"
+	CaptureTrace = "trace"
+)
+
+// SubgridTime is how long one subgrid took in a tick
+type SubgridTime struct {
+	X        int64 `json:"x"`
+	Y        int64 `json:"y"`
+	Entities int   `json:"entities"`
+	Players  int   `json:"players"`
+	// In ParallelExec, where its movers are updated
+	ParallelSeconds float64 `json:"parallel_seconds"`
+	// In PlayerExec, summed over its players' displays
+	PlayerSeconds float64 `json:"player_seconds"`
+}
+
+func (self SubgridTime) seconds() float64 {
+	return self.ParallelSeconds + self.PlayerSeconds
+}
+
+// SlowTick is the report on a tick that ran over its budget
+type SlowTick struct {
+	Tick     uint64             `json:"tick"`
+	Time     time.Time          `json:"time"`
+	Seconds  float64            `json:"seconds"`
+	Budget   float64            `json:"budget"`
+	Phases   map[string]float64 `json:"phases"`
+	Subgrids int                `json:"subgrids"`
+	Players  int                `json:"players"`
+	Worst    []SubgridTime      `json:"worst_subgrids"`
+	// The profile or trace of the ticks after this one, if one was taken
+	Capture string `json:"capture,omitempty"`
+}
+
+/*
+TickProfiler watches for ticks that run longer than a tick has. It logs a
+report on each one and keeps the last few for the admin endpoint. If a
+capture kind is set, a slow tick also starts a CPU profile or execution
+trace of the next CaptureTicks ticks, written to CaptureDir.
+
+runLoop calls EndTick; the admin handler reads the reports, so they are
+behind mutex.
+*/
+type TickProfiler struct {
+	CaptureKind  string
+	CaptureTicks int
+	CaptureDir   string
+
+	// Ticks left in the capture under way, 0 when there is none
+	captureLeft int
+	captureKind string
+	captureFile *os.File
+	lastCapture time.Time
+	mutex       sync.Mutex
+	reports     []SlowTick
+}
+
+func NewTickProfiler(kind string, ticks int, dir string) *TickProfiler {
+	return &TickProfiler{
+		CaptureKind:  kind,
+		CaptureTicks: ticks,
+		CaptureDir:   dir,
+	}
+}
+
+func ValidCaptureKind(kind string) bool {
+	return kind == CaptureNone || kind == CaptureCPU || kind == CaptureTrace
+}
+
+// EndTick looks at the tick just run, which took elapsed in all
+func (self *TickProfiler) EndTick(srv *CstServer, elapsed time.Duration) {
+	if self.captureLeft > 0 {
+		self.captureLeft--
+		if self.captureLeft == 0 {
+			self.stopCapture()
+		}
+	}
+	if elapsed.Seconds() <= tickSecs {
+		return
+	}
+	report := srv.slowTick(elapsed)
+	now := srv.clock.Now()
+	if self.CaptureKind != CaptureNone && self.captureLeft == 0 &&
+		(self.lastCapture.IsZero() || now.Sub(self.lastCapture) >= captureInterval) {
+		path, err := self.startCapture(report.Tick)
+		if err != nil {
+			profileLog.Error("slow tick capture not started", tickAttr(report.Tick), "err", err)
+		} else {
+			report.Capture = path
+			self.lastCapture = now
+		}
+	}
+	profileLog.Warn("slow tick", tickAttr(report.Tick), "report", report)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.reports) == slowTickReports {
+		copy(self.reports, self.reports[1:])
+		self.reports = self.reports[:slowTickReports-1]
+	}
+	self.reports = append(self.reports, report)
+}
+
+func (self *TickProfiler) startCapture(tick uint64) (string, error) {
+	name := fmt.Sprintf("slowtick-%d.%s", tick, self.CaptureKind)
+	path := filepath.Join(self.CaptureDir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if self.CaptureKind == CaptureCPU {
+		err = pprof.StartCPUProfile(file)
+	} else {
+		err = trace.Start(file)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", err
+	}
+	self.captureFile = file
+	self.captureKind = self.CaptureKind
+	self.captureLeft = self.CaptureTicks
+	if self.captureLeft < 1 {
+		self.captureLeft = 1
+	}
+	return path, nil
+}
+
+func (self *TickProfiler) stopCapture() {
+	if self.captureKind == CaptureCPU {
+		pprof.StopCPUProfile()
+	} else {
+		trace.Stop()
+	}
+	if err := self.captureFile.Close(); err != nil {
+		profileLog.Error("slow tick capture not written", "path", self.captureFile.Name(), "err", err)
+	}
+	profileLog.Info("slow tick capture written", "path", self.captureFile.Name())
+	self.captureFile = nil
+}
+
+// Stop ends a capture under way, for a server shutting down
+func (self *TickProfiler) Stop() {
+	if self.captureFile != nil {
+		self.stopCapture()
+	}
+}
+
+// Reports returns the last slow-tick reports, oldest first
+func (self *TickProfiler) Reports() []SlowTick {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]SlowTick{}, self.reports...)
+}
+
+func (self *TickProfiler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(self.Reports(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// slowTick reports on the tick just run, from the phase times and the
+// time each subgrid took. Only the tick goroutine may call it.
+func (srv *CstServer) slowTick(elapsed time.Duration) SlowTick {
+	report := SlowTick{
+		Tick:     srv.tickNumber - 1,
+		Time:     srv.clock.Now(),
+		Seconds:  elapsed.Seconds(),
+		Budget:   tickSecs,
+		Phases:   make(map[string]float64, phaseCount),
+		Subgrids: len(srv.world.grid),
+		Players:  srv.world.playerCount(),
+	}
+	for i, d := range srv.phaseTimes {
+		report.Phases[phaseNames[i]] = d.Seconds()
+	}
+	times := make([]SubgridTime, 0, len(srv.world.grid))
+	for gcoord, subgrid := range srv.world.grid {
+		times = append(times, SubgridTime{
+			X:               gcoord.x,
+			Y:               gcoord.y,
+			Entities:        len(subgrid.Entities),
+			Players:         subgrid.PlayerCount,
+			ParallelSeconds: subgrid.parallelTime.Seconds(),
+			PlayerSeconds:   time.Duration(subgrid.playerTime).Seconds(),
+		})
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].seconds() > times[j].seconds()
+	})
+	if len(times) > slowTickSubgrids {
+		times = times[:slowTickSubgrids]
+	}
+	report.Worst = times
+	return report
+}
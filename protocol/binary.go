@@ -0,0 +1,507 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+/*
+With codec=bin every frame the server sends is a websocket.BinaryMessage
+laid out as below.
+
+uvarint and varint are encoding/binary varints; varint is zigzag signed.
+str is a uvarint byte length followed by UTF-8. Positions of things in
+view are two bytes, dx and dy, relative to the view's top left corner,
+the same offsets the JSON frames encode in Base91.
+
+init, first byte 'I':
+
+	approved byte      1 if a player entity was created
+	approved == 1:
+	  uuid [16]byte
+	  token str        resume token for reconnect commands
+	approved == 0:
+	  pop uvarint
+	  load uvarint     server load * 100
+
+queue, first byte 'Q':
+
+	position uvarint   1 is next in
+	length uvarint     connections waiting
+	wait uvarint       estimated seconds to admission, 0 if unknown
+
+resume, first byte 'R':
+
+	approved byte      1 if the old player was handed back
+	approved == 1:
+	  uuid [16]byte
+	  token str        the new resume token
+
+update, first byte 'U':
+
+	pop uvarint
+	load uvarint       server load * 100
+	x, y varint        player location
+	d byte             facing: 'n' 's' 'e' 'w' or '0'
+	health varint
+	flags byte         bit 0 collided, bit 1 life allowed here, bit 2 the
+	                   map carries tile codes (v=2), bit 3 entity deltas,
+	                   bit 4 keyframe
+	maptype byte       'b' basic, 'l' line, 'e' entity
+	  'b': tiles for the whole 79x25 view
+	  'l': start x, y varint, orientation byte, tiles for one row or column
+	  'e': nothing
+	patch uvarint      count, then per tile dx, dy, tile code byte
+	entities uvarint   count, then per entity dx, dy, symbol uvarint; with
+	                   entity deltas, per delta instead: handle uvarint,
+	                   fields byte, then x, y varint, symbol uvarint and
+	                   health varint as the fields bits say
+	life [247]byte     life cells of the view, bit i of byte i/8 is cell i
+	messages uvarint   count, then a str per message
+	timestamp uvarint  echo of the last applied move's client timestamp
+
+tiles depend on the map encoding, which clients pick with the "v" query
+parameter:
+
+	v=1: walkable bits, row by row, bit i of byte i/8 is cell i
+	v=2: palette count byte, then that many tile code bytes, then runs
+	     covering every cell: a byte with the palette index in the low 3
+	     bits and run length - 1 in the high 5 bits; a high value of 31
+	     means a uvarint of (length - 32) follows
+
+message, first byte 'M':
+
+	data str           chat text, not HTML escaped
+
+shutdown, first byte 'S':
+
+	seconds uvarint    until the server closes the connection
+	restart byte       1 if the server is coming back
+*/
+
+const FrameInit byte = 'I'
+const FrameUpdate byte = 'U'
+const FrameMessage byte = 'M'
+const FrameResume byte = 'R'
+const FrameQueue byte = 'Q'
+const FrameShutdown byte = 'S'
+
+var mapTypeBytes = map[string]byte{MapBasic: 'b', MapLine: 'l', MapEntity: 'e'}
+var mapTypeNames = map[byte]string{'b': MapBasic, 'l': MapLine, 'e': MapEntity}
+
+func putUvarint(buffer *bytes.Buffer, v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	buffer.Write(scratch[:n])
+}
+
+func putVarint(buffer *bytes.Buffer, v int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(scratch[:], v)
+	buffer.Write(scratch[:n])
+}
+
+func putString(buffer *bytes.Buffer, s string) {
+	putUvarint(buffer, uint64(len(s)))
+	buffer.WriteString(s)
+}
+
+func putLoad(buffer *bytes.Buffer, load float64) {
+	putUvarint(buffer, uint64(math.Max(0, load*100)+0.5))
+}
+
+// putBits packs bools into bytes, least significant bit first
+func putBits(buffer *bytes.Buffer, n int, bit func(int) bool) {
+	var v byte
+	for i := 0; i < n; i++ {
+		if bit(i) {
+			v |= 1 << uint(i%8)
+		}
+		if i%8 == 7 {
+			buffer.WriteByte(v)
+			v = 0
+		}
+	}
+	if n%8 != 0 {
+		buffer.WriteByte(v)
+	}
+}
+
+func (self *Init) EncodeBinary(buffer *bytes.Buffer) {
+	buffer.WriteByte(FrameInit)
+	if self.Approved {
+		buffer.WriteByte(1)
+		buffer.Write(self.ID[:])
+		putString(buffer, self.Token)
+	} else {
+		buffer.WriteByte(0)
+		putUvarint(buffer, uint64(self.Pop))
+		putLoad(buffer, self.Load)
+	}
+}
+
+func (self *Queue) EncodeBinary(buffer *bytes.Buffer) {
+	buffer.WriteByte(FrameQueue)
+	putUvarint(buffer, uint64(self.Position))
+	putUvarint(buffer, uint64(self.Length))
+	putUvarint(buffer, uint64(self.Wait))
+}
+
+func (self *Resume) EncodeBinary(buffer *bytes.Buffer) {
+	buffer.WriteByte(FrameResume)
+	if self.Approved {
+		buffer.WriteByte(1)
+		buffer.Write(self.ID[:])
+		putString(buffer, self.Token)
+	} else {
+		buffer.WriteByte(0)
+	}
+}
+
+func (self *Message) EncodeBinary(buffer *bytes.Buffer) {
+	buffer.WriteByte(FrameMessage)
+	putString(buffer, self.Data)
+}
+
+func (self *Shutdown) EncodeBinary(buffer *bytes.Buffer) {
+	buffer.WriteByte(FrameShutdown)
+	putUvarint(buffer, uint64(self.Seconds))
+	if self.Restart {
+		buffer.WriteByte(1)
+	} else {
+		buffer.WriteByte(0)
+	}
+}
+
+func (self *MapUpdate) encodeBinary(buffer *bytes.Buffer) {
+	buffer.WriteByte(mapTypeBytes[self.Type])
+	switch self.Type {
+	case MapEntity:
+		return
+	case MapLine:
+		putVarint(buffer, self.StartX)
+		putVarint(buffer, self.StartY)
+		buffer.WriteByte(byte(self.Orientation))
+	}
+	if self.Encoding < MapTiles {
+		putBits(buffer, len(self.Tiles), func(i int) bool {
+			return Walkable(self.Tiles[i])
+		})
+		return
+	}
+	palette, paletteIndex := buildPalette(self.Tiles)
+	buffer.WriteByte(byte(len(palette)))
+	for _, tile := range palette {
+		buffer.WriteByte(byte(tile))
+	}
+	forEachRun(self.Tiles, func(tile int8, length int) {
+		index := byte(paletteIndex[tile])
+		if length < 32 {
+			buffer.WriteByte(index | byte((length-1)<<3))
+		} else {
+			buffer.WriteByte(index | (31 << 3))
+			putUvarint(buffer, uint64(length-32))
+		}
+	})
+}
+
+func putDelta(buffer *bytes.Buffer, delta EntityDelta) {
+	putUvarint(buffer, uint64(delta.Handle))
+	buffer.WriteByte(delta.Fields)
+	if delta.Fields&DeltaPosition != 0 {
+		putVarint(buffer, delta.X)
+		putVarint(buffer, delta.Y)
+	}
+	if delta.Fields&DeltaSymbol != 0 {
+		putUvarint(buffer, uint64(delta.Symbol))
+	}
+	if delta.Fields&DeltaHealth != 0 {
+		putVarint(buffer, int64(delta.Health))
+	}
+}
+
+func (self *Update) EncodeBinary(buffer *bytes.Buffer) {
+	buffer.WriteByte(FrameUpdate)
+	putUvarint(buffer, uint64(self.Pop))
+	putLoad(buffer, self.Load)
+	putVarint(buffer, self.X)
+	putVarint(buffer, self.Y)
+	buffer.WriteByte(byte(self.Direction))
+	putVarint(buffer, int64(self.Health))
+
+	var flags byte
+	if self.Collided {
+		flags |= 1
+	}
+	if self.LifeAllowed {
+		flags |= 2
+	}
+	if self.Map.Encoding >= MapTiles {
+		flags |= 4
+	}
+	if self.UseDeltas {
+		flags |= 8
+	}
+	if self.Keyframe {
+		flags |= 16
+	}
+	buffer.WriteByte(flags)
+
+	self.Map.encodeBinary(buffer)
+
+	putUvarint(buffer, uint64(len(self.Patch)))
+	for _, patch := range self.Patch {
+		buffer.WriteByte(patch.X)
+		buffer.WriteByte(patch.Y)
+		buffer.WriteByte(byte(patch.Tile))
+	}
+	if self.UseDeltas {
+		putUvarint(buffer, uint64(len(self.Deltas)))
+		for _, delta := range self.Deltas {
+			putDelta(buffer, delta)
+		}
+	} else {
+		putUvarint(buffer, uint64(len(self.Entities)))
+		for _, mark := range self.Entities {
+			buffer.WriteByte(mark.X)
+			buffer.WriteByte(mark.Y)
+			putUvarint(buffer, uint64(mark.Symbol))
+		}
+	}
+	putBits(buffer, len(self.Life), func(i int) bool {
+		return self.Life[i]
+	})
+	putUvarint(buffer, uint64(len(self.Messages)))
+	for _, msg := range self.Messages {
+		putString(buffer, msg)
+	}
+	putUvarint(buffer, self.Timestamp)
+}
+
+// binaryReader reads a frame, remembering the first error
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail() {
+	if r.err == nil {
+		r.err = ErrBadFrame
+	}
+	r.data = nil
+}
+
+func (r *binaryReader) Byte() byte {
+	if len(r.data) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) Bytes(n int) []byte {
+	if n < 0 || len(r.data) < n {
+		r.fail()
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) Uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) Varint() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) String() string {
+	n := r.Uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail()
+		return ""
+	}
+	return string(r.Bytes(int(n)))
+}
+
+func (r *binaryReader) Bits(n int, setBit func(int, bool)) {
+	b := r.Bytes((n + 7) / 8)
+	if b == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		setBit(i, (b[i/8]>>uint(i%8))&1 != 0)
+	}
+}
+
+// Count reads a uvarint element count, rejecting counts larger than the
+// bytes left could hold
+func (r *binaryReader) Count(minSize int) int {
+	n := r.Uvarint()
+	if n > uint64(len(r.data)/minSize) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) Delta() EntityDelta {
+	var delta EntityDelta
+	delta.Handle = uint16(r.Uvarint())
+	delta.Fields = r.Byte()
+	if delta.Fields&DeltaPosition != 0 {
+		delta.X = r.Varint()
+		delta.Y = r.Varint()
+	}
+	if delta.Fields&DeltaSymbol != 0 {
+		delta.Symbol = rune(r.Uvarint())
+	}
+	if delta.Fields&DeltaHealth != 0 {
+		delta.Health = int(r.Varint())
+	}
+	return delta
+}
+
+func DecodeBinary(data []byte) (Frame, error) {
+	r := &binaryReader{data: data}
+	switch r.Byte() {
+	case FrameInit:
+		init := &Init{Approved: r.Byte() == 1}
+		if init.Approved {
+			copy(init.ID[:], r.Bytes(16))
+			init.Token = r.String()
+		} else {
+			init.Pop = int(r.Uvarint())
+			init.Load = float64(r.Uvarint()) / 100
+		}
+		return init, r.err
+	case FrameQueue:
+		queue := &Queue{
+			Position: int(r.Uvarint()),
+			Length:   int(r.Uvarint()),
+			Wait:     int(r.Uvarint()),
+		}
+		return queue, r.err
+	case FrameResume:
+		resume := &Resume{Approved: r.Byte() == 1}
+		if resume.Approved {
+			copy(resume.ID[:], r.Bytes(16))
+			resume.Token = r.String()
+		}
+		return resume, r.err
+	case FrameMessage:
+		return &Message{Data: r.String()}, r.err
+	case FrameShutdown:
+		shutdown := &Shutdown{Seconds: int(r.Uvarint()), Restart: r.Byte() == 1}
+		return shutdown, r.err
+	case FrameUpdate:
+		update := NewUpdate()
+		update.decodeBinary(r)
+		return update, r.err
+	}
+	return nil, ErrBadFrame
+}
+
+func (self *MapUpdate) decodeBinary(r *binaryReader) {
+	name, present := mapTypeNames[r.Byte()]
+	if !present {
+		r.fail()
+		return
+	}
+	self.Type = name
+	if self.Type == MapEntity {
+		return
+	}
+	if self.Type == MapLine {
+		self.StartX = r.Varint()
+		self.StartY = r.Varint()
+		self.Orientation = rune(r.Byte())
+	}
+	n := self.Width() * self.Height()
+	if self.Encoding < MapTiles {
+		r.Bits(n, func(i int, walkable bool) {
+			if walkable {
+				self.Tiles = append(self.Tiles, TileFloor)
+			} else {
+				self.Tiles = append(self.Tiles, TileUnused)
+			}
+		})
+		return
+	}
+	palette := r.Bytes(int(r.Byte()))
+	for len(self.Tiles) < n && r.err == nil {
+		v := r.Byte()
+		if int(v&7) >= len(palette) {
+			r.fail()
+			return
+		}
+		length := int(v>>3) + 1
+		if length == 32 {
+			length += int(r.Uvarint())
+		}
+		if len(self.Tiles)+length > n {
+			r.fail()
+			return
+		}
+		for ; length > 0; length-- {
+			self.Tiles = append(self.Tiles, int8(palette[v&7]))
+		}
+	}
+}
+
+func (self *Update) decodeBinary(r *binaryReader) {
+	self.Pop = int(r.Uvarint())
+	self.Load = float64(r.Uvarint()) / 100
+	self.X = r.Varint()
+	self.Y = r.Varint()
+	self.Direction = rune(r.Byte())
+	self.Health = int(r.Varint())
+	flags := r.Byte()
+	self.Collided = flags&1 != 0
+	self.LifeAllowed = flags&2 != 0
+	self.Map.Encoding = MapBitmask
+	if flags&4 != 0 {
+		self.Map.Encoding = MapTiles
+	}
+	self.UseDeltas = flags&8 != 0
+	self.Keyframe = flags&16 != 0
+
+	self.Map.decodeBinary(r)
+
+	for n := r.Count(3); n > 0; n-- {
+		self.Patch = append(self.Patch, TilePatch{r.Byte(), r.Byte(), int8(r.Byte())})
+	}
+	if self.UseDeltas {
+		for n := r.Count(2); n > 0; n-- {
+			self.Deltas = append(self.Deltas, r.Delta())
+		}
+	} else {
+		for n := r.Count(3); n > 0; n-- {
+			self.Entities = append(self.Entities, Mark{r.Byte(), r.Byte(), rune(r.Uvarint())})
+		}
+	}
+	r.Bits(ViewWidth*ViewHeight, func(i int, alive bool) {
+		self.Life = append(self.Life, alive)
+	})
+	for n := r.Count(1); n > 0; n-- {
+		self.Messages = append(self.Messages, r.String())
+	}
+	self.Timestamp = r.Uvarint()
+}
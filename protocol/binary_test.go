@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+/*
+The benchmarks encode the updates a player is sent each tick: a keyframe
+with the whole view, the row or column that scrolls in as it walks, and
+what it gets standing still. Each reports its size, which is what one
+player costs per tick.
+*/
+
+var benchmarkUpdates = []struct {
+	name        string
+	mapType     string
+	orientation rune
+}{
+	{"basic", MapBasic, 0},
+	{"line", MapLine, 'n'},
+	{"entity", MapEntity, 0},
+}
+
+func benchmarkEncode(b *testing.B, codec int) {
+	for _, sample := range benchmarkUpdates {
+		for _, deltas := range []bool{false, true} {
+			name := sample.name
+			if deltas {
+				name += "-deltas"
+			}
+			b.Run(name, func(b *testing.B) {
+				update := sampleUpdate(MapTiles, sample.mapType, sample.orientation, deltas)
+				var buffer bytes.Buffer
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					buffer.Reset()
+					Encode(codec, update, &buffer)
+				}
+				b.ReportMetric(float64(buffer.Len()), "bytes/frame")
+			})
+		}
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	benchmarkEncode(b, CodecJSON)
+}
+
+func BenchmarkEncodeBinary(b *testing.B) {
+	benchmarkEncode(b, CodecBinary)
+}
+
+func benchmarkDecode(b *testing.B, codec int) {
+	var buffer bytes.Buffer
+	Encode(codec, sampleUpdate(MapTiles, MapBasic, 0, false), &buffer)
+	data := buffer.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(codec, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(data)), "bytes/frame")
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	benchmarkDecode(b, CodecJSON)
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	benchmarkDecode(b, CodecBinary)
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Client command types
+const CmdMove = "mv"
+const CmdChat = "ch"
+const CmdBlur = "bl"
+const CmdLifeCell = "li"
+const CmdLifeActivate = "al"
+const CmdInteract = "in"
+const CmdReconnect = "reconnect"
+const CmdSpeed = "speed"
+
+// MaxMoves bounds one mv command. A click-to-walk path fits easily.
+const MaxMoves = 512
+
+// MaxChat bounds the text of one ch command
+const MaxChat = 512
+
+// MaxToken bounds a resume token. Tokens are opaque to clients but are
+// always unpadded URL-safe Base64.
+const MaxToken = 128
+
+// MaxSpeed bounds the playback speed a spectator can ask a replay for.
+// Speed 0 pauses.
+const MaxSpeed = 16
+
+var ErrBadCommand = errors.New("protocol: malformed command")
+
+// Command is one client frame: "timestamp:cmd:data". The timestamp is the
+// client's clock in milliseconds and is echoed back in Update.Timestamp.
+type Command struct {
+	Timestamp uint64
+	Type      string
+	Data      string
+}
+
+// ParseCommand splits and validates a client frame. Command types are
+// case insensitive; Type is always returned in lower case.
+func ParseCommand(message []byte) (Command, error) {
+	var cmd Command
+	s := string(message)
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return cmd, ErrBadCommand
+	}
+	j := strings.IndexByte(s[i+1:], ':')
+	if j < 0 {
+		return cmd, ErrBadCommand
+	}
+	j += i + 1
+	timestamp, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return cmd, ErrBadCommand
+	}
+	cmd.Timestamp = timestamp
+	cmd.Type = strings.ToLower(s[i+1 : j])
+	cmd.Data = s[j+1:]
+	return cmd, cmd.validate()
+}
+
+func (self Command) validate() error {
+	switch self.Type {
+	case CmdMove:
+		if len(self.Data) > MaxMoves {
+			return fmt.Errorf("protocol: %d moves is over the limit", len(self.Data))
+		}
+		for _, mv := range self.Data {
+			switch mv {
+			case 'n', 's', 'e', 'w', '0':
+			default:
+				return fmt.Errorf("protocol: bad move %q", mv)
+			}
+		}
+	case CmdChat:
+		if len(self.Data) > MaxChat {
+			return fmt.Errorf("protocol: chat of %d bytes is over the limit", len(self.Data))
+		}
+	case CmdBlur:
+		if self.Data != "0" && self.Data != "1" {
+			return fmt.Errorf("protocol: bad blur flag %q", self.Data)
+		}
+	case CmdLifeCell, CmdLifeActivate, CmdInteract:
+	case CmdReconnect:
+		if !validToken(self.Data) {
+			return fmt.Errorf("protocol: bad resume token %q", self.Data)
+		}
+	case CmdSpeed:
+		if _, err := self.Speed(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("protocol: unknown command %q", self.Type)
+	}
+	return nil
+}
+
+func validToken(token string) bool {
+	if len(token) == 0 || len(token) > MaxToken {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Blurred is the flag of a CmdBlur command
+func (self Command) Blurred() bool {
+	return self.Data == "1"
+}
+
+// Speed is the playback speed of a CmdSpeed command
+func (self Command) Speed() (float64, error) {
+	speed, err := strconv.ParseFloat(self.Data, 64)
+	if err != nil || !(0 <= speed && speed <= MaxSpeed) {
+		return 0, fmt.Errorf("protocol: bad speed %q", self.Data)
+	}
+	return speed, nil
+}
+
+// AppendTo writes the command in wire form
+func (self Command) AppendTo(buf []byte) []byte {
+	buf = strconv.AppendUint(buf, self.Timestamp, 10)
+	buf = append(buf, ':')
+	buf = append(buf, self.Type...)
+	buf = append(buf, ':')
+	return append(buf, self.Data...)
+}
+
+func (self Command) String() string {
+	return string(self.AppendTo(make([]byte, 0, 24+len(self.Type)+len(self.Data))))
+}
@@ -0,0 +1,691 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+)
+
+/*
+JSON frames are the original wire format read by static/game.js and
+static/display.js. Bulk fields are packed into strings:
+
+	map, line  walkable bits, 6 cells per Base64 character, least
+	           significant bit first; or, with "enc":"rle", runs over
+	           "palette" (see writeRuns)
+	entities   3 characters per entity: Base91 x and y offsets from the
+	           view corner, then the symbol
+	li         life cells of the view, packed like the walkable bits
+	patch      3 characters per changed tile: Base91 x and y offsets, then
+	           the tile code as a Base64 character
+
+Clients that asked for entity deltas get "ents" instead of "entities": an
+array of [handle, fields, x, y, symbol, health] arrays where only the
+fields named in the fields bitmask are present, plus "kf":1 on keyframes.
+A keyframe lists every entity in view; anything else the client knows of
+is gone.
+*/
+
+var Base64Runes = []rune{'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '+', '/'}
+
+var Base91Table = []rune{'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '!', '#', '$', '%', '&', '(', ')', '*', '+', ',', '.', '/', ':', ';', '<', '=', '>', '?', '@', '[', ']', '^', '_', '`', '{', '|', '}', '~', '-'}
+
+var base64Index = tableIndex(Base64Runes)
+var base91Index = tableIndex(Base91Table)
+
+func tableIndex(table []rune) map[rune]int {
+	index := make(map[rune]int, len(table))
+	for i, r := range table {
+		index[r] = i
+	}
+	return index
+}
+
+// jsonWriter streams the fields of one JSON object into a buffer
+type jsonWriter struct {
+	buffer  *bytes.Buffer
+	fields  int
+	scratch [32]byte
+}
+
+func newJSONWriter(buffer *bytes.Buffer, frameType string) *jsonWriter {
+	w := &jsonWriter{buffer: buffer}
+	buffer.WriteByte('{')
+	w.String("type", frameType)
+	return w
+}
+
+func (w *jsonWriter) Key(key string) {
+	if w.fields > 0 {
+		w.buffer.WriteByte(',')
+	}
+	w.fields++
+	w.buffer.WriteByte('"')
+	w.buffer.WriteString(key)
+	w.buffer.WriteString(`":`)
+}
+
+func (w *jsonWriter) String(key, value string) {
+	w.Key(key)
+	writeJSONString(w.buffer, value)
+}
+
+func (w *jsonWriter) Int(key string, value int64) {
+	w.Key(key)
+	w.buffer.Write(strconv.AppendInt(w.scratch[:0], value, 10))
+}
+
+func (w *jsonWriter) Uint(key string, value uint64) {
+	w.Key(key)
+	w.buffer.Write(strconv.AppendUint(w.scratch[:0], value, 10))
+}
+
+func (w *jsonWriter) Float(key string, value float64) {
+	w.Key(key)
+	w.buffer.Write(strconv.AppendFloat(w.scratch[:0], value, 'f', 2, 64))
+}
+
+func (w *jsonWriter) Pair(key string, x, y int64) {
+	w.Key(key)
+	w.buffer.WriteByte('[')
+	w.buffer.Write(strconv.AppendInt(w.scratch[:0], x, 10))
+	w.buffer.WriteByte(',')
+	w.buffer.Write(strconv.AppendInt(w.scratch[:0], y, 10))
+	w.buffer.WriteByte(']')
+}
+
+// BeginString opens a string field whose contents the caller writes
+// directly. Only use it for characters that need no escaping.
+func (w *jsonWriter) BeginString(key string) {
+	w.Key(key)
+	w.buffer.WriteByte('"')
+}
+
+func (w *jsonWriter) EndString() {
+	w.buffer.WriteByte('"')
+}
+
+func (w *jsonWriter) Close() {
+	w.buffer.WriteByte('}')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString writes s as a quoted JSON string. U+2028 and U+2029 are
+// escaped too, since they end lines in JavaScript source.
+func writeJSONString(buffer *bytes.Buffer, s string) {
+	buffer.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			buffer.WriteString(s[start:i])
+			switch c {
+			case '"', '\\':
+				buffer.WriteByte('\\')
+				buffer.WriteByte(c)
+			case '\n':
+				buffer.WriteString(`\n`)
+			case '\r':
+				buffer.WriteString(`\r`)
+			case '\t':
+				buffer.WriteString(`\t`)
+			default:
+				buffer.WriteString(`\u00`)
+				buffer.WriteByte(hexDigits[c>>4])
+				buffer.WriteByte(hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buffer.WriteString(s[start:i])
+			buffer.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buffer.WriteString(s[start:i])
+			buffer.WriteString(`\u202`)
+			buffer.WriteByte(hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buffer.WriteString(s[start:])
+	buffer.WriteByte('"')
+}
+
+// writeBase64Bits packs bools 6 to a character, least significant bit first
+func writeBase64Bits(buffer *bytes.Buffer, n int, bit func(int) bool) {
+	v := 0
+	for i := 0; i < n; i++ {
+		if bit(i) {
+			v += 1 << uint32(i%6)
+		}
+		if (i+1)%6 == 0 {
+			buffer.WriteRune(Base64Runes[v])
+			v = 0
+		}
+	}
+	if n%6 != 0 {
+		buffer.WriteRune(Base64Runes[v])
+	}
+}
+
+func readBase64Bits(s string, n int, setBit func(int, bool)) error {
+	i := 0
+	for _, c := range s {
+		v, present := base64Index[c]
+		if !present {
+			return ErrBadFrame
+		}
+		for b := 0; b < 6 && i < n; b++ {
+			setBit(i, (v>>uint(b))&1 != 0)
+			i++
+		}
+	}
+	if i < n {
+		return ErrBadFrame
+	}
+	return nil
+}
+
+func writeBase64Varint(buffer *bytes.Buffer, n int) {
+	for n >= 32 {
+		buffer.WriteRune(Base64Runes[32|(n&31)])
+		n >>= 5
+	}
+	buffer.WriteRune(Base64Runes[n])
+}
+
+/*
+writeRuns encodes tile codes as runs over a palette of the codes present,
+in order of first appearance. Each run starts with one Base64 character:
+the low 3 bits are the palette index and the high 3 bits are the run
+length minus one. A high value of 7 means the run is 8 or longer, and
+(length - 8) follows as a Base64 varint: the low 5 bits of each character
+carry length bits, least significant first, and bit 5 (value 32) means
+another character follows.
+*/
+func (w *jsonWriter) writeRuns(key string, tiles []int8) {
+	palette, paletteIndex := buildPalette(tiles)
+	w.String("enc", "rle")
+	w.Key("palette")
+	w.buffer.WriteByte('[')
+	for i := 0; i < len(palette); i++ {
+		if i > 0 {
+			w.buffer.WriteByte(',')
+		}
+		w.buffer.Write(strconv.AppendInt(w.scratch[:0], int64(palette[i]), 10))
+	}
+	w.buffer.WriteByte(']')
+	w.BeginString(key)
+	forEachRun(tiles, func(tile int8, length int) {
+		index := paletteIndex[tile]
+		if length < 8 {
+			w.buffer.WriteRune(Base64Runes[index|((length-1)<<3)])
+		} else {
+			w.buffer.WriteRune(Base64Runes[index|(7<<3)])
+			writeBase64Varint(w.buffer, length-8)
+		}
+	})
+	w.EndString()
+}
+
+func readRuns(s string, palette []int8, n int, tiles []int8) ([]int8, error) {
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		v, present := base64Index[runes[i]]
+		i++
+		if !present || v&7 >= len(palette) {
+			return tiles, ErrBadFrame
+		}
+		tile, length := palette[v&7], (v>>3)+1
+		if length == 8 {
+			extra, shift := 0, uint(0)
+			for more := true; more; {
+				if i >= len(runes) {
+					return tiles, ErrBadFrame
+				}
+				c, present := base64Index[runes[i]]
+				if !present {
+					return tiles, ErrBadFrame
+				}
+				i++
+				extra |= (c & 31) << shift
+				shift += 5
+				more = c&32 != 0
+			}
+			length += extra
+		}
+		if len(tiles)+length > n {
+			return tiles, ErrBadFrame
+		}
+		for ; length > 0; length-- {
+			tiles = append(tiles, tile)
+		}
+	}
+	if len(tiles) != n {
+		return tiles, ErrBadFrame
+	}
+	return tiles, nil
+}
+
+// buildPalette lists the tile codes present in order of first appearance.
+// Codes outside 0..MaxTile-1 are treated as TileUnused.
+func buildPalette(tiles []int8) ([]int8, [MaxTile]int) {
+	var paletteIndex [MaxTile]int
+	for i := range paletteIndex {
+		paletteIndex[i] = -1
+	}
+	palette := make([]int8, 0, MaxTile)
+	for i, tile := range tiles {
+		if tile < 0 || tile >= MaxTile {
+			tiles[i], tile = TileUnused, TileUnused
+		}
+		if paletteIndex[tile] < 0 {
+			paletteIndex[tile] = len(palette)
+			palette = append(palette, tile)
+		}
+	}
+	return palette, paletteIndex
+}
+
+func forEachRun(tiles []int8, doRun func(int8, int)) {
+	for i := 0; i < len(tiles); {
+		j := i + 1
+		for j < len(tiles) && tiles[j] == tiles[i] {
+			j++
+		}
+		doRun(tiles[i], j-i)
+		i = j
+	}
+}
+
+func (self *Init) EncodeJSON(buffer *bytes.Buffer) {
+	w := newJSONWriter(buffer, "init")
+	if self.Approved {
+		w.String("uuid", FormatUUID(self.ID))
+		w.String("token", self.Token)
+		w.Int("approved", 1)
+	} else {
+		w.Int("pop", int64(self.Pop))
+		w.Float("load", self.Load)
+	}
+	w.Close()
+}
+
+func (self *Queue) EncodeJSON(buffer *bytes.Buffer) {
+	w := newJSONWriter(buffer, "queue")
+	w.Int("position", int64(self.Position))
+	w.Int("length", int64(self.Length))
+	w.Int("wait", int64(self.Wait))
+	w.Close()
+}
+
+func (self *Resume) EncodeJSON(buffer *bytes.Buffer) {
+	w := newJSONWriter(buffer, "re")
+	if self.Approved {
+		w.String("uuid", FormatUUID(self.ID))
+		w.String("token", self.Token)
+		w.Int("approved", 1)
+	} else {
+		w.Int("approved", 0)
+	}
+	w.Close()
+}
+
+func (self *Message) EncodeJSON(buffer *bytes.Buffer) {
+	w := newJSONWriter(buffer, "message")
+	w.String("data", self.Data)
+	w.Close()
+}
+
+func (self *Shutdown) EncodeJSON(buffer *bytes.Buffer) {
+	w := newJSONWriter(buffer, "shutdown")
+	w.Int("seconds", int64(self.Seconds))
+	if self.Restart {
+		w.Int("restart", 1)
+	} else {
+		w.Int("restart", 0)
+	}
+	w.Close()
+}
+
+func (self *MapUpdate) encodeJSON(w *jsonWriter) {
+	w.String("maptype", self.Type)
+	key := "map"
+	switch self.Type {
+	case MapEntity:
+		return
+	case MapLine:
+		key = "line"
+		w.Pair("start", self.StartX, self.StartY)
+		w.String("orientation", string(self.Orientation))
+	}
+	if self.Encoding >= MapTiles {
+		w.writeRuns(key, self.Tiles)
+		return
+	}
+	w.BeginString(key)
+	writeBase64Bits(w.buffer, len(self.Tiles), func(i int) bool {
+		return Walkable(self.Tiles[i])
+	})
+	w.EndString()
+}
+
+func (self *Update) EncodeJSON(buffer *bytes.Buffer) {
+	w := newJSONWriter(buffer, "update")
+	w.Int("pop", int64(self.Pop))
+	w.Float("load", self.Load)
+	w.Pair("location", self.X, self.Y)
+	w.String("d", string(self.Direction))
+	w.Int("health", int64(self.Health))
+	self.Map.encodeJSON(w)
+
+	if len(self.Patch) > 0 {
+		w.BeginString("patch")
+		for _, patch := range self.Patch {
+			w.buffer.WriteRune(Base91Table[patch.X])
+			w.buffer.WriteRune(Base91Table[patch.Y])
+			w.buffer.WriteRune(Base64Runes[patch.Tile])
+		}
+		w.EndString()
+	}
+
+	if self.UseDeltas {
+		self.encodeDeltasJSON(w)
+	} else {
+		w.Key("entities")
+		w.buffer.WriteByte('"')
+		for _, mark := range self.Entities {
+			w.buffer.WriteRune(Base91Table[mark.X])
+			w.buffer.WriteRune(Base91Table[mark.Y])
+			if mark.Symbol == '"' || mark.Symbol == '\\' {
+				w.buffer.WriteByte('\\')
+			}
+			w.buffer.WriteRune(mark.Symbol)
+		}
+		w.buffer.WriteByte('"')
+	}
+
+	w.BeginString("li")
+	writeBase64Bits(w.buffer, len(self.Life), func(i int) bool {
+		return self.Life[i]
+	})
+	w.EndString()
+
+	if self.LifeAllowed {
+		w.Int("la", 1)
+	}
+	if self.Collided {
+		w.Int("collided", 1)
+	} else {
+		w.Int("collided", 0)
+	}
+	w.Key("messages")
+	w.buffer.WriteByte('[')
+	for i, msg := range self.Messages {
+		if i > 0 {
+			w.buffer.WriteByte(',')
+		}
+		writeJSONString(w.buffer, msg)
+	}
+	w.buffer.WriteByte(']')
+	w.Uint("timestamp", self.Timestamp)
+	w.Close()
+}
+
+func (self *Update) encodeDeltasJSON(w *jsonWriter) {
+	if self.Keyframe {
+		w.Int("kf", 1)
+	}
+	w.Key("ents")
+	w.buffer.WriteByte('[')
+	for i, delta := range self.Deltas {
+		if i > 0 {
+			w.buffer.WriteByte(',')
+		}
+		w.buffer.WriteByte('[')
+		w.buffer.Write(strconv.AppendUint(w.scratch[:0], uint64(delta.Handle), 10))
+		w.buffer.WriteByte(',')
+		w.buffer.Write(strconv.AppendUint(w.scratch[:0], uint64(delta.Fields), 10))
+		if delta.Fields&DeltaPosition != 0 {
+			w.buffer.WriteByte(',')
+			w.buffer.Write(strconv.AppendInt(w.scratch[:0], delta.X, 10))
+			w.buffer.WriteByte(',')
+			w.buffer.Write(strconv.AppendInt(w.scratch[:0], delta.Y, 10))
+		}
+		if delta.Fields&DeltaSymbol != 0 {
+			w.buffer.WriteByte(',')
+			writeJSONString(w.buffer, string(delta.Symbol))
+		}
+		if delta.Fields&DeltaHealth != 0 {
+			w.buffer.WriteByte(',')
+			w.buffer.Write(strconv.AppendInt(w.scratch[:0], int64(delta.Health), 10))
+		}
+		w.buffer.WriteByte(']')
+	}
+	w.buffer.WriteByte(']')
+}
+
+// jsonFrame has every field any JSON frame uses. Decoding is for clients
+// and tools, so it leans on encoding/json.
+type jsonFrame struct {
+	Type        string              `json:"type"`
+	UUID        string              `json:"uuid"`
+	Token       string              `json:"token"`
+	Approved    int                 `json:"approved"`
+	Pop         int                 `json:"pop"`
+	Position    int                 `json:"position"`
+	Length      int                 `json:"length"`
+	Wait        int                 `json:"wait"`
+	Load        float64             `json:"load"`
+	Location    [2]int64            `json:"location"`
+	D           string              `json:"d"`
+	Health      int                 `json:"health"`
+	Maptype     string              `json:"maptype"`
+	Map         string              `json:"map"`
+	Start       [2]int64            `json:"start"`
+	Orientation string              `json:"orientation"`
+	Line        string              `json:"line"`
+	Enc         string              `json:"enc"`
+	Palette     []int8              `json:"palette"`
+	Patch       string              `json:"patch"`
+	Entities    string              `json:"entities"`
+	Kf          int                 `json:"kf"`
+	Ents        [][]json.RawMessage `json:"ents"`
+	Li          string              `json:"li"`
+	La          int                 `json:"la"`
+	Collided    int                 `json:"collided"`
+	Messages    []string            `json:"messages"`
+	Timestamp   uint64              `json:"timestamp"`
+	Data        string              `json:"data"`
+	Seconds     int                 `json:"seconds"`
+	Restart     int                 `json:"restart"`
+}
+
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
+}
+
+func DecodeJSON(data []byte) (Frame, error) {
+	var frame jsonFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, err
+	}
+	switch frame.Type {
+	case "init":
+		init := &Init{
+			Approved: frame.Approved != 0,
+			Pop:      frame.Pop,
+			Load:     frame.Load,
+		}
+		if init.Approved {
+			id, err := ParseUUID(frame.UUID)
+			if err != nil {
+				return nil, err
+			}
+			init.ID = id
+			init.Token = frame.Token
+		}
+		return init, nil
+	case "queue":
+		return &Queue{Position: frame.Position, Length: frame.Length, Wait: frame.Wait}, nil
+	case "re":
+		resume := &Resume{Approved: frame.Approved != 0}
+		if resume.Approved {
+			id, err := ParseUUID(frame.UUID)
+			if err != nil {
+				return nil, err
+			}
+			resume.ID = id
+			resume.Token = frame.Token
+		}
+		return resume, nil
+	case "message":
+		return &Message{Data: frame.Data}, nil
+	case "shutdown":
+		return &Shutdown{Seconds: frame.Seconds, Restart: frame.Restart != 0}, nil
+	case "update":
+		update := NewUpdate()
+		return update, frame.fillUpdate(update)
+	}
+	return nil, ErrBadFrame
+}
+
+func decodeDeltaJSON(fields []json.RawMessage) (EntityDelta, error) {
+	var delta EntityDelta
+	next := func(v interface{}) error {
+		if len(fields) == 0 {
+			return ErrBadFrame
+		}
+		err := json.Unmarshal(fields[0], v)
+		fields = fields[1:]
+		return err
+	}
+	if err := next(&delta.Handle); err != nil {
+		return delta, err
+	}
+	if err := next(&delta.Fields); err != nil {
+		return delta, err
+	}
+	if delta.Fields&DeltaPosition != 0 {
+		if err := next(&delta.X); err != nil {
+			return delta, err
+		}
+		if err := next(&delta.Y); err != nil {
+			return delta, err
+		}
+	}
+	if delta.Fields&DeltaSymbol != 0 {
+		var symbol string
+		if err := next(&symbol); err != nil {
+			return delta, err
+		}
+		delta.Symbol = firstRune(symbol)
+	}
+	if delta.Fields&DeltaHealth != 0 {
+		if err := next(&delta.Health); err != nil {
+			return delta, err
+		}
+	}
+	if len(fields) != 0 {
+		return delta, ErrBadFrame
+	}
+	return delta, nil
+}
+
+func (frame *jsonFrame) fillUpdate(update *Update) error {
+	update.Pop = frame.Pop
+	update.Load = frame.Load
+	update.X, update.Y = frame.Location[0], frame.Location[1]
+	update.Direction = firstRune(frame.D)
+	update.Health = frame.Health
+	update.LifeAllowed = frame.La != 0
+	update.Collided = frame.Collided != 0
+	update.Messages = append(update.Messages, frame.Messages...)
+	update.Timestamp = frame.Timestamp
+	update.UseDeltas = frame.Ents != nil
+	update.Keyframe = frame.Kf != 0
+	for _, fields := range frame.Ents {
+		delta, err := decodeDeltaJSON(fields)
+		if err != nil {
+			return err
+		}
+		update.Deltas = append(update.Deltas, delta)
+	}
+
+	m := &update.Map
+	m.Type = frame.Maptype
+	m.Encoding = MapBitmask
+	data := frame.Map
+	if m.Type == MapLine {
+		m.StartX, m.StartY = frame.Start[0], frame.Start[1]
+		m.Orientation = firstRune(frame.Orientation)
+		data = frame.Line
+	}
+	n := m.Width() * m.Height()
+	if frame.Enc == "rle" {
+		m.Encoding = MapTiles
+		tiles, err := readRuns(data, frame.Palette, n, m.Tiles)
+		m.Tiles = tiles
+		if err != nil {
+			return err
+		}
+	} else if n > 0 {
+		err := readBase64Bits(data, n, func(i int, walkable bool) {
+			if walkable {
+				m.Tiles = append(m.Tiles, TileFloor)
+			} else {
+				m.Tiles = append(m.Tiles, TileUnused)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	patch := []rune(frame.Patch)
+	if len(patch)%3 != 0 {
+		return ErrBadFrame
+	}
+	for i := 0; i < len(patch); i += 3 {
+		x, ok1 := base91Index[patch[i]]
+		y, ok2 := base91Index[patch[i+1]]
+		tile, ok3 := base64Index[patch[i+2]]
+		if !ok1 || !ok2 || !ok3 {
+			return ErrBadFrame
+		}
+		update.Patch = append(update.Patch, TilePatch{uint8(x), uint8(y), int8(tile)})
+	}
+
+	entities := []rune(frame.Entities)
+	if len(entities)%3 != 0 {
+		return ErrBadFrame
+	}
+	for i := 0; i < len(entities); i += 3 {
+		x, ok1 := base91Index[entities[i]]
+		y, ok2 := base91Index[entities[i+1]]
+		if !ok1 || !ok2 {
+			return ErrBadFrame
+		}
+		update.Entities = append(update.Entities, Mark{uint8(x), uint8(y), entities[i+2]})
+	}
+
+	return readBase64Bits(frame.Li, ViewWidth*ViewHeight, func(i int, alive bool) {
+		update.Life = append(update.Life, alive)
+	})
+}
@@ -0,0 +1,274 @@
+/*
+Package protocol defines the frames the ROTCS server and its clients
+exchange over the websocket.
+
+The server sends Init, Queue, Resume, Update, Message and Shutdown frames,
+encoded either as JSON text (the default, understood by static/game.js) or in the
+binary layout described in binary.go. Clients send Commands as
+"timestamp:cmd:data" text in both codecs.
+
+Frames are plain structs so the server can fill one per player per tick
+and encode it without building intermediate strings. Reset keeps the
+slices of an Update so it can be reused.
+*/
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// The player's view is a 79x25 window centered on the player
+const ViewWidth = 79
+const ViewHeight = 25
+
+// Codecs a client can select at the handshake
+const CodecJSON = 0
+const CodecBinary = 1
+
+// Map encodings. MapBitmask only says which cells are walkable; MapTiles
+// carries the tile code of every cell.
+const MapBitmask = 1
+const MapTiles = 2
+
+// Tile codes, as stored by the dungeon generator. The door codes past
+// TileDoor are display-only and report door state.
+const TileUnused int8 = 0
+const TileWall int8 = 1
+const TileFloor int8 = 2
+const TileUnpass int8 = 3
+const TileCorridor int8 = 4
+const TileDoor int8 = 5
+const TileDoorClosed int8 = 6
+const TileDoorLocked int8 = 7
+
+// MaxTile is one more than the largest tile code
+const MaxTile = 8
+
+// Walkable reports whether a display tile code can be walked on
+func Walkable(tile int8) bool {
+	return tile == TileFloor || tile == TileCorridor || tile == TileDoor
+}
+
+// Map update types
+const MapBasic = "basic"
+const MapLine = "line"
+const MapEntity = "entity"
+
+var ErrBadFrame = errors.New("protocol: malformed frame")
+
+// Frame is any message the server sends
+type Frame interface {
+	EncodeJSON(*bytes.Buffer)
+	EncodeBinary(*bytes.Buffer)
+}
+
+// Encode writes frame to buffer in the given codec
+func Encode(codec int, frame Frame, buffer *bytes.Buffer) {
+	if codec == CodecBinary {
+		frame.EncodeBinary(buffer)
+	} else {
+		frame.EncodeJSON(buffer)
+	}
+}
+
+// Decode reads a frame written by Encode. It returns *Init, *Queue,
+// *Resume, *Update, *Message or *Shutdown.
+func Decode(codec int, data []byte) (Frame, error) {
+	if codec == CodecBinary {
+		return DecodeBinary(data)
+	}
+	return DecodeJSON(data)
+}
+
+// Init answers a new connection. An approved Init carries the resume
+// token the client sends back in a reconnect command if it drops.
+type Init struct {
+	Approved bool
+	ID       [16]byte
+	Token    string
+	Pop      int
+	Load     float64
+}
+
+// Queue tells a client waiting for admission where it stands. Position 1
+// is next in. Wait is an estimate in seconds; 0 means unknown.
+type Queue struct {
+	Position int
+	Length   int
+	Wait     int
+}
+
+// Resume answers a reconnect command. On approval the client has its old
+// player back and gets a fresh token; otherwise it keeps the player its
+// new connection was given.
+type Resume struct {
+	Approved bool
+	ID       [16]byte
+	Token    string
+}
+
+type Message struct {
+	Data string
+}
+
+// Shutdown counts down to the server closing the connection. Restart
+// means it is coming back, so the client should reconnect.
+type Shutdown struct {
+	Seconds int
+	Restart bool
+}
+
+// MapUpdate is the dungeon part of an Update. Basic maps cover the whole
+// view; line maps cover the one row or column that scrolled into view;
+// entity maps carry no tiles because the player didn't move.
+type MapUpdate struct {
+	Type        string
+	Encoding    int
+	StartX      int64
+	StartY      int64
+	Orientation rune
+	Tiles       []int8
+}
+
+// Width and Height give the size of the map's tile rectangle
+func (self *MapUpdate) Width() int {
+	if self.Type == MapLine && (self.Orientation == 'w' || self.Orientation == 'e') {
+		return 1
+	}
+	return ViewWidth
+}
+
+func (self *MapUpdate) Height() int {
+	switch self.Type {
+	case MapLine:
+		if self.Orientation == 'w' || self.Orientation == 'e' {
+			return ViewHeight
+		}
+		return 1
+	case MapBasic:
+		return ViewHeight
+	}
+	return 0
+}
+
+// Mark is something drawn at an offset from the view's top left corner
+type Mark struct {
+	X      uint8
+	Y      uint8
+	Symbol rune
+}
+
+// EntityDelta fields. A delta for a handle the client doesn't know is a
+// spawn and carries every field; a despawn carries none.
+const DeltaPosition = 1 << 0
+const DeltaSymbol = 1 << 1
+const DeltaHealth = 1 << 2
+const DeltaDespawn = 1 << 3
+
+// EntityDelta is a change to one entity, named by a handle that is stable
+// for as long as the entity stays in view of the connection. Positions
+// are world coordinates so clients can animate moves across scrolls.
+type EntityDelta struct {
+	Handle uint16
+	Fields uint8
+	X      int64
+	Y      int64
+	Symbol rune
+	Health int
+}
+
+type TilePatch struct {
+	X    uint8
+	Y    uint8
+	Tile int8
+}
+
+type Update struct {
+	Pop         int
+	Load        float64
+	X           int64
+	Y           int64
+	Direction   rune
+	Health      int
+	Map         MapUpdate
+	Patch       []TilePatch
+	Entities    []Mark
+	Deltas      []EntityDelta
+	UseDeltas   bool
+	Keyframe    bool
+	Life        []bool
+	LifeAllowed bool
+	Collided    bool
+	Messages    []string
+	Timestamp   uint64
+}
+
+func NewUpdate() *Update {
+	return &Update{
+		Map:      MapUpdate{Tiles: make([]int8, 0, ViewWidth*ViewHeight)},
+		Patch:    make([]TilePatch, 0, 4),
+		Entities: make([]Mark, 0, 32),
+		Deltas:   make([]EntityDelta, 0, 32),
+		Life:     make([]bool, 0, ViewWidth*ViewHeight),
+		Messages: make([]string, 0, 4),
+	}
+}
+
+// Reset clears the update for reuse, keeping its slices
+func (self *Update) Reset() {
+	tiles := self.Map.Tiles[:0]
+	patch, entities, deltas := self.Patch[:0], self.Entities[:0], self.Deltas[:0]
+	life, messages := self.Life[:0], self.Messages[:0]
+	*self = Update{
+		Map:      MapUpdate{Tiles: tiles},
+		Patch:    patch,
+		Entities: entities,
+		Deltas:   deltas,
+		Life:     life,
+		Messages: messages,
+	}
+}
+
+// FormatUUID writes id in the canonical 8-4-4-4-12 hex form
+func FormatUUID(id [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+func ParseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return id, fmt.Errorf("protocol: bad uuid %q", s)
+	}
+	j := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '-' {
+			continue
+		}
+		if i+1 >= len(s) {
+			return id, fmt.Errorf("protocol: bad uuid %q", s)
+		}
+		hi, ok1 := unhex(s[i])
+		lo, ok2 := unhex(s[i+1])
+		if !ok1 || !ok2 {
+			return id, fmt.Errorf("protocol: bad uuid %q", s)
+		}
+		id[j] = hi<<4 | lo
+		j++
+		i++
+	}
+	return id, nil
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,236 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var codecs = []int{CodecJSON, CodecBinary}
+
+func codecName(codec int) string {
+	if codec == CodecBinary {
+		return "binary"
+	}
+	return "json"
+}
+
+func roundTrip(t *testing.T, codec int, frame Frame) Frame {
+	var buffer bytes.Buffer
+	Encode(codec, frame, &buffer)
+	decoded, err := Decode(codec, buffer.Bytes())
+	if err != nil {
+		t.Fatalf("%s: %v\n%q", codecName(codec), err, buffer.Bytes())
+	}
+	return decoded
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	id := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 255}
+	frames := []Frame{
+		// Approved or not, an Init carries only what the client needs
+		&Init{Approved: true, ID: id, Token: "tok-EN_123"},
+		&Init{Pop: 200, Load: 0.75},
+		&Queue{Position: 3, Length: 9, Wait: 42},
+		&Queue{Position: 1, Length: 1},
+		&Resume{Approved: true, ID: id, Token: "next_token"},
+		&Resume{},
+		&Message{Data: "plain"},
+		&Message{Data: "quotes \" back\\slash <b>\n\ttab \u00e9\u4e16 \x01"},
+		&Message{},
+		&Shutdown{Seconds: 15},
+		&Shutdown{Seconds: 0, Restart: true},
+	}
+	for _, codec := range codecs {
+		for _, frame := range frames {
+			decoded := roundTrip(t, codec, frame)
+			if !reflect.DeepEqual(frame, decoded) {
+				t.Errorf("%s: sent %#v, got %#v", codecName(codec), frame, decoded)
+			}
+		}
+	}
+}
+
+// sampleUpdate fills every field an update of the map type can carry
+func sampleUpdate(encoding int, mapType string, orientation rune, deltas bool) *Update {
+	update := NewUpdate()
+	update.Pop, update.Load = 3, 0.25
+	update.X, update.Y, update.Direction, update.Health = -100, 4000, 'n', 77
+	update.Map.Type, update.Map.Encoding = mapType, encoding
+	if mapType == MapLine {
+		update.Map.StartX, update.Map.StartY, update.Map.Orientation = -5, 9, orientation
+	}
+	for i := 0; i < update.Map.Width()*update.Map.Height(); i++ {
+		tile := int8((i / 37) % MaxTile)
+		if encoding == MapBitmask {
+			if Walkable(tile) {
+				tile = TileFloor
+			} else {
+				tile = TileUnused
+			}
+		}
+		update.Map.Tiles = append(update.Map.Tiles, tile)
+	}
+	if encoding == MapTiles {
+		update.Patch = append(update.Patch, TilePatch{1, 2, TileDoorClosed}, TilePatch{78, 24, TileDoor})
+	}
+	if deltas {
+		update.UseDeltas, update.Keyframe = true, true
+		update.Deltas = append(update.Deltas,
+			EntityDelta{Handle: 1, Fields: DeltaPosition | DeltaSymbol | DeltaHealth, X: -3, Y: 7, Symbol: '@', Health: 100},
+			EntityDelta{Handle: 2, Fields: DeltaPosition, X: 1 << 40, Y: -1 << 40},
+			EntityDelta{Handle: 300, Fields: DeltaSymbol, Symbol: '"'},
+			EntityDelta{Handle: 4, Fields: DeltaDespawn})
+	} else {
+		update.Entities = append(update.Entities, Mark{3, 4, '@'}, Mark{5, 6, '"'}, Mark{7, 8, '\\'}, Mark{78, 24, 'M'})
+	}
+	for i := 0; i < ViewWidth*ViewHeight; i++ {
+		update.Life = append(update.Life, i%5 == 0)
+	}
+	update.LifeAllowed, update.Collided = true, true
+	update.Messages = append(update.Messages, "hi \"there\"\n <b>", "x")
+	update.Timestamp = 1234567890123
+	return update
+}
+
+// normalize lets a decoded update be compared with the one sent: empty
+// and nil slices are the same on the wire
+func normalize(update *Update) {
+	if len(update.Map.Tiles) == 0 {
+		update.Map.Tiles = nil
+	}
+	if len(update.Patch) == 0 {
+		update.Patch = nil
+	}
+	if len(update.Entities) == 0 {
+		update.Entities = nil
+	}
+	if len(update.Deltas) == 0 {
+		update.Deltas = nil
+	}
+	if len(update.Life) == 0 {
+		update.Life = nil
+	}
+	if len(update.Messages) == 0 {
+		update.Messages = nil
+	}
+	if update.Map.Type == MapEntity {
+		update.Map.Encoding = 0
+	}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	maps := []struct {
+		mapType     string
+		orientation rune
+	}{
+		{MapBasic, 0},
+		{MapLine, 'n'},
+		{MapLine, 's'},
+		{MapLine, 'e'},
+		{MapLine, 'w'},
+		{MapEntity, 0},
+	}
+	for _, codec := range codecs {
+		for _, encoding := range []int{MapBitmask, MapTiles} {
+			for _, m := range maps {
+				for _, deltas := range []bool{false, true} {
+					name := fmt.Sprintf("%s/%d/%s%c/deltas=%v", codecName(codec), encoding, m.mapType, m.orientation, deltas)
+					sent := sampleUpdate(encoding, m.mapType, m.orientation, deltas)
+					decoded, ok := roundTrip(t, codec, sent).(*Update)
+					if !ok {
+						t.Fatalf("%s: not decoded as an update", name)
+					}
+					normalize(sent)
+					normalize(decoded)
+					if !reflect.DeepEqual(sent, decoded) {
+						t.Errorf("%s:\nsent %+v\n got %+v", name, sent, decoded)
+					}
+				}
+			}
+		}
+	}
+}
+
+// A client can't make a truncated binary frame panic the decoder
+func TestTruncatedBinary(t *testing.T) {
+	var buffer bytes.Buffer
+	Encode(CodecBinary, sampleUpdate(MapTiles, MapBasic, 0, true), &buffer)
+	data := buffer.Bytes()
+	for i := 0; i < len(data); i++ {
+		if _, err := DecodeBinary(data[:i]); err == nil {
+			t.Fatalf("%d of %d bytes decoded", i, len(data))
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	good := []struct {
+		message string
+		command Command
+	}{
+		{"12:mv:nsew0", Command{12, CmdMove, "nsew0"}},
+		{"12:MV:n", Command{12, CmdMove, "n"}},
+		{"1:mv:", Command{1, CmdMove, ""}},
+		{"1:mv:" + strings.Repeat("e", MaxMoves), Command{1, CmdMove, strings.Repeat("e", MaxMoves)}},
+		{"1:ch:hello: there", Command{1, CmdChat, "hello: there"}},
+		{"1:ch:" + strings.Repeat("x", MaxChat), Command{1, CmdChat, strings.Repeat("x", MaxChat)}},
+		{"1:bl:0", Command{1, CmdBlur, "0"}},
+		{"1:bl:1", Command{1, CmdBlur, "1"}},
+		{"1:li:", Command{1, CmdLifeCell, ""}},
+		{"1:al:", Command{1, CmdLifeActivate, ""}},
+		{"1:in:", Command{1, CmdInteract, ""}},
+		{"1:reconnect:abc-DEF_123", Command{1, CmdReconnect, "abc-DEF_123"}},
+		{"1:reconnect:" + strings.Repeat("a", MaxToken), Command{1, CmdReconnect, strings.Repeat("a", MaxToken)}},
+		{"1:speed:0", Command{1, CmdSpeed, "0"}},
+		{"1:speed:2.5", Command{1, CmdSpeed, "2.5"}},
+		{fmt.Sprintf("1:speed:%d", MaxSpeed), Command{1, CmdSpeed, fmt.Sprint(MaxSpeed)}},
+	}
+	for _, test := range good {
+		command, err := ParseCommand([]byte(test.message))
+		if err != nil || command != test.command {
+			t.Errorf("%.40q: got %v, %v", test.message, command, err)
+		}
+	}
+
+	bad := []struct {
+		why     string
+		message string
+	}{
+		{"no colons", "nocolon"},
+		{"one colon", "1:mv"},
+		{"no timestamp", ":mv:n"},
+		{"bad timestamp", "x:mv:n"},
+		{"negative timestamp", "-1:mv:n"},
+		{"bad move", "1:mv:q"},
+		{"too many moves", "1:mv:" + strings.Repeat("e", MaxMoves+1)},
+		{"chat too long", "1:ch:" + strings.Repeat("x", MaxChat+1)},
+		{"blur 2", "1:bl:2"},
+		{"blur empty", "1:bl:"},
+		{"blur word", "1:bl:true"},
+		{"empty token", "1:reconnect:"},
+		{"token with a space", "1:reconnect:no pe"},
+		{"token with padding", "1:reconnect:abc="},
+		{"token too long", "1:reconnect:" + strings.Repeat("a", MaxToken+1)},
+		{"speed over the limit", fmt.Sprintf("1:speed:%d", MaxSpeed+1)},
+		{"negative speed", "1:speed:-1"},
+		{"speed not a number", "1:speed:fast"},
+		{"unknown command", "1:zz:"},
+		{"empty command", "1::"},
+	}
+	for _, test := range bad {
+		if command, err := ParseCommand([]byte(test.message)); err == nil {
+			t.Errorf("%s: accepted as %v", test.why, command)
+		}
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	command := Command{Timestamp: 42, Type: CmdChat, Data: "a:b"}
+	parsed, err := ParseCommand([]byte(command.String()))
+	if err != nil || parsed != command {
+		t.Fatalf("%q parsed as %v, %v", command.String(), parsed, err)
+	}
+}
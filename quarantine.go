@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sort"
+)
+
+/*
+The grid code relies on invariants, such as an entity being in the SubGrid
+that moves it. When a bug elsewhere breaks one, the grid quarantines what
+it caught instead of taking the server down. The SubGrid stops stepping,
+so nothing in it moves and its life stops, and nothing can walk into it.
+Players in it still get displays, and are told the area has frozen. The
+admin API reports quarantined SubGrids and the entities that put them
+there.
+
+A panic in a SubGrid's goroutine, or while the serial phase drains its
+queues, quarantines the SubGrid the same way, with the stack in the log.
+The rest of the world keeps ticking.
+
+A quarantined SubGrid stays frozen until the admin API releases it as it
+is, or rebuilds it: its players are put back in a fresh SubGrid and
+everything else in it is dropped. The server rebuilds it itself once it
+has been frozen for quarantine_rebuild.
+*/
+
+// What the players in a SubGrid are told when it freezes
+const frozenMessage = "Something went wrong here. This area is frozen until it is repaired."
+
+// quarantine stops the SubGrid over an invariant ntt broke. Called from
+// the SubGrid's own goroutine in ParallelExec, or from the serial phases.
+func (self *SubGrid) quarantine(ntt Entity, reason string, attrs ...slog.Attr) {
+	args := []interface{}{tickAttr(self.parent.tick), "subgrid", self.GridCoord, "entity", ntt.EntityID(), "reason", reason}
+	for _, attr := range attrs {
+		args = append(args, attr)
+	}
+	worldLog.Error("invariant broken; subgrid quarantined", args...)
+	self.freeze(reason, ntt.EntityID())
+}
+
+// freeze marks the SubGrid quarantined, and reports whether it wasn't
+// already. The players in one SubGrid get their displays in parallel, so
+// it locks.
+func (self *SubGrid) freeze(reason string, suspect EntityID) bool {
+	self.quarantineMutex.Lock()
+	defer self.quarantineMutex.Unlock()
+	first := self.quarantined == ""
+	if first {
+		self.quarantined = reason
+		self.frozenAt = self.parent.tick
+	}
+	if suspect != (EntityID{}) {
+		self.suspects = append(self.suspects, suspect)
+	}
+	return first
+}
+
+/*
+recoverPanic quarantines the SubGrid over a panic in work done on it. It
+has to be deferred itself, for recover to see the panic. ntt is the
+entity the work was for, if there was one; otherwise the SubGrid's
+stepping says which one it was on.
+*/
+func (self *SubGrid) recoverPanic(ntt Entity) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	suspect := self.stepping
+	if ntt != nil {
+		suspect = ntt.EntityID()
+	}
+	reason := fmt.Sprintf("panic: %v", r)
+	if !self.freeze(reason, suspect) {
+		// Its players' displays may keep failing until it is repaired
+		worldLog.Debug("panic in a quarantined subgrid", tickAttr(self.parent.tick),
+			"subgrid", self.GridCoord, "entity", suspect, "reason", reason)
+		return
+	}
+	worldLog.Error("panic; subgrid quarantined", tickAttr(self.parent.tick),
+		"subgrid", self.GridCoord, "entity", suspect, "reason", reason,
+		"entities", len(self.Entities), "players", self.PlayerCount,
+		"life", self.lifeActive, "stack", string(debug.Stack()))
+}
+
+// quarantine stops the SubGrid ntt is at, for invariants the WorldGrid
+// keeps
+func (self *WorldGrid) quarantine(ntt Entity, reason string, attrs ...slog.Attr) {
+	self.subgridAtGrid(ntt.Coord().Grid(self)).quarantine(ntt, reason, attrs...)
+}
+
+func (self *SubGrid) Quarantined() bool {
+	return self.quarantined != ""
+}
+
+// quarantinedAt reports whether loc is in a quarantined SubGrid
+func (self *WorldGrid) quarantinedAt(loc Coord) bool {
+	subgrid := self.safeSubgridAtGrid(loc.Grid(self))
+	return subgrid != nil && subgrid.Quarantined()
+}
+
+// noticeFrozen tells the players in SubGrids that froze this tick
+func (self *WorldGrid) noticeFrozen() {
+	for _, gcoord := range self.gridCoords() {
+		subgrid := self.grid[gcoord]
+		if !subgrid.Quarantined() || subgrid.frozenNoticed {
+			continue
+		}
+		subgrid.frozenNoticed = true
+		for _, ntt := range subgrid.Entities {
+			if ntt.IsPlayer() {
+				ntt.AddMessage(frozenMessage)
+			}
+		}
+	}
+}
+
+// release lets a quarantined SubGrid step again, as it is
+func (self *SubGrid) release() {
+	self.quarantined = ""
+	self.suspects = nil
+	self.frozenNoticed = false
+	for _, ntt := range self.Entities {
+		if ntt.IsPlayer() {
+			ntt.AddMessage("This area has been repaired.")
+		}
+	}
+}
+
+/*
+rebuildSubgrid replaces the SubGrid at gcoord with a fresh one. Its
+players are put back where they were, and get a whole map; everything
+else in it is dropped. Its queues are dropped with it.
+*/
+func (self *WorldGrid) rebuildSubgrid(gcoord GridCoord) {
+	old := self.grid[gcoord]
+	ids := make([]EntityID, 0, len(old.Entities))
+	for id, _ := range old.Entities {
+		ids = append(ids, id)
+	}
+	sort.Sort(SortableIDs(ids))
+	players := make([]Entity, 0, old.PlayerCount)
+	for _, id := range ids {
+		ntt := old.Entities[id]
+		old.RemoveEntityID(id)
+		delete(self.entityGrid, id)
+		if ntt.IsPlayer() {
+			players = append(players, ntt)
+		}
+	}
+	// Entities the old SubGrid lost track of
+	for id, gc := range self.entityGrid {
+		if gc == gcoord {
+			delete(self.entityGrid, id)
+		}
+	}
+	delete(self.grid, gcoord)
+	self.subgridAtGrid(gcoord)
+	for _, player := range players {
+		self.PutEntityAt(player, player.Coord())
+		player.SetInitialized(false)
+		player.AddMessage("This area has been rebuilt.")
+	}
+	worldLog.Info("subgrid rebuilt", tickAttr(self.tick), "subgrid", gcoord,
+		"dropped", len(ids)-len(players), "players", len(players))
+}
+
+// applyRepair releases or rebuilds a SubGrid, for applyChange
+func applyRepair(world *WorldGrid, change adminChange) error {
+	subgrid := world.safeSubgridAtGrid(change.gcoord)
+	if subgrid == nil {
+		return adminErrorf(http.StatusNotFound, "no subgrid %v", change.gcoord)
+	}
+	if change.op == adminRelease {
+		if !subgrid.Quarantined() {
+			return adminErrorf(http.StatusConflict, "%v isn't quarantined", change.gcoord)
+		}
+		subgrid.release()
+		return nil
+	}
+	world.rebuildSubgrid(change.gcoord)
+	return nil
+}
+
+// rebuildFrozen rebuilds the SubGrids that have been quarantined for
+// longer than the config allows. Called once per tick, between ticks.
+func (srv *CstServer) rebuildFrozen() {
+	if srv.playback != nil || srv.config.QuarantineRebuild <= 0 {
+		return
+	}
+	ticks := uint64(srv.config.QuarantineRebuild.Seconds() * float64(ticksPerSec))
+	for _, gcoord := range srv.world.gridCoords() {
+		subgrid := srv.world.grid[gcoord]
+		if !subgrid.Quarantined() || srv.tickNumber-subgrid.frozenAt < ticks {
+			continue
+		}
+		if err := srv.change(adminChange{op: adminRebuild, gcoord: gcoord}); err != nil {
+			worldLog.Error("rebuilding a quarantined subgrid", "subgrid", gcoord, "err", err)
+		}
+	}
+}
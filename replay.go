@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"sort"
+	"time"
+)
+
+/*
+A replay log is a header followed by records. Each record is a kind byte
+and its fields as varints; entity IDs are 16 raw bytes. Everything from
+one Tick record up to the next happened in that tick, in order. Records
+before the first Tick are from world creation.
+*/
+const replayHeader = "ROTCS replay 1\n"
+
+const recTick = 'T'   // tick
+const recSeed = 'S'   // kind, grid x, grid y, seed
+const recJoin = 'J'   // id, x, y
+const recLeave = 'L'  // id
+const recDrop = 'D'   // id
+const recResume = 'R' // id
+const recInput = 'I'  // id, flags, blurred, move count, (direction, timestamp)...
+const recDigest = 'H' // digest of the world at the end of the tick
+const recAdmin = 'A'  // admin change: op, then its fields (see Admin)
+
+// A digest of the world is recorded this often, so playback can tell when
+// it stops matching the recording
+var digestTicks = ticksPerSec
+
+var ErrBadReplay = errors.New("replay: malformed log")
+
+type replayRecord struct {
+	kind     byte
+	tick     uint64
+	id       EntityID
+	loc      Coord
+	seed     int64
+	seedKind uint8
+	gcoord   GridCoord
+	input    playerInput
+	digest   uint64
+	change   adminChange
+}
+
+/*
+ReplayRecorder writes the replay log, each entry against its tick: every
+RNG seed, every player joining, leaving, dropping and resuming, every
+input a player's client sent and every change made through the admin
+API. That is enough to re-simulate the world.
+
+All methods are no-ops on a nil recorder, so the server calls them
+without checking whether it records. Only runLoop uses it. The first
+write error is logged and ends the recording.
+*/
+type ReplayRecorder struct {
+	out     *bufio.Writer
+	scratch []byte
+	varbuf  [binary.MaxVarintLen64]byte
+	err     error
+}
+
+func NewReplayRecorder(w io.Writer) *ReplayRecorder {
+	recorder := &ReplayRecorder{
+		out:     bufio.NewWriter(w),
+		scratch: make([]byte, 0, 64),
+	}
+	recorder.out.WriteString(replayHeader)
+	return recorder
+}
+
+func (self *ReplayRecorder) uvarint(x uint64) {
+	n := binary.PutUvarint(self.varbuf[:], x)
+	self.scratch = append(self.scratch, self.varbuf[:n]...)
+}
+
+func (self *ReplayRecorder) varint(x int64) {
+	n := binary.PutVarint(self.varbuf[:], x)
+	self.scratch = append(self.scratch, self.varbuf[:n]...)
+}
+
+func (self *ReplayRecorder) begin(kind byte) {
+	self.scratch = append(self.scratch[:0], kind)
+}
+
+func (self *ReplayRecorder) end() {
+	if self.err != nil {
+		return
+	}
+	if _, err := self.out.Write(self.scratch); err != nil {
+		self.fail(err)
+	}
+}
+
+func (self *ReplayRecorder) fail(err error) {
+	self.err = err
+	replayLog.Error("recording stopped", "err", err)
+}
+
+func (self *ReplayRecorder) entity(kind byte, id EntityID) {
+	if self == nil {
+		return
+	}
+	self.begin(kind)
+	self.scratch = append(self.scratch, id[:]...)
+	self.end()
+}
+
+func (self *ReplayRecorder) Tick(tick uint64) {
+	if self == nil {
+		return
+	}
+	self.begin(recTick)
+	self.uvarint(tick)
+	self.end()
+}
+
+func (self *ReplayRecorder) Seed(kind uint8, gcoord GridCoord, seed int64) {
+	if self == nil {
+		return
+	}
+	self.begin(recSeed)
+	self.scratch = append(self.scratch, kind)
+	self.varint(gcoord.x)
+	self.varint(gcoord.y)
+	self.varint(seed)
+	self.end()
+}
+
+func (self *ReplayRecorder) Join(id EntityID, loc Coord) {
+	if self == nil {
+		return
+	}
+	self.begin(recJoin)
+	self.scratch = append(self.scratch, id[:]...)
+	self.varint(loc.x)
+	self.varint(loc.y)
+	self.end()
+}
+
+func (self *ReplayRecorder) Leave(id EntityID)  { self.entity(recLeave, id) }
+func (self *ReplayRecorder) Drop(id EntityID)   { self.entity(recDrop, id) }
+func (self *ReplayRecorder) Resume(id EntityID) { self.entity(recResume, id) }
+
+func (self *ReplayRecorder) Input(id EntityID, input playerInput) {
+	if self == nil {
+		return
+	}
+	self.begin(recInput)
+	self.scratch = append(self.scratch, id[:]...)
+	self.uvarint(input.flags)
+	self.scratch = append(self.scratch, bool2byte(input.blurred))
+	self.uvarint(uint64(len(input.moves)))
+	for _, mv := range input.moves {
+		self.scratch = append(self.scratch, byte(mv.direction))
+		self.uvarint(mv.timestamp)
+	}
+	self.end()
+}
+
+// Admin records a change made through the admin API. Teleports are the
+// entity and where to; health changes the entity and its new health;
+// spawns the archetype's name and where; life changes the subgrid and
+// whether life is allowed and active there; releases and rebuilds the
+// subgrid.
+func (self *ReplayRecorder) Admin(change adminChange) {
+	if self == nil {
+		return
+	}
+	self.begin(recAdmin)
+	self.scratch = append(self.scratch, change.op)
+	switch change.op {
+	case adminTeleport:
+		self.scratch = append(self.scratch, change.id[:]...)
+		self.varint(change.loc.x)
+		self.varint(change.loc.y)
+	case adminHealth:
+		self.scratch = append(self.scratch, change.id[:]...)
+		self.varint(int64(change.health))
+	case adminSpawn:
+		self.uvarint(uint64(len(change.archetype)))
+		self.scratch = append(self.scratch, change.archetype...)
+		self.varint(change.loc.x)
+		self.varint(change.loc.y)
+	case adminLife:
+		self.varint(change.gcoord.x)
+		self.varint(change.gcoord.y)
+		self.scratch = append(self.scratch, bool2byte(change.allowed), bool2byte(change.active))
+	case adminGod:
+		self.scratch = append(self.scratch, change.id[:]...)
+		self.scratch = append(self.scratch, bool2byte(change.active))
+	case adminGameplay:
+		self.varint(int64(change.detection))
+		self.varint(int64(change.tries))
+	case adminRelease, adminRebuild:
+		self.varint(change.gcoord.x)
+		self.varint(change.gcoord.y)
+	}
+	self.end()
+}
+
+func (self *ReplayRecorder) Digest(digest uint64) {
+	if self == nil {
+		return
+	}
+	self.begin(recDigest)
+	self.uvarint(digest)
+	self.end()
+}
+
+// Flush ends a tick. Ticks are flushed whole, so a crash loses at most
+// the tick in progress.
+func (self *ReplayRecorder) Flush() {
+	if self == nil || self.err != nil {
+		return
+	}
+	if err := self.out.Flush(); err != nil {
+		self.fail(err)
+	}
+}
+
+// RecordingSeeds takes seeds from source and records them
+type RecordingSeeds struct {
+	source   SeedSource
+	recorder *ReplayRecorder
+}
+
+func NewRecordingSeeds(source SeedSource, recorder *ReplayRecorder) *RecordingSeeds {
+	return &RecordingSeeds{source: source, recorder: recorder}
+}
+
+func (self *RecordingSeeds) Seed(kind uint8, gcoord GridCoord) int64 {
+	seed := self.source.Seed(kind, gcoord)
+	self.recorder.Seed(kind, gcoord, seed)
+	return seed
+}
+
+// recordInput records the inputs that change something. Blur state is
+// recorded when it changes.
+func (srv *CstServer) recordInput(player *Player, input playerInput) {
+	if len(input.moves) > 0 || input.flags != 0 || input.blurred != player.blurred {
+		srv.recorder.Input(player.EntityID(), input)
+	}
+}
+
+// Digest hashes every entity's ID, position and health, in ID order
+func (self *WorldGrid) Digest() uint64 {
+	entities := make([]Entity, 0, len(self.entityGrid))
+	for _, subgrid := range self.grid {
+		for _, ntt := range subgrid.Entities {
+			entities = append(entities, ntt)
+		}
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		a, b := entities[i].EntityID(), entities[j].EntityID()
+		return string(a[:]) < string(b[:])
+	})
+	hash := fnv.New64a()
+	var buf [3 * binary.MaxVarintLen64]byte
+	for _, ntt := range entities {
+		id := ntt.EntityID()
+		hash.Write(id[:])
+		n := binary.PutVarint(buf[:], ntt.Coord().x)
+		n += binary.PutVarint(buf[n:], ntt.Coord().y)
+		n += binary.PutVarint(buf[n:], int64(ntt.Health()))
+		hash.Write(buf[:n])
+	}
+	return hash.Sum64()
+}
+
+// replayReader reads records back
+type replayReader struct {
+	in *bufio.Reader
+}
+
+func (self *replayReader) id() (EntityID, error) {
+	var id EntityID
+	_, err := io.ReadFull(self.in, id[:])
+	return id, err
+}
+
+func (self *replayReader) coord() (int64, int64, error) {
+	x, err := binary.ReadVarint(self.in)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := binary.ReadVarint(self.in)
+	return x, y, err
+}
+
+// Next returns the next record, or io.EOF at a clean end of the log
+func (self *replayReader) Next() (replayRecord, error) {
+	var rec replayRecord
+	kind, err := self.in.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	rec.kind = kind
+	switch kind {
+	case recTick:
+		rec.tick, err = binary.ReadUvarint(self.in)
+	case recSeed:
+		if rec.seedKind, err = self.in.ReadByte(); err != nil {
+			break
+		}
+		if rec.gcoord.x, rec.gcoord.y, err = self.coord(); err != nil {
+			break
+		}
+		rec.seed, err = binary.ReadVarint(self.in)
+	case recJoin:
+		if rec.id, err = self.id(); err != nil {
+			break
+		}
+		rec.loc.x, rec.loc.y, err = self.coord()
+	case recLeave, recDrop, recResume:
+		rec.id, err = self.id()
+	case recInput:
+		err = self.readInput(&rec)
+	case recDigest:
+		rec.digest, err = binary.ReadUvarint(self.in)
+	case recAdmin:
+		err = self.readChange(&rec.change)
+	default:
+		return rec, ErrBadReplay
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return rec, err
+}
+
+func (self *replayReader) readInput(rec *replayRecord) error {
+	var err error
+	if rec.id, err = self.id(); err != nil {
+		return err
+	}
+	if rec.input.flags, err = binary.ReadUvarint(self.in); err != nil {
+		return err
+	}
+	blurred, err := self.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	rec.input.blurred = blurred != 0
+	count, err := binary.ReadUvarint(self.in)
+	if err != nil {
+		return err
+	}
+	if count > 64*1024 {
+		return ErrBadReplay
+	}
+	rec.input.moves = make([]moveRequest, count)
+	for i := range rec.input.moves {
+		direction, err := self.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		rec.input.moves[i].direction = rune(direction)
+		if rec.input.moves[i].timestamp, err = binary.ReadUvarint(self.in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *replayReader) readChange(change *adminChange) error {
+	var err error
+	if change.op, err = self.in.ReadByte(); err != nil {
+		return err
+	}
+	switch change.op {
+	case adminTeleport:
+		if change.id, err = self.id(); err != nil {
+			return err
+		}
+		change.loc.x, change.loc.y, err = self.coord()
+	case adminHealth:
+		if change.id, err = self.id(); err != nil {
+			return err
+		}
+		var health int64
+		health, err = binary.ReadVarint(self.in)
+		change.health = int(health)
+	case adminSpawn:
+		var length uint64
+		if length, err = binary.ReadUvarint(self.in); err != nil {
+			return err
+		}
+		if length > 256 {
+			return ErrBadReplay
+		}
+		name := make([]byte, length)
+		if _, err = io.ReadFull(self.in, name); err != nil {
+			return err
+		}
+		change.archetype = string(name)
+		change.loc.x, change.loc.y, err = self.coord()
+	case adminLife:
+		if change.gcoord.x, change.gcoord.y, err = self.coord(); err != nil {
+			return err
+		}
+		var flags [2]byte
+		_, err = io.ReadFull(self.in, flags[:])
+		change.allowed, change.active = flags[0] != 0, flags[1] != 0
+	case adminGod:
+		if change.id, err = self.id(); err != nil {
+			return err
+		}
+		var flag byte
+		flag, err = self.in.ReadByte()
+		change.active = flag != 0
+	case adminGameplay:
+		var detection, tries int64
+		if detection, err = binary.ReadVarint(self.in); err != nil {
+			return err
+		}
+		tries, err = binary.ReadVarint(self.in)
+		change.detection, change.tries = int(detection), int(tries)
+	case adminRelease, adminRebuild:
+		change.gcoord.x, change.gcoord.y, err = self.coord()
+	default:
+		return ErrBadReplay
+	}
+	return err
+}
+
+// replaySeeds hands back recorded seeds for each RNG in the order they
+// were recorded. An RNG the recording never seeded gets a clock seed;
+// that only happens once playback has diverged.
+type replaySeeds struct {
+	seeds map[seedKey][]int64
+}
+
+func (self *replaySeeds) push(kind uint8, gcoord GridCoord, seed int64) {
+	key := seedKey{kind, gcoord}
+	self.seeds[key] = append(self.seeds[key], seed)
+}
+
+func (self *replaySeeds) Seed(kind uint8, gcoord GridCoord) int64 {
+	key := seedKey{kind, gcoord}
+	queue := self.seeds[key]
+	if len(queue) == 0 {
+		replayLog.Warn("no seed in the replay", "kind", kind, "subgrid", gcoord)
+		return time.Now().UnixNano()
+	}
+	if len(queue) == 1 {
+		delete(self.seeds, key)
+	} else {
+		self.seeds[key] = queue[1:]
+	}
+	return queue[0]
+}
+
+/*
+Playback re-simulates a recorded world one tick at a time. It feeds the
+recorded seeds to the world's RNGs, applies the recorded joins, drops
+and inputs to stand-in players and makes the recorded admin changes, then
+runs the tick the way runLoop does.
+Nothing live joins a played-back world; every client watches it as a
+spectator.
+*/
+type Playback struct {
+	reader    replayReader
+	seeds     *replaySeeds
+	next      replayRecord
+	events    []replayRecord
+	players   map[EntityID]*Player
+	digest    uint64
+	hasDigest bool
+	diverged  bool
+	done      bool
+
+	budget     float64
+	speed      float64
+	speedQueue chan float64
+}
+
+// OpenReplay reads the header and the world creation records. The
+// returned Playback's seeds must create the world it plays into.
+func OpenReplay(r io.Reader) (*Playback, error) {
+	in := bufio.NewReader(r)
+	header := make([]byte, len(replayHeader))
+	if _, err := io.ReadFull(in, header); err != nil || string(header) != replayHeader {
+		return nil, ErrBadReplay
+	}
+	playback := &Playback{
+		reader:     replayReader{in: in},
+		seeds:      &replaySeeds{seeds: make(map[seedKey][]int64)},
+		players:    make(map[EntityID]*Player),
+		speed:      1,
+		speedQueue: make(chan float64, 16),
+	}
+	if err := playback.readTick(); err != nil {
+		return nil, err
+	}
+	return playback, nil
+}
+
+func (self *Playback) Seeds() SeedSource {
+	return self.seeds
+}
+
+// SetSpeed may be called from any goroutine
+func (self *Playback) SetSpeed(speed float64) {
+	select {
+	case self.speedQueue <- speed:
+	default:
+	}
+}
+
+// readTick reads the records up to the next Tick record, which is kept in
+// next. Seeds go straight to the seed queues, since the simulation asks
+// for them in the middle of the tick.
+func (self *Playback) readTick() error {
+	self.events = self.events[:0]
+	self.hasDigest = false
+	for {
+		rec, err := self.reader.Next()
+		if err == io.EOF {
+			self.done = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch rec.kind {
+		case recTick:
+			self.next = rec
+			return nil
+		case recSeed:
+			self.seeds.push(rec.seedKind, rec.gcoord, rec.seed)
+		case recDigest:
+			self.digest = rec.digest
+			self.hasDigest = true
+		default:
+			self.events = append(self.events, rec)
+		}
+	}
+}
+
+// join stands in for a recorded client. Its connection's frames are
+// thrown away, but it still gets them, since building them is where
+// Monsters detect players.
+func (self *Playback) join(srv *CstServer, rec replayRecord) {
+	c := newConnection(nil)
+	go c.discard()
+	player := NewPlayer(c, srv.world, srv.world.offsets)
+	entity, _ := srv.world.NewEntity(player)
+	c.setPlayer(entity.EntityID(), player)
+	srv.connections[c] = c.id
+	self.players[rec.id] = player
+	if entity.Coord() != rec.loc {
+		self.divergedAt(srv.tickNumber, "join position")
+	}
+}
+
+func (self *Playback) leave(srv *CstServer, player *Player) {
+	srv.world.RemoveEntityID(player.EntityID())
+	delete(srv.connections, player.Connection)
+	player.Connection.hangUp()
+}
+
+func (self *Playback) divergedAt(tick uint64, what string) {
+	if !self.diverged {
+		self.diverged = true
+		replayLog.Warn("diverged from the recording", tickAttr(tick), "what", what)
+	}
+}
+
+// Step simulates the next recorded tick. It returns false at the end of
+// the log.
+func (self *Playback) Step(srv *CstServer) bool {
+	if self.done {
+		return false
+	}
+	srv.tickNumber = self.next.tick
+	if err := self.readTick(); err != nil {
+		replayLog.Error("replay ends early", tickAttr(srv.tickNumber), "err", err)
+		self.done = true
+	}
+	for _, rec := range self.events {
+		if rec.kind == recJoin {
+			self.join(srv, rec)
+			continue
+		}
+		if rec.kind == recAdmin {
+			if err := applyChange(srv.world, rec.change); err != nil {
+				self.divergedAt(srv.tickNumber, "admin change: "+err.Error())
+			}
+			continue
+		}
+		player, present := self.players[rec.id]
+		if !present {
+			self.divergedAt(srv.tickNumber, "unknown player")
+			continue
+		}
+		switch rec.kind {
+		case recLeave:
+			self.leave(srv, player)
+			delete(self.players, rec.id)
+		case recDrop:
+			player.dropped = true
+		case recResume:
+			player.dropped = false
+			player.SetInitialized(false)
+		case recInput:
+			player.applyInput(rec.input)
+		}
+	}
+
+	srv.world.Step(srv)
+	if srv.tickNumber%ticksPerSec == 0 {
+		srv.population = srv.world.playerCount()
+	}
+
+	if self.hasDigest && srv.world.Digest() != self.digest {
+		self.divergedAt(srv.tickNumber, "world digest")
+	}
+	return true
+}
+
+// playbackLoop replaces runLoop when the server plays a replay. Spectator
+// frames go out at the normal tick rate; the speed decides how many
+// recorded ticks pass between them.
+func (srv *CstServer) playbackLoop() {
+	playback := srv.playback
+	finished := false
+	for {
+		startTime := srv.clock.Now()
+	dropped:
+		for {
+			select {
+			case c := <-srv.droppedQueue:
+				srv.dropConnection(c, startTime)
+			default:
+				break dropped
+			}
+		}
+	register:
+		for {
+			select {
+			case c := <-srv.register:
+				srv.registerConnection(c)
+			default:
+				break register
+			}
+		}
+		srv.runAdminCommands()
+		srv.stepShutdown()
+		if srv.stopped() {
+			srv.finish()
+			return
+		}
+	speed:
+		for {
+			select {
+			case playback.speed = <-playback.speedQueue:
+			default:
+				break speed
+			}
+		}
+
+		playback.budget += playback.speed
+		for playback.budget >= 1 {
+			playback.budget--
+			if !playback.Step(srv) {
+				playback.budget = 0
+				if !finished {
+					finished = true
+					replayLog.Info("replay finished", tickAttr(srv.tickNumber))
+					for _, spectator := range srv.spectators {
+						spectator.AddMessage("Replay finished")
+					}
+				}
+			}
+		}
+		srv.updateSpectators()
+		srv.sendSpectatorDisplays()
+
+		tickDuration := srv.clock.Now().Sub(startTime).Seconds()
+		if tickDuration < tickSecs {
+			time.Sleep(time.Duration((tickSecs-tickDuration)*1000) * time.Millisecond)
+		}
+	}
+}
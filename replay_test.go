@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingHarness is a Harness whose server records to log
+func recordingHarness(seed int64, log *bytes.Buffer) *Harness {
+	recorder := NewReplayRecorder(log)
+	config := DefaultServerConfig()
+	config.Seed = seed
+	srv := NewCstServer(config, NewRecordingSeeds(NewWorldSeed(seed), recorder))
+	srv.recorder = recorder
+	clock := NewManualClock(time.Unix(0, 0))
+	srv.clock = clock
+	return &Harness{
+		Clock:  clock,
+		Server: srv,
+		World:  srv.world,
+	}
+}
+
+// TestReplayRoundTrip records players walking about and an admin change,
+// plays the log back and checks the world matches at every digest. An
+// admin command that would change the replayed world is refused.
+func TestReplayRoundTrip(t *testing.T) {
+	var log bytes.Buffer
+	h := recordingHarness(5, &log)
+	var players []*Player
+	for i := 0; i < 3; i++ {
+		c := newConnection(nil)
+		h.Server.register <- c
+		h.Run(1)
+		if c.player == nil {
+			t.Fatal("player not admitted")
+		}
+		players = append(players, c.player)
+		h.Script(c.player, strings.Repeat("nneessww", 5))
+	}
+	const ticks = 40
+	h.Run(ticks / 2)
+	change := adminChange{op: adminHealth, id: players[0].EntityID(), health: 1}
+	if err := h.Server.change(change); err != nil {
+		t.Fatal(err)
+	}
+	h.Run(ticks / 2)
+	want := h.World.Digest()
+
+	playback, err := OpenReplay(bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewCstServer(DefaultServerConfig(), playback.Seeds())
+	srv.playback = playback
+	srv.clock = NewManualClock(time.Unix(0, 0))
+	digests := 0
+	for playback.Step(srv) {
+		if playback.hasDigest {
+			digests++
+		}
+		if srv.tickNumber == ticks/2 {
+			kick := adminCommand{
+				run: func(srv *CstServer) (interface{}, error) {
+					srv.kick(players[1].Connection)
+					return adminOK, nil
+				},
+				reply:   make(chan adminReply, 1),
+				mutates: true,
+			}
+			srv.adminQueue <- kick
+			srv.runAdminCommands()
+			reply := <-kick.reply
+			if err, ok := reply.err.(*adminError); !ok || err.status != http.StatusConflict {
+				t.Fatalf("kick during a replay answered %v", reply.err)
+			}
+		}
+	}
+	if digests == 0 {
+		t.Fatal("no digests recorded")
+	}
+	if playback.diverged {
+		t.Fatal("playback diverged from the recording")
+	}
+	if got := srv.world.Digest(); got != want {
+		t.Fatalf("played back world %x, recorded %x", got, want)
+	}
+}
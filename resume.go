@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"html/template"
+	"time"
+
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// maxMissedMessages bounds what a dropped player keeps for replay
+const maxMissedMessages = 100
+
+// resumeMACSize is how much of the HMAC a token carries
+const resumeMACSize = 16
+
+// resumePayloadSize is the entity ID, the nonce and when it was issued
+const resumePayloadSize = len(EntityID{}) + 8 + 8
+
+// resumeTokenLife is how long a token is good for. Each resume issues a
+// new one, so only a player who stays connected longer has to start over
+// after a drop.
+const resumeTokenLife = 24 * time.Hour
+
+/*
+ResumeSigner issues and checks resume tokens. A token is the entity ID,
+a nonce and the time it was issued, followed by a truncated HMAC-SHA256
+of them, so a client can only resume the player it was given. The player
+keeps the nonce of its newest token; a resume changes it, so each token
+can be used once. The key is random per process; players don't outlive
+the process either.
+*/
+type ResumeSigner struct {
+	key []byte
+}
+
+// resumeClaim is what a valid token says
+type resumeClaim struct {
+	id     EntityID
+	nonce  uint64
+	issued time.Time
+}
+
+// newResumeNonce draws a nonce for a player's next token
+func newResumeNonce() uint64 {
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		panic("no entropy for a resume nonce: " + err.Error())
+	}
+	return binary.BigEndian.Uint64(raw[:])
+}
+
+func NewResumeSigner() *ResumeSigner {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic("no entropy for the resume key: " + err.Error())
+	}
+	return &ResumeSigner{key: key}
+}
+
+func (self *ResumeSigner) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:resumeMACSize]
+}
+
+func (self *ResumeSigner) Token(id EntityID, nonce uint64, now time.Time) string {
+	raw := make([]byte, 0, resumePayloadSize+resumeMACSize)
+	raw = append(raw, id[:]...)
+	raw = binary.BigEndian.AppendUint64(raw, nonce)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(now.Unix()))
+	raw = append(raw, self.mac(raw)...)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Verify checks the token was signed here and hasn't expired. Whether
+// its nonce is still the player's is up to the caller.
+func (self *ResumeSigner) Verify(token string, now time.Time) (resumeClaim, bool) {
+	var claim resumeClaim
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != resumePayloadSize+resumeMACSize {
+		return claim, false
+	}
+	payload := raw[:resumePayloadSize]
+	if !hmac.Equal(raw[resumePayloadSize:], self.mac(payload)) {
+		return claim, false
+	}
+	copy(claim.id[:], payload)
+	claim.nonce = binary.BigEndian.Uint64(payload[len(claim.id):])
+	claim.issued = time.Unix(int64(binary.BigEndian.Uint64(payload[len(claim.id)+8:])), 0)
+	return claim, now.Sub(claim.issued) < resumeTokenLife
+}
+
+// issueToken gives the player a new nonce and signs a token for it. Any
+// token it had stops working.
+func (srv *CstServer) issueToken(player *Player) string {
+	player.resumeNonce = newResumeNonce()
+	return srv.resumeSigner.Token(player.EntityID(), player.resumeNonce, srv.clock.Now())
+}
+
+// dropConnection parks a closed connection's player until it is resumed
+// or the grace period runs out. Only called from runLoop.
+func (srv *CstServer) dropConnection(c *connection, now time.Time) {
+	if c.spectator != nil {
+		delete(srv.spectators, c)
+		c.hangUp()
+		return
+	}
+	if c.player == nil {
+		srv.admission.Remove(c)
+		c.hangUp()
+		return
+	}
+	if _, present := srv.connections[c]; !present {
+		// Kicked, or taken over by a resume
+		c.hangUp()
+		return
+	}
+	c.droppedAt = now
+	c.player.dropped = true
+	srv.metrics.CountDropped()
+	srv.recorder.Drop(c.id)
+	srv.dropped[c.id] = c
+}
+
+// expireDropped unregisters players whose clients didn't come back in
+// time
+func (srv *CstServer) expireDropped(now time.Time) {
+	for id, c := range srv.dropped {
+		if now.Sub(c.droppedAt) > srv.config.ResumeGrace {
+			logTrace(netLog, "resume grace over", "entity", id)
+			delete(srv.dropped, id)
+			srv.unregister <- c
+		}
+	}
+}
+
+// liveConnection finds the open connection that owns id, if any
+func (srv *CstServer) liveConnection(id EntityID, except *connection) (*connection, bool) {
+	for c, cid := range srv.connections {
+		if cid == id && c != except {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+/*
+resume answers a reconnect command. Clients send it as soon as they
+connect, so it can beat the connection's registration; then it is left
+for registerConnection. A client whose player is gone but whose token is
+good still goes ahead of new arrivals in the admission queue.
+*/
+func (srv *CstServer) resume(rc reconnect) {
+	if rc.newConn.hungUp {
+		return
+	}
+	if !rc.newConn.registered {
+		rc.newConn.resumeToken = rc.token
+		return
+	}
+	claim, valid := srv.resumeSigner.Verify(rc.token, srv.clock.Now())
+	if valid && srv.takeSession(claim, rc.newConn) {
+		return
+	}
+	srv.refuseResume(rc.newConn)
+	if valid && srv.admission.Remove(rc.newConn) {
+		srv.admission.Push(rc.newConn, laneResume)
+		srv.notifyQueue(false)
+	}
+}
+
+func (srv *CstServer) refuseResume(c *connection) {
+	netLog.Info("resume refused", "conn", c)
+	var buffer bytes.Buffer
+	frame := protocol.Resume{Approved: false}
+	protocol.Encode(c.codec, &frame, &buffer)
+	c.queue(buffer.Bytes())
+}
+
+/*
+takeSession hands the claimed player to newConn if it is dropped and
+waiting. Any player the new connection got at registration is discarded.
+A client can come back before its old socket times out; then the old
+connection is closed and taken over. Either way the token has to be the
+player's newest, and it is used up.
+*/
+func (srv *CstServer) takeSession(claim resumeClaim, newConn *connection) bool {
+	oldConn, dropped := srv.dropped[claim.id]
+	if !dropped {
+		var live bool
+		oldConn, live = srv.liveConnection(claim.id, newConn)
+		if !live {
+			return false
+		}
+	}
+	if oldConn.player.resumeNonce != claim.nonce {
+		logTrace(netLog, "stale resume token", "entity", claim.id, "issued", claim.issued)
+		return false
+	}
+	if !dropped {
+		oldConn.cancel()
+	}
+	delete(srv.dropped, claim.id)
+	if newConn.player != nil {
+		srv.world.RemoveEntityID(newConn.id)
+		srv.recorder.Leave(newConn.id)
+	}
+	delete(srv.connections, newConn)
+	srv.admission.Remove(newConn)
+	srv.reconnect(oldConn, newConn)
+
+	var buffer bytes.Buffer
+	frame := protocol.Resume{Approved: true, ID: claim.id, Token: srv.issueToken(newConn.player)}
+	protocol.Encode(newConn.codec, &frame, &buffer)
+	newConn.queue(buffer.Bytes())
+	newConn.player.replayMissed()
+	return true
+}
+
+// missMessage keeps a message for a dropped player's client. It may be
+// called concurrently through ParallelExec(), so the store is a channel.
+func (ntt *Player) missMessage(msg string) {
+	select {
+	case ntt.missed <- msg:
+	default:
+	}
+}
+
+// replayMissed sends what the player missed while dropped, oldest first
+func (ntt *Player) replayMissed() {
+	for {
+		select {
+		case msg := <-ntt.missed:
+			if ntt.Codec() != protocol.CodecBinary {
+				msg = template.HTMLEscapeString(msg)
+			}
+			var buffer bytes.Buffer
+			frame := protocol.Message{Data: msg}
+			protocol.Encode(ntt.Codec(), &frame, &buffer)
+			ntt.Connection.queue(buffer.Bytes())
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+func TestResumeToken(t *testing.T) {
+	signer := NewResumeSigner()
+	id := NewEntityID()
+	now := time.Unix(1000000, 0)
+	token := signer.Token(id, 42, now)
+	claim, valid := signer.Verify(token, now)
+	if !valid || claim.id != id || claim.nonce != 42 || !claim.issued.Equal(now) {
+		t.Fatalf("%q verified as %+v, %v", token, claim, valid)
+	}
+	if _, err := protocol.ParseCommand([]byte("1:reconnect:" + token)); err != nil {
+		t.Fatal(err)
+	}
+	if _, valid := signer.Verify(token, now.Add(resumeTokenLife)); valid {
+		t.Error("expired token accepted")
+	}
+	if _, valid := NewResumeSigner().Verify(token, now); valid {
+		t.Error("another server's token accepted")
+	}
+	tampered := []byte(token)
+	if tampered[20] == 'A' {
+		tampered[20] = 'B'
+	} else {
+		tampered[20] = 'A'
+	}
+	if _, valid := signer.Verify(string(tampered), now); valid {
+		t.Error("tampered token accepted")
+	}
+}
+
+// sentFrames decodes what has been queued for c
+func sentFrames(t *testing.T, c *connection) []protocol.Frame {
+	var frames []protocol.Frame
+	for {
+		select {
+		case message := <-c.send:
+			frame, err := protocol.Decode(c.codec, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+}
+
+// resumed reports whether c was answered with an approved resume, and
+// the token it was given
+func resumed(t *testing.T, c *connection) (bool, string) {
+	for _, frame := range sentFrames(t, c) {
+		if resume, ok := frame.(*protocol.Resume); ok {
+			return resume.Approved, resume.Token
+		}
+	}
+	t.Fatal("no resume frame")
+	return false, ""
+}
+
+// TestResumeRotates resumes a dropped player, then checks each token
+// works once, and only the newest takes over a live connection
+func TestResumeRotates(t *testing.T) {
+	h := NewHarness(1)
+	srv := h.Server
+	first := newConnection(nil)
+	srv.registerConnection(first)
+	var token string
+	for _, frame := range sentFrames(t, first) {
+		if init, ok := frame.(*protocol.Init); ok && init.Approved {
+			token = init.Token
+		}
+	}
+	if token == "" {
+		t.Fatal("not admitted")
+	}
+	player := first.player
+	srv.dropConnection(first, srv.clock.Now())
+
+	second := newConnection(nil)
+	srv.registerConnection(second)
+	srv.resume(reconnect{token, second})
+	approved, next := resumed(t, second)
+	if !approved || second.player != player {
+		t.Fatal("dropped player not resumed")
+	}
+	if next == token {
+		t.Fatal("resume gave back the same token")
+	}
+
+	third := newConnection(nil)
+	srv.registerConnection(third)
+	srv.resume(reconnect{token, third})
+	if approved, _ := resumed(t, third); approved || second.ctx.Err() != nil {
+		t.Fatal("used token took over a live player")
+	}
+
+	// A reconnect command that beats registration is left for it
+	fourth := newConnection(nil)
+	srv.resume(reconnect{next, fourth})
+	srv.registerConnection(fourth)
+	if approved, _ := resumed(t, fourth); !approved || fourth.player != player {
+		t.Fatal("newest token didn't take the player over")
+	}
+	if second.ctx.Err() == nil {
+		t.Fatal("taken over connection still open")
+	}
+}
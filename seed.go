@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+)
+
+// The RNGs a SeedSource seeds. SubGrid seeds also depend on the grid.
+const seedWorld uint8 = 0
+const seedOffset uint8 = 1
+const seedSubGrid uint8 = 2
+const seedIDs uint8 = 3
+
+// SeedSource seeds each RNG the world creates. Everything random in the
+// simulation draws from one of these RNGs, so whoever controls the seeds
+// can reproduce it.
+type SeedSource interface {
+	Seed(kind uint8, gcoord GridCoord) int64
+}
+
+// ClockSeeds seeds from the clock, which is what a live server uses
+type ClockSeeds struct{}
+
+func (self ClockSeeds) Seed(kind uint8, gcoord GridCoord) int64 {
+	return time.Now().UnixNano()
+}
+
+/*
+WorldSeed derives every seed from one number, which makes the world
+deterministic: the same seed and the same inputs give bit-identical
+worlds. Each seed mixes the world seed with the RNG's kind, its grid and
+how many times that RNG has been seeded before, since a SubGrid that is
+culled and comes back gets a new RNG.
+
+Seeds are only asked for in runLoop's serial phases, so it needs no lock.
+*/
+type WorldSeed struct {
+	seed   int64
+	counts map[seedKey]uint64
+}
+
+type seedKey struct {
+	kind   uint8
+	gcoord GridCoord
+}
+
+func NewWorldSeed(seed int64) *WorldSeed {
+	return &WorldSeed{
+		seed:   seed,
+		counts: make(map[seedKey]uint64),
+	}
+}
+
+func (self *WorldSeed) Seed(kind uint8, gcoord GridCoord) int64 {
+	key := seedKey{kind, gcoord}
+	count := self.counts[key]
+	self.counts[key] = count + 1
+	x := mix64(uint64(self.seed) ^ uint64(kind))
+	x = mix64(x ^ uint64(gcoord.x))
+	x = mix64(x ^ uint64(gcoord.y))
+	return int64(mix64(x ^ count))
+}
+
+// mix64 is the SplitMix64 finalizer. Nearby inputs give unrelated outputs.
+func mix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
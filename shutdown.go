@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+/*
+A server stops in one of two ways.
+
+Shutdown stops accepting connections and counts down the grace period,
+sending every client a shutdown frame every shutdownNoticeEvery seconds
+and each of the last shutdownNoticeFinal. The world keeps ticking. When
+the count reaches zero the last tick finishes, the replay log is flushed
+and every connection's send channel is closed, so its writer sends what
+is left and hangs up.
+
+Drain is for rolling restarts. The health check fails, so the load
+balancer sends new clients elsewhere, and anyone who still arrives is
+turned away, but players already in keep playing. Once they have all
+left, or the drain timeout passes, the server shuts down as above, telling
+clients it is restarting so they reconnect.
+
+Both run on the tick goroutine, through the admin queue.
+*/
+
+// Seconds between countdown notices, until the last few, which each get
+// one
+const shutdownNoticeEvery = 10
+const shutdownNoticeFinal = 5
+
+// How long the writers get to send the last frames
+const shutdownFlushWait = 2 * time.Second
+
+// How long past the countdown main waits before it exits regardless
+const shutdownSlack = shutdownFlushWait + 3*time.Second
+
+// Health, as the health check reports it
+const (
+	healthServing int32 = iota
+	healthDraining
+	healthStopping
+)
+
+var healthNames = []string{
+	healthServing:  "serving",
+	healthDraining: "draining",
+	healthStopping: "stopping",
+}
+
+var errStopping = errors.New("the server is shutting down")
+
+type shutdown struct {
+	// Tell clients the server is coming back
+	restart bool
+	// When the countdown ends. Zero while draining.
+	deadline time.Time
+	// When a drain stops waiting for players to leave, and the countdown
+	// it starts then
+	drainUntil time.Time
+	grace      time.Duration
+	// Seconds left at the last notice, -1 before the first
+	noticed int
+	// Set by the tick the countdown ends in
+	over bool
+}
+
+// Shutdown closes the listeners at once and has the tick loop count down
+// grace before it closes every connection. Done is closed after.
+func (srv *CstServer) Shutdown(grace time.Duration) {
+	atomic.StoreInt32(&srv.health, healthStopping)
+	srv.closeListeners()
+	srv.adminQueue <- adminCommand{run: func(srv *CstServer) (interface{}, error) {
+		srv.beginShutdown(srv.clock.Now(), grace, false)
+		return nil, nil
+	}}
+}
+
+// Drain stops admitting players and shuts down, counting down grace, once
+// the last one leaves or timeout passes
+func (srv *CstServer) Drain(timeout, grace time.Duration) {
+	atomic.CompareAndSwapInt32(&srv.health, healthServing, healthDraining)
+	srv.adminQueue <- adminCommand{run: func(srv *CstServer) (interface{}, error) {
+		srv.beginDrain(timeout, grace)
+		return nil, nil
+	}}
+}
+
+// Done is closed once the server has shut down and its loop has returned
+func (srv *CstServer) Done() <-chan struct{} {
+	return srv.done
+}
+
+// Listen opens a listener that Shutdown closes
+func (srv *CstServer) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv.listenerMutex.Lock()
+	defer srv.listenerMutex.Unlock()
+	if srv.listenersClosed {
+		listener.Close()
+		return nil, errStopping
+	}
+	srv.listeners = append(srv.listeners, listener)
+	return listener, nil
+}
+
+func (srv *CstServer) closeListeners() {
+	srv.listenerMutex.Lock()
+	defer srv.listenerMutex.Unlock()
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	srv.listeners = nil
+	srv.listenersClosed = true
+}
+
+// Accepting is false once the listeners are closed, so accept loops can
+// tell a shutdown from an error
+func (srv *CstServer) Accepting() bool {
+	return atomic.LoadInt32(&srv.health) != healthStopping
+}
+
+// ServeHealth answers load balancers: 200 while serving, 503 while
+// draining or stopping
+func (srv *CstServer) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	health := atomic.LoadInt32(&srv.health)
+	if health != healthServing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write([]byte(healthNames[health] + "\n"))
+}
+
+func (srv *CstServer) beginShutdown(now time.Time, grace time.Duration, restart bool) {
+	deadline := now.Add(grace)
+	if srv.stopping == nil {
+		srv.stopping = &shutdown{noticed: -1}
+	} else if !srv.stopping.deadline.IsZero() && !deadline.Before(srv.stopping.deadline) {
+		// Already counting down, and sooner
+		return
+	}
+	srv.stopping.restart = restart
+	srv.stopping.deadline = deadline
+	atomic.StoreInt32(&srv.health, healthStopping)
+	srv.closeListeners()
+	srv.sendAwayWaiting()
+	serverLog.Info("shutting down", "in", grace, tickAttr(srv.tickNumber))
+}
+
+func (srv *CstServer) beginDrain(timeout, grace time.Duration) {
+	if srv.stopping != nil {
+		return
+	}
+	srv.stopping = &shutdown{
+		restart:    true,
+		drainUntil: srv.clock.Now().Add(timeout),
+		grace:      grace,
+		noticed:    -1,
+	}
+	srv.sendAwayWaiting()
+	srv.broadcast("This server is being restarted. It closes when everyone has left, or in " + timeout.String())
+	serverLog.Info("draining", "for", timeout, tickAttr(srv.tickNumber))
+}
+
+// stepShutdown moves a drain or a countdown along. Called once per tick.
+func (srv *CstServer) stepShutdown() {
+	self := srv.stopping
+	if self == nil || self.over {
+		return
+	}
+	now := srv.clock.Now()
+	if self.deadline.IsZero() {
+		if srv.playersLeft() > 0 && now.Before(self.drainUntil) {
+			return
+		}
+		grace := self.grace
+		if srv.playersLeft() == 0 && len(srv.spectators) == 0 {
+			grace = 0
+		}
+		srv.beginShutdown(now, grace, true)
+	}
+	left := self.deadline.Sub(now)
+	seconds := int(math.Ceil(left.Seconds()))
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds != self.noticed &&
+		(self.noticed < 0 || seconds%shutdownNoticeEvery == 0 || seconds <= shutdownNoticeFinal) {
+		self.noticed = seconds
+		srv.noticeShutdown(seconds)
+	}
+	self.over = left <= 0
+}
+
+// playersLeft counts the players still connected. Stand-ins for the
+// players in a replay don't count.
+func (srv *CstServer) playersLeft() int {
+	if srv.playback != nil {
+		return 0
+	}
+	return len(srv.connections) - len(srv.dropped)
+}
+
+// stopped reports whether the countdown has ended, so the loop should
+// finish
+func (srv *CstServer) stopped() bool {
+	return srv.stopping != nil && srv.stopping.over
+}
+
+func (srv *CstServer) shutdownFrame(codec int, seconds int) []byte {
+	var buffer bytes.Buffer
+	frame := protocol.Shutdown{Seconds: seconds, Restart: srv.stopping.restart}
+	protocol.Encode(codec, &frame, &buffer)
+	return buffer.Bytes()
+}
+
+// noticeShutdown tells every client how long is left. A client that is
+// behind doesn't hold up the tick; it will see the next one.
+func (srv *CstServer) noticeShutdown(seconds int) {
+	frames := [2][]byte{
+		protocol.CodecJSON:   srv.shutdownFrame(protocol.CodecJSON, seconds),
+		protocol.CodecBinary: srv.shutdownFrame(protocol.CodecBinary, seconds),
+	}
+	for c, _ := range srv.connections {
+		if !c.player.dropped {
+			c.queue(frames[c.codec])
+		}
+	}
+	for c, _ := range srv.spectators {
+		c.queue(frames[c.codec])
+	}
+}
+
+// sendAway tells a new connection the server is going away and hangs up
+func (srv *CstServer) sendAway(c *connection) {
+	seconds := 0
+	if !srv.stopping.deadline.IsZero() {
+		seconds = int(math.Ceil(srv.stopping.deadline.Sub(srv.clock.Now()).Seconds()))
+		if seconds < 0 {
+			seconds = 0
+		}
+	}
+	c.queue(srv.shutdownFrame(c.codec, seconds))
+	srv.hangUpStopping(c)
+	srv.metrics.CountRejected(rejectStopping)
+	logTrace(netLog, "sent away while stopping", "conn", c)
+}
+
+// hangUpStopping hangs up, telling the client whether the server is coming
+// back
+func (srv *CstServer) hangUpStopping(c *connection) {
+	if srv.stopping.restart {
+		c.hangUpFor(closeRestart, "server restarting")
+	} else {
+		c.hangUpFor(closeShutdown, "server shutting down")
+	}
+}
+
+func (srv *CstServer) sendAwayWaiting() {
+	for {
+		c, ok := srv.admission.Pop()
+		if !ok {
+			return
+		}
+		srv.sendAway(c)
+	}
+}
+
+/*
+finish ends a shutdown after its last tick. It flushes what the server
+writes to disk, closes every send channel and gives the writers a moment
+to send what they have, then closes Done.
+*/
+func (srv *CstServer) finish() {
+	srv.profiler.Stop()
+	srv.recorder.Flush()
+
+	var writers []*connection
+	hangUp := func(c *connection) {
+		if c.hungUp {
+			return
+		}
+		srv.hangUpStopping(c)
+		if c.closer != nil {
+			writers = append(writers, c)
+		}
+	}
+	for c, _ := range srv.connections {
+		hangUp(c)
+	}
+	for c, _ := range srv.spectators {
+		hangUp(c)
+	}
+
+	timeout := time.After(shutdownFlushWait)
+wait:
+	for _, c := range writers {
+		select {
+		case <-c.written:
+		case <-timeout:
+			netLog.Warn("stopped waiting for clients to take their last frames")
+			break wait
+		}
+	}
+	serverLog.Info("shut down", tickAttr(srv.tickNumber))
+	close(srv.done)
+}
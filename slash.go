@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Slash commands are chat lines that start with "/". They give moderators
+and admins in the game the controls the admin API gives operators:
+
+	/help                 the commands you may run
+	/login KEY            take on the role KEY grants
+	/who                  players in the world
+	/tp X Y               teleport yourself
+	/tp PLAYER [X Y]      teleport a player, or yourself next to them
+	/kick PLAYER          remove a player from the server
+	/mute PLAYER          silence or unsilence a player's chat
+	/god [PLAYER]         turn god mode on or off
+	/spawn ARCHETYPE [X Y]  spawn next to you, or at X Y
+	/life on|off          the life system in your subgrid
+
+Players are anonymous, so a role comes from a key in the roles file. A
+player who logs in keeps the role until it leaves, resumes included.
+Every command above the player role, and every login, is written to the
+audit log with who ran it.
+
+The reader goroutine queues each command on adminQueue; it runs between
+ticks like the admin API's.
+*/
+
+type Role int
+
+const (
+	RolePlayer Role = iota
+	RoleModerator
+	RoleAdmin
+)
+
+var roleNames = [...]string{
+	RolePlayer:    "player",
+	RoleModerator: "moderator",
+	RoleAdmin:     "admin",
+}
+
+func (self Role) String() string {
+	return roleNames[self]
+}
+
+func parseRole(s string) (Role, bool) {
+	for i, name := range roleNames {
+		if name == s {
+			return Role(i), true
+		}
+	}
+	return RolePlayer, false
+}
+
+type roleGrant struct {
+	role Role
+	name string
+	key  string
+}
+
+/*
+Roles holds the roles file, one grant per line:
+
+	# role name key
+	admin alice 4e1f0c...
+	moderator bob 90d2a7...
+
+The name is only for the audit log. Blank lines and lines starting with #
+are skipped.
+*/
+type Roles struct {
+	grants []roleGrant
+}
+
+// LoadRoles reads a roles file. With no file, no one can log in.
+func LoadRoles(path string) (*Roles, error) {
+	roles := &Roles{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return roles, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want role, name and key", path, line)
+		}
+		role, ok := parseRole(fields[0])
+		if !ok || role == RolePlayer {
+			return nil, fmt.Errorf("%s:%d: unknown role %q", path, line, fields[0])
+		}
+		roles.grants = append(roles.grants, roleGrant{role, fields[1], fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// Login finds the grant for key. Every key is compared, in constant time.
+func (self *Roles) Login(key string) (roleGrant, bool) {
+	var found roleGrant
+	ok := false
+	for _, grant := range self.grants {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(grant.key)) == 1 {
+			found, ok = grant, true
+		}
+	}
+	return found, ok
+}
+
+// AuditLog appends one line per privileged command. A nil AuditLog
+// records nothing.
+type AuditLog struct {
+	out *log.Logger
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{out: log.New(file, "", log.LstdFlags|log.LUTC)}, nil
+}
+
+func (self *AuditLog) Record(tick uint64, player *Player, line string, err error) {
+	if self == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "failed: " + err.Error()
+	}
+	name := player.roleName
+	if name == "" {
+		name = "-"
+	}
+	self.out.Printf("tick=%d player=%s name=%s role=%v %q %s",
+		tick, player.DisplayString(), name, player.role, line, result)
+}
+
+type slashCommand struct {
+	role  Role
+	usage string
+	// Audited without its arguments, whoever runs it
+	secret bool
+	run    func(srv *CstServer, player *Player, args []string) error
+}
+
+var slashCommands map[string]slashCommand
+
+func init() {
+	slashCommands = map[string]slashCommand{
+		"help":  {RolePlayer, "/help", false, slashHelp},
+		"login": {RolePlayer, "/login KEY", true, slashLogin},
+		"who":   {RolePlayer, "/who", false, slashWho},
+		"tp":    {RoleModerator, "/tp X Y, /tp PLAYER [X Y]", false, slashTeleport},
+		"kick":  {RoleModerator, "/kick PLAYER", false, slashKick},
+		"mute":  {RoleModerator, "/mute PLAYER", false, slashMute},
+		"god":   {RoleAdmin, "/god [PLAYER]", false, slashGod},
+		"spawn": {RoleAdmin, "/spawn ARCHETYPE [X Y]", false, slashSpawn},
+		"life":  {RoleAdmin, "/life on|off", false, slashLife},
+	}
+}
+
+// queueSlash has the tick loop run a slash command from c
+func (srv *CstServer) queueSlash(c *connection, line string) {
+	srv.adminQueue <- adminCommand{run: func(srv *CstServer) (interface{}, error) {
+		srv.slash(c, line)
+		return nil, nil
+	}}
+}
+
+// slash runs a slash command and tells the player how it went. Only the
+// tick goroutine may call it.
+func (srv *CstServer) slash(c *connection, line string) {
+	if _, present := srv.connections[c]; !present {
+		// Left or was kicked while the command waited
+		return
+	}
+	player := c.player
+	fields := strings.Fields(strings.TrimPrefix(line, "/"))
+	if len(fields) == 0 {
+		return
+	}
+	name, args := strings.ToLower(fields[0]), fields[1:]
+	cmd, present := slashCommands[name]
+	if !present {
+		player.AddMessage("Unknown command /" + name + ", try /help")
+		return
+	}
+	var err error
+	if player.role < cmd.role {
+		err = fmt.Errorf("that needs the %v role", cmd.role)
+	} else if srv.playback != nil {
+		err = fmt.Errorf("the world is a replay")
+	} else {
+		err = cmd.run(srv, player, args)
+	}
+	if cmd.secret {
+		srv.audit.Record(srv.tickNumber, player, "/"+name, err)
+	} else if cmd.role > RolePlayer {
+		srv.audit.Record(srv.tickNumber, player, line, err)
+	}
+	if err != nil {
+		player.AddMessage("/" + name + ": " + err.Error())
+	}
+}
+
+// loggedSlash is a slash command line as it may be logged: a secret
+// command's arguments are left out
+func loggedSlash(line string) string {
+	fields := strings.Fields(strings.TrimPrefix(line, "/"))
+	if len(fields) == 0 {
+		return line
+	}
+	name := strings.ToLower(fields[0])
+	if slashCommands[name].secret {
+		return "/" + name
+	}
+	return line
+}
+
+// slashPlayer finds a player by ID or short name
+func (srv *CstServer) slashPlayer(name string) (*Player, error) {
+	player, present := srv.findPlayer(strings.ToUpper(name))
+	if !present {
+		player, present = srv.findPlayer(strings.ToLower(name))
+	}
+	if !present {
+		return nil, fmt.Errorf("no player %s", name)
+	}
+	return player, nil
+}
+
+func slashCoord(x, y string) (Coord, error) {
+	cx, errX := strconv.ParseInt(x, 10, 64)
+	cy, errY := strconv.ParseInt(y, 10, 64)
+	if errX != nil || errY != nil {
+		return Coord{}, fmt.Errorf("bad location %s %s", x, y)
+	}
+	return Coord{cx, cy}, nil
+}
+
+// openCellNear finds open floor next to loc
+func openCellNear(world *WorldGrid, loc Coord) (Coord, bool) {
+	for _, dir := range "nesw" {
+		if next := loc.MovedBy(dir); world.PassableAt(next) {
+			return next, true
+		}
+	}
+	return loc, false
+}
+
+func usageError(name string) error {
+	return fmt.Errorf("usage: %s", slashCommands[name].usage)
+}
+
+func slashHelp(srv *CstServer, player *Player, args []string) error {
+	names := make([]string, 0, len(slashCommands))
+	for name, cmd := range slashCommands {
+		if cmd.role <= player.role {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		player.AddMessage(slashCommands[name].usage)
+	}
+	return nil
+}
+
+func slashLogin(srv *CstServer, player *Player, args []string) error {
+	if len(args) != 1 {
+		return usageError("login")
+	}
+	grant, ok := srv.roles.Login(args[0])
+	if !ok {
+		return fmt.Errorf("bad key")
+	}
+	player.role, player.roleName = grant.role, grant.name
+	player.AddMessage(fmt.Sprintf("Logged in as %s, %v", grant.name, grant.role))
+	return nil
+}
+
+func slashWho(srv *CstServer, player *Player, args []string) error {
+	infos := srv.playerInfos()
+	player.AddMessage(fmt.Sprintf("%d players", len(infos)))
+	for _, info := range infos {
+		line := fmt.Sprintf("%s at %d,%d, %s", info.Name, info.X, info.Y, info.State)
+		if player.role > RolePlayer {
+			other, _ := srv.findPlayer(info.Name)
+			if other != nil && other.role > RolePlayer {
+				line += fmt.Sprintf(", %v %s", other.role, other.roleName)
+			}
+			if other != nil && other.muted {
+				line += ", muted"
+			}
+		}
+		player.AddMessage(line)
+	}
+	return nil
+}
+
+func slashTeleport(srv *CstServer, player *Player, args []string) error {
+	target := player
+	var loc Coord
+	var err error
+	switch len(args) {
+	case 1:
+		other, err := srv.slashPlayer(args[0])
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if loc, ok = openCellNear(srv.world, other.Coord()); !ok {
+			return fmt.Errorf("no room next to %s", other.DisplayString())
+		}
+	case 2:
+		loc, err = slashCoord(args[0], args[1])
+	case 3:
+		if target, err = srv.slashPlayer(args[0]); err == nil {
+			loc, err = slashCoord(args[1], args[2])
+		}
+	default:
+		return usageError("tp")
+	}
+	if err != nil {
+		return err
+	}
+	err = srv.change(adminChange{op: adminTeleport, id: target.EntityID(), loc: loc})
+	if err != nil {
+		return err
+	}
+	player.AddMessage(fmt.Sprintf("Teleported %s to %d,%d", target.DisplayString(), loc.x, loc.y))
+	return nil
+}
+
+func slashKick(srv *CstServer, player *Player, args []string) error {
+	if len(args) != 1 {
+		return usageError("kick")
+	}
+	target, err := srv.slashPlayer(args[0])
+	if err != nil {
+		return err
+	}
+	if target.role > player.role {
+		return fmt.Errorf("%s outranks you", target.DisplayString())
+	}
+	srv.kick(target.Connection)
+	player.AddMessage("Kicked " + target.DisplayString())
+	return nil
+}
+
+func slashMute(srv *CstServer, player *Player, args []string) error {
+	if len(args) != 1 {
+		return usageError("mute")
+	}
+	target, err := srv.slashPlayer(args[0])
+	if err != nil {
+		return err
+	}
+	if target.role > player.role {
+		return fmt.Errorf("%s outranks you", target.DisplayString())
+	}
+	target.muted = !target.muted
+	if target.muted {
+		target.AddMessage("You were muted")
+		player.AddMessage("Muted " + target.DisplayString())
+	} else {
+		target.AddMessage("You were unmuted")
+		player.AddMessage("Unmuted " + target.DisplayString())
+	}
+	return nil
+}
+
+func slashGod(srv *CstServer, player *Player, args []string) error {
+	target := player
+	if len(args) == 1 {
+		var err error
+		if target, err = srv.slashPlayer(args[0]); err != nil {
+			return err
+		}
+	} else if len(args) > 1 {
+		return usageError("god")
+	}
+	err := srv.change(adminChange{op: adminGod, id: target.EntityID(), active: !target.god})
+	if err != nil {
+		return err
+	}
+	state := "off"
+	if target.god {
+		state = "on"
+	}
+	player.AddMessage(fmt.Sprintf("God mode %s for %s", state, target.DisplayString()))
+	return nil
+}
+
+func slashSpawn(srv *CstServer, player *Player, args []string) error {
+	var loc Coord
+	var err error
+	switch len(args) {
+	case 1:
+		var ok bool
+		if loc, ok = openCellNear(srv.world, player.Coord()); !ok {
+			return fmt.Errorf("no room next to you")
+		}
+	case 3:
+		loc, err = slashCoord(args[1], args[2])
+	default:
+		return usageError("spawn")
+	}
+	if err != nil {
+		return err
+	}
+	err = srv.change(adminChange{op: adminSpawn, archetype: args[0], loc: loc})
+	if err != nil {
+		return err
+	}
+	player.AddMessage(fmt.Sprintf("Spawned %s at %d,%d", args[0], loc.x, loc.y))
+	return nil
+}
+
+func slashLife(srv *CstServer, player *Player, args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return usageError("life")
+	}
+	on := args[0] == "on"
+	gcoord := player.Coord().Grid(srv.world)
+	change := adminChange{op: adminLife, gcoord: gcoord, allowed: true, active: on}
+	if subgrid := srv.world.safeSubgridAtGrid(gcoord); subgrid != nil && !on {
+		change.allowed = subgrid.lifeAllowed
+	}
+	if err := srv.change(change); err != nil {
+		return err
+	}
+	player.AddMessage(fmt.Sprintf("Life system %s in subgrid %d,%d", args[0], gcoord.x, gcoord.y))
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// A spectator looking for a player it can't find tries again this often
+var followRetryTicks = ticksPerSec
+
+// Clients that pass follow=<player> or camera=<x>,<y> on /ws watch instead
+// of play. A player is named by its ID or by the short name chat shows.
+func spectatorFor(c *connection, r *http.Request) (*Spectator, bool) {
+	query := r.URL.Query()
+	follow, camera := query.Get("follow"), query.Get("camera")
+	if follow == "" && camera == "" {
+		return nil, false
+	}
+	spectator := NewSpectator(c)
+	if xy := strings.SplitN(camera, ",", 2); len(xy) == 2 {
+		x, errX := strconv.ParseInt(xy[0], 10, 64)
+		y, errY := strconv.ParseInt(xy[1], 10, 64)
+		if errX == nil && errY == nil {
+			spectator.Location = Coord{x, y}
+		}
+	}
+	spectator.followName = follow
+	return spectator, true
+}
+
+/*
+Spectator is the viewpoint of a connection that watches without playing.
+It is never placed in the world: nothing can collide with it, Monsters
+don't detect it since it isn't a player, and it doesn't count toward the
+server population. It gets the same update frames a player does, built
+by SubGrid.WriteDisplay around its camera.
+
+The camera either follows a player or sits at a Coord, where move
+commands pan it.
+*/
+type Spectator struct {
+	EntityT
+	Connection *connection
+	following  EntityID
+	followName string
+	found      bool
+	inbox      []string
+	panQueue   chan rune
+	view       *SubGrid
+}
+
+func NewSpectator(c *connection) *Spectator {
+	entity := EntityT{
+		direction: '0',
+		ID:        NewEntityID(),
+		Symbol:    '@',
+	}
+	return &Spectator{
+		Connection: c,
+		EntityT:    entity,
+		inbox:      make([]string, 0, 4),
+		panQueue:   make(chan rune, 64),
+	}
+}
+
+func (ntt *Spectator) AddMessage(msg string) {
+	ntt.inbox = append(ntt.inbox, msg)
+}
+func (ntt *Spectator) Codec() int {
+	return ntt.Connection.codec
+}
+func (ntt *Spectator) EntityTracker() *EntityTracker {
+	return ntt.Connection.tracker
+}
+func (ntt *Spectator) Inbox() []string {
+	return ntt.inbox
+}
+func (ntt *Spectator) InMaxRange(other Entity) bool {
+	return ntt.Location.InRange(other.Coord(), 39, 12)
+}
+func (ntt *Spectator) IsBlurred() bool {
+	return ntt.Connection.Blurred()
+}
+func (ntt *Spectator) IsDead() bool      { return false }
+func (ntt *Spectator) IsTransient() bool { return false }
+func (ntt *Spectator) ProtocolVersion() int {
+	return ntt.Connection.protocol
+}
+
+// Pan queues a camera move from the connection's reader. Moves that don't
+// fit are dropped; the client will send more.
+func (ntt *Spectator) Pan(move rune) {
+	select {
+	case ntt.panQueue <- move:
+	default:
+	}
+}
+
+// SendDisplay writes the spectator's frame. One that replaces a frame the
+// client never got carries the whole view, but not the messages the other
+// one had.
+func (ntt *Spectator) SendDisplay(grid GridKeeper, gproc GridProcessor) {
+	if ntt.IsBlurred() {
+		ntt.inbox = ntt.inbox[:0]
+		return
+	}
+	ntt.Connection.offerUpdate(func(behind bool) []byte {
+		if behind {
+			ntt.SetInitialized(false)
+			if tracker := ntt.EntityTracker(); tracker != nil {
+				tracker.ForceKeyframe()
+			}
+		}
+		var buffer bytes.Buffer
+		grid.WriteDisplay(ntt, gproc, &buffer)
+		return buffer.Bytes()
+	})
+	ntt.inbox = ntt.inbox[:0]
+}
+
+// findPlayer looks up a player by ID or short name
+func (srv *CstServer) findPlayer(name string) (*Player, bool) {
+	for c := range srv.connections {
+		if c.id.String() == name || c.player.DisplayString() == name {
+			return c.player, true
+		}
+	}
+	return nil, false
+}
+
+// addSpectator registers a watching connection. Spectators skip the
+// admission queue, but there are only so many of them.
+func (srv *CstServer) addSpectator(c *connection) {
+	var buffer bytes.Buffer
+	frame := protocol.Init{Pop: srv.population, Load: srv.load}
+	if len(srv.spectators) < srv.config.MaxSpectators {
+		srv.spectators[c] = c.spectator
+		frame.Approved = true
+		frame.ID = c.spectator.EntityID()
+		logTrace(netLog, "spectating", "conn", c, "spectator", EntityID(frame.ID))
+	} else {
+		srv.metrics.CountRejected(rejectSpectatorsFull)
+		logTrace(netLog, "spectator turned away", "conn", c)
+	}
+	protocol.Encode(c.codec, &frame, &buffer)
+	c.queue(buffer.Bytes())
+	if !frame.Approved {
+		c.hangUpFor(closeServerFull, "spectators full")
+	}
+}
+
+// moveCamera follows the spectator's player or pans its free camera.
+// Moving the camera by hand stops following.
+func (srv *CstServer) moveCamera(ntt *Spectator) {
+panqloop:
+	for {
+		select {
+		case move := <-ntt.panQueue:
+			ntt.followName = ""
+			ntt.found = false
+			ntt.Location = ntt.Location.MovedBy(move)
+			ntt.direction = move
+		default:
+			break panqloop
+		}
+	}
+	if ntt.followName == "" {
+		return
+	}
+	if !ntt.found {
+		if srv.tickNumber%followRetryTicks != 0 {
+			return
+		}
+		player, present := srv.findPlayer(ntt.followName)
+		if !present {
+			return
+		}
+		ntt.following = player.EntityID()
+		ntt.found = true
+		ntt.AddMessage("Following " + player.DisplayString())
+	}
+	target := srv.world.EntityByID(ntt.following)
+	if target == nil {
+		// Hold the camera where the player was last seen
+		ntt.found = false
+		ntt.AddMessage(ntt.followName + " left")
+		return
+	}
+	ntt.Location = target.Coord()
+	ntt.direction = target.Direction()
+	ntt.health = target.Health()
+}
+
+// updateSpectators places every camera for this tick and finds the
+// SubGrid to display each one from
+func (srv *CstServer) updateSpectators() {
+	for _, spectator := range srv.spectators {
+		srv.moveCamera(spectator)
+		spectator.view = srv.world.viewGrid(spectator.Coord(), spectator.view)
+	}
+}
+
+// sendSpectatorDisplays runs after the players' displays. WriteDisplay
+// isn't concurrent on one SubGrid, so the spectators watching a SubGrid
+// are written one after another; different SubGrids go in parallel.
+func (srv *CstServer) sendSpectatorDisplays() {
+	views := make(map[*SubGrid][]*Spectator)
+	for _, spectator := range srv.spectators {
+		views[spectator.view] = append(views[spectator.view], spectator)
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(views))
+	for view, spectators := range views {
+		go func(view *SubGrid, spectators []*Spectator) {
+			defer wg.Done()
+			for _, ntt := range spectators {
+				ntt.SendDisplay(view, srv)
+			}
+		}(view, spectators)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loadHostKey reads the server's SSH host key, making one the first time
+// so that clients see the same key on every start
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		serverLog.Info("generated SSH host key", "path", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// listenSSH serves terminal sessions to SSH clients on addr. Anyone may
+// log in, as anyone may open the web page.
+func (srv *CstServer) listenSSH(addr string, keyPath string) error {
+	signer, err := loadHostKey(keyPath)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	listener, err := srv.Listen(addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if srv.Accepting() {
+					netLog.Error("SSH listener stopped", "err", err)
+				}
+				return
+			}
+			go srv.serveSSH(conn, config)
+		}
+	}()
+	return nil
+}
+
+func (srv *CstServer) serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		logTrace(netLog, "SSH handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are served")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go srv.serveSSHSession(channel, channelRequests, conn)
+	}
+}
+
+// serveSSHSession starts the game when the client asks for a shell. Ptys
+// are accepted but their size is not used; the screen is always 79x29.
+func (srv *CstServer) serveSSHSession(channel ssh.Channel, requests <-chan *ssh.Request, conn net.Conn) {
+	started := false
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "pty-req", "window-change", "env":
+			ok = true
+		case "shell":
+			ok = !started
+			if ok {
+				started = true
+				go srv.serveTerminal(&sshSession{Channel: channel}, conn, false)
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// sshSession tells the client the game ended normally before it closes
+// the channel, so ssh exits with status 0
+type sshSession struct {
+	ssh.Channel
+	once sync.Once
+}
+
+func (self *sshSession) Close() error {
+	self.once.Do(func() {
+		status := struct{ Status uint32 }{0}
+		self.SendRequest("exit-status", false, ssh.Marshal(&status))
+	})
+	return self.Channel.Close()
+}
@@ -20,6 +20,8 @@ var CreateGame = function(term) {
     initReq.send();
 
     var uuid_ = null;
+    var token_ = null;
+    var freshInit_ = null;
 
     var generateInterval_ = function(k) {
         var maxInterval = (Math.pow(2, k) - 1) * 1000;
@@ -33,6 +35,11 @@ var CreateGame = function(term) {
     };
 
     var wsaddr = (initReq.responseText).trim();
+    // Opening the page with ?follow=<player> or ?camera=<x>,<y> watches
+    // instead of playing
+    var spectate_ = window.location.search.replace(/^\?/, "").split("&").filter(function(param) {
+        return (param.indexOf("follow=") === 0) || (param.indexOf("camera=") === 0);
+    }).join("&");
     var wsocket_ = null;
     var reconnectAttempts_ = 1;
 
@@ -120,6 +127,11 @@ var CreateGame = function(term) {
 	showMessage_("You say: '" + data + "'");
     };
 
+    // Slash commands go up as chat; the server answers in messages
+    var sendSlash_ = function(line) {
+	sendQueue_.enqueue("ch:" + line);
+    };
+
     var showMessage_ = function(message) {
 	if (term_) {
 	    term_.output(message+"<br>");
@@ -197,6 +209,14 @@ var CreateGame = function(term) {
             return
         }
 
+        // o to open or close the door ahead
+        if (code == 79) {
+            sendQueue_.enqueue("in:0");
+	    e.preventDefault();
+	    e.stopPropagation();
+            return
+        }
+
 	var action = "0";
 	if (code == 38) { action = "n"; }
 	if (code == 40) { action = "s"; }
@@ -301,20 +321,34 @@ var CreateGame = function(term) {
 
 
     var initWebSockets_ = function(){
+       var addr = wsaddr;
+       if (spectate_) {
+            addr += ((addr.indexOf("?") < 0) ? "?" : "&") + spectate_;
+       }
        try {
-            wsocket_ = new WebSocket(wsaddr);
+            wsocket_ = new WebSocket(addr);
         } catch (err) {
             return false;
         };
 
+        wsocket_.onopen = function(event) {
+            if ((gameState_ === "RECONNECT") && token_) {
+                // resume straight away instead of waiting for admission.
+                // The token stays out of the URL, where logs would keep it.
+                sendImmediate_(["reconnect", token_].join(":"));
+            }
+        };
+
         wsocket_.onmessage = function(event) {
 	    var jsonObj = JSON.parse(event.data);
 	    if (jsonObj.type === "init") {
 	        if (jsonObj.approved) {
-                    if (gameState_ === "RECONNECT") {
-                        sendImmediate_([(new Date()).getTime(),"reconnect",uuid_].join(":"));
+                    if ((gameState_ === "RECONNECT") && token_) {
+                        // keep it in case the resume is refused
+                        freshInit_ = jsonObj;
                     } else {
 	                uuid_ = jsonObj.uuid; 
+	                token_ = jsonObj.token; 
                         reconnectAttempts_ = 1;
                         gameState_ = "INITIALIZED";
                     }
@@ -323,14 +357,34 @@ var CreateGame = function(term) {
 		    Game.showMessage("Pop:" + jsonObj.pop + " Load:" + jsonObj.load);
 	        }
 	    }
+	    if (jsonObj.type === "queue") {
+		var wait = (jsonObj.wait > 0) ? (" About " + jsonObj.wait + "s.") : "";
+		showMessage_("Server full. Waiting in line: " + jsonObj.position +
+			     " of " + jsonObj.length + "." + wait);
+	    }
 	    if ((gameState_ === "RECONNECT") && (jsonObj.type === "re")) {
                  if (jsonObj.approved) {
 	             if (uuid_ !== jsonObj.uuid) {
                          throw "UUIDs don't match!";
                      }; 
-                     reconnectAttempts_ = 1;
-                     gameState_ = "INITIALIZED";
+                     token_ = jsonObj.token;
+	        } else {
+		     showMessage_("Could not resume your session.");
+                     token_ = null;
+                     if (!freshInit_) {
+                         // play the player this connection gets when
+                         // it's admitted
+                         gameState_ = "START";
+                         return;
+                     }
+                     // too late to resume: play the player this
+                     // connection was given instead
+                     uuid_ = freshInit_.uuid;
+                     token_ = freshInit_.token;
 	        }
+                 freshInit_ = null;
+                 reconnectAttempts_ = 1;
+                 gameState_ = "INITIALIZED";
             }
 	    if ((gameState_ === "INITIALIZED") && (jsonObj.type === "update")) {
 	        if (jsonObj.messages) {
@@ -346,10 +400,26 @@ var CreateGame = function(term) {
 	    if (jsonObj.type === "message") {
 	        showMessage_(jsonObj.data);
 	    }
+	    if (jsonObj.type === "shutdown") {
+	        var what = jsonObj.restart ? "restarting" : "shutting down";
+	        if (jsonObj.seconds > 0) {
+		    showMessage_("Server " + what + " in " + jsonObj.seconds + "s.");
+	        } else {
+		    showMessage_("Server " + what + " now.");
+	        }
+	    }
         };
 
         wsocket_.onclose = function(event) {
-            console.log("websocket closed");
+            console.log("websocket closed", event.code, event.reason);
+            if (event.reason) {
+                showMessage_("Disconnected: " + event.reason + ".");
+            }
+            if (event.code === 1008) {
+                // kicked, or broke the server's rules: don't come back
+                gameState_ = "CLOSED";
+                return;
+            }
             gameState_ = "RECONNECT";
 
             var time = generateInterval_(reconnectAttempts_);
@@ -372,6 +442,7 @@ var CreateGame = function(term) {
     return {
 	focusID: (function() {return hasFocus_}),
         sendMessage: sendMessage_,
+        sendSlash: sendSlash_,
 	setFocus: setFocus_
     }
     
@@ -220,9 +220,14 @@ var Terminal = Terminal || function(containerId) {
           output('<p>Toggle command mode using the ESC key.</p>');
           output('<p>Arrow keys/click to move</p>');
           output('<p>L=LifePen. A=Activate Life System</p>');
+          output('<p>/help lists the slash commands you may run</p>');
           break;
       case 'login':
-          output('command under construction<br>');
+          if (game_ && args.length == 1) {
+              game_.sendSlash('/login ' + args[0]);
+          } else {
+              output('usage: login KEY<br>');
+          }
           break;
       case 'mission':
           output('command under construction<br>');
@@ -243,10 +248,14 @@ var Terminal = Terminal || function(containerId) {
           output(VERSION_);
           break;
       case 'who':
-          output('command is under construction<br>');
+          if (game_) {
+              game_.sendSlash('/who');
+          }
           break;
       default:
-          if (cmd) {
+          if (cmd && cmd.charAt(0) == '/' && game_) {
+              game_.sendSlash(lineText.trim());
+          } else if (cmd) {
               output('command not found');
           }
       };
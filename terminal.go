@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+
+	"github.com/StCredZero/ROTCS/client"
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+/*
+Terminal sessions play the game in an ANSI terminal over telnet or SSH.
+A session is a connection like any websocket client's: it registers, waits
+in the admission queue, gets a full Player and is dropped when it hangs
+up. The server sends it binary frames with tile maps. The session's
+writer decodes them and draws them with a client.Screen, as rotcs-client
+does. Its reader turns keys into the same commands the browser sends.
+*/
+
+// Telnet protocol bytes
+const telnetSE byte = 240
+const telnetSB byte = 250
+const telnetWILL byte = 251
+const telnetWONT byte = 252
+const telnetDO byte = 253
+const telnetDONT byte = 254
+const telnetIAC byte = 255
+const telnetEcho byte = 1
+const telnetSGA byte = 3
+
+type terminalSession struct {
+	c *connection
+	// For write deadlines; the network connection under rw
+	conn   net.Conn
+	rw     io.ReadWriteCloser
+	screen *client.Screen
+	telnet bool
+	view   *client.View
+}
+
+func newTerminalSession(c *connection, rw io.ReadWriteCloser, conn net.Conn, telnet bool) *terminalSession {
+	return &terminalSession{
+		c:      c,
+		conn:   conn,
+		rw:     rw,
+		screen: client.NewScreen(rw),
+		telnet: telnet,
+		view:   client.NewView(),
+	}
+}
+
+// serveTerminal plays one terminal session over rw until it hangs up
+func (srv *CstServer) serveTerminal(rw io.ReadWriteCloser, conn net.Conn, telnet bool) {
+	c := newConnection(nil)
+	c.closer = rw
+	if conn != nil {
+		c.remote = conn.RemoteAddr().String()
+	}
+	c.codec = protocol.CodecBinary
+	c.protocol = protocol.MapTiles
+	if srv.playback != nil {
+		c.spectator = NewSpectator(c)
+	}
+	session := newTerminalSession(c, rw, conn, telnet)
+	srv.serve(c, func() { session.reader(srv) }, session.writer)
+}
+
+func (self *terminalSession) writer() {
+
+	defer func() {
+		logTrace(netLog, "closing terminal writer", "conn", self.c)
+		self.screen.Stop()
+		self.screen.Flush()
+		self.c.cancel()
+		close(self.c.written)
+	}()
+
+	self.screen.Start()
+	for {
+		message, made, ok := self.c.next()
+		if !ok {
+			return
+		}
+		frame, err := protocol.DecodeBinary(message)
+		if err != nil {
+			netLog.Warn("terminal frame not decoded", "conn", self.c, "err", err)
+			continue
+		}
+		self.screen.Show(self.view, frame)
+		if self.conn != nil {
+			self.conn.SetWriteDeadline(time.Now().Add(1200 * time.Millisecond))
+		}
+		if err := self.screen.Flush(); err != nil {
+			return
+		}
+		// What the terminal was sent, before it became screen updates
+		self.c.wrote(len(message), made)
+	}
+}
+
+func (self *terminalSession) reader(srv *CstServer) {
+
+	defer func() {
+		logTrace(netLog, "closing terminal reader", "conn", self.c)
+	}()
+
+	var in io.Reader = self.rw
+	if self.telnet {
+		in = &telnetReader{in: bufio.NewReader(self.rw)}
+	}
+	keys := client.NewKeyReader(in)
+	for self.c.ctx.Err() == nil {
+		cmd, quit, err := keys.ReadCommand()
+		if err != nil || quit {
+			return
+		}
+		cmd.Timestamp = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		self.c.handle(srv, cmd)
+	}
+}
+
+// telnetReader passes on what the client types, leaving out telnet
+// negotiation
+type telnetReader struct {
+	in *bufio.Reader
+}
+
+func (self *telnetReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && (n == 0 || self.in.Buffered() > 0) {
+		b, err := self.readByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
+
+func (self *telnetReader) readByte() (byte, error) {
+	in := self.in
+	for {
+		b, err := in.ReadByte()
+		if err != nil || b != telnetIAC {
+			return b, err
+		}
+		op, err := in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case telnetIAC:
+			return op, nil
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			if _, err := in.ReadByte(); err != nil {
+				return 0, err
+			}
+		case telnetSB:
+			// subnegotiation runs to IAC SE
+			for last := byte(0); ; {
+				b, err := in.ReadByte()
+				if err != nil {
+					return 0, err
+				}
+				if last == telnetIAC && b == telnetSE {
+					break
+				}
+				last = b
+			}
+		}
+	}
+}
+
+// listenTelnet serves terminal sessions to telnet clients on addr
+func (srv *CstServer) listenTelnet(addr string) error {
+	listener, err := srv.Listen(addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if srv.Accepting() {
+					netLog.Error("telnet listener stopped", "err", err)
+				}
+				return
+			}
+			go srv.serveTelnet(conn)
+		}
+	}()
+	return nil
+}
+
+// serveTelnet puts the client in character mode with the server echoing,
+// which it never does, so keys aren't printed over the map
+func (srv *CstServer) serveTelnet(conn net.Conn) {
+	conn.Write([]byte{
+		telnetIAC, telnetWILL, telnetEcho,
+		telnetIAC, telnetWILL, telnetSGA,
+		telnetIAC, telnetDO, telnetSGA,
+	})
+	srv.serveTerminal(conn, conn, true)
+}
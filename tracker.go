@@ -0,0 +1,153 @@
+package main
+
+import (
+	"github.com/StCredZero/ROTCS/protocol"
+)
+
+// A full keyframe goes out at least this often, so a client that lost
+// track of something is never wrong for long
+var keyframeInterval = ticksPerSec * 4
+
+// trackedEntity is what the client was last told about one entity, and
+// what it looks like this tick
+type trackedEntity struct {
+	id     EntityID
+	handle uint16
+	sent   bool
+	seen   bool
+
+	loc    Coord
+	symbol rune
+	health int
+
+	sentLoc    Coord
+	sentSymbol rune
+	sentHealth int
+}
+
+/*
+EntityTracker gives each entity a connection a short handle while it is
+in view, and turns the entities seen each tick into deltas against what
+that connection was last sent. The websocket delivers frames reliably and
+in order, so a frame handed to the writer counts as acknowledged; anything
+that breaks that, like dropping frames, must call ForceKeyframe.
+
+A tracker belongs to one connection and is only touched from that
+player's WriteDisplay, so it needs no locking.
+*/
+type EntityTracker struct {
+	byID         map[EntityID]*trackedEntity
+	tracked      []*trackedEntity
+	freeHandles  []uint16
+	nextHandle   uint16
+	lastKeyframe uint64
+	keyframeDue  bool
+}
+
+func NewEntityTracker() *EntityTracker {
+	return &EntityTracker{
+		byID:        make(map[EntityID]*trackedEntity),
+		tracked:     make([]*trackedEntity, 0, 32),
+		freeHandles: make([]uint16, 0, 32),
+		nextHandle:  1,
+		keyframeDue: true,
+	}
+}
+
+func (self *EntityTracker) ForceKeyframe() {
+	self.keyframeDue = true
+}
+
+func (self *EntityTracker) allocHandle() uint16 {
+	if n := len(self.freeHandles); n > 0 {
+		handle := self.freeHandles[n-1]
+		self.freeHandles = self.freeHandles[:n-1]
+		return handle
+	}
+	handle := self.nextHandle
+	self.nextHandle++
+	return handle
+}
+
+// Observe records an entity in view this tick
+func (self *EntityTracker) Observe(ntt Entity) {
+	tracked, present := self.byID[ntt.EntityID()]
+	if !present {
+		tracked = &trackedEntity{
+			id:     ntt.EntityID(),
+			handle: self.allocHandle(),
+		}
+		self.byID[tracked.id] = tracked
+		self.tracked = append(self.tracked, tracked)
+	}
+	tracked.seen = true
+	tracked.loc = ntt.Coord()
+	tracked.symbol = ntt.DisplaySymbol()
+	tracked.health = ntt.Health()
+}
+
+// Flush writes the deltas since the last frame into update and forgets
+// entities that left view. Handles of despawned entities are only reused
+// from the next tick on, so a frame never spawns and despawns one handle.
+func (self *EntityTracker) Flush(tick uint64, update *protocol.Update) {
+	keyframe := self.keyframeDue || tick-self.lastKeyframe >= keyframeInterval
+	if keyframe {
+		self.keyframeDue = false
+		self.lastKeyframe = tick
+	}
+	update.UseDeltas = true
+	update.Keyframe = keyframe
+
+	var freed []uint16
+	kept := self.tracked[:0]
+	for _, tracked := range self.tracked {
+		if !tracked.seen {
+			if !keyframe {
+				update.Deltas = append(update.Deltas, protocol.EntityDelta{
+					Handle: tracked.handle,
+					Fields: protocol.DeltaDespawn,
+				})
+			}
+			delete(self.byID, tracked.id)
+			freed = append(freed, tracked.handle)
+			continue
+		}
+		tracked.seen = false
+		kept = append(kept, tracked)
+
+		var fields uint8
+		if keyframe || !tracked.sent {
+			fields = protocol.DeltaPosition | protocol.DeltaSymbol | protocol.DeltaHealth
+		} else {
+			if tracked.loc != tracked.sentLoc {
+				fields |= protocol.DeltaPosition
+			}
+			if tracked.symbol != tracked.sentSymbol {
+				fields |= protocol.DeltaSymbol
+			}
+			if tracked.health != tracked.sentHealth {
+				fields |= protocol.DeltaHealth
+			}
+		}
+		if fields == 0 {
+			continue
+		}
+		update.Deltas = append(update.Deltas, protocol.EntityDelta{
+			Handle: tracked.handle,
+			Fields: fields,
+			X:      tracked.loc.x,
+			Y:      tracked.loc.y,
+			Symbol: tracked.symbol,
+			Health: tracked.health,
+		})
+		tracked.sent = true
+		tracked.sentLoc = tracked.loc
+		tracked.sentSymbol = tracked.symbol
+		tracked.sentHealth = tracked.health
+	}
+	for i := len(kept); i < len(self.tracked); i++ {
+		self.tracked[i] = nil
+	}
+	self.tracked = kept
+	self.freeHandles = append(self.freeHandles, freed...)
+}
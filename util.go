@@ -16,6 +16,13 @@ func abs(n int64) int64 {
 	}
 }
 
+func bool2byte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func bool2rune(b bool) rune {
 	if b {
 		return '1'
@@ -62,6 +69,15 @@ func subtractGridList(grids *(map[GridCoord]bool), gridList []GridCoord) {
 	}
 }
 
+func sortedGrids(grids *(map[GridCoord]bool)) []GridCoord {
+	sorted := make(SortableGCoords, 0, len(*grids))
+	for gc, _ := range *grids {
+		sorted = append(sorted, gc)
+	}
+	sort.Sort(sorted)
+	return sorted
+}
+
 func intersectGrids(gr1, gr2 *(map[GridCoord]bool)) {
 	for gc, _ := range *gr1 {
 		if _, present := (*gr2)[gc]; !present {